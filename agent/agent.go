@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +21,10 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"k6-agent/sketch"
 )
 
 // AgentInfo Agent信息结构
@@ -26,10 +32,11 @@ type AgentInfo struct {
 	AgentID    string            `json:"agent_id"`
 	Hostname   string            `json:"hostname"`
 	IP         string            `json:"ip"`
+	IPs        []string          `json:"ips,omitempty"`
 	OS         string            `json:"os"`
 	Arch       string            `json:"arch"`
 	K6Version  string            `json:"k6_version"`
-	Resources  map[string]int    `json:"resources"`
+	Resources  *HostResources    `json:"resources"`
 	Tags       map[string]string `json:"tags,omitempty"`
 	Timestamp  time.Time         `json:"timestamp"`
 }
@@ -55,9 +62,23 @@ type Job struct {
 	ScriptContent string                 `json:"script_content,omitempty"`
 	Command       string                 `json:"command,omitempty"`
 	Params        map[string]interface{} `json:"params,omitempty"`
+	Options       map[string]interface{} `json:"options,omitempty"` // k6执行选项：vus、duration、iterations、stages
 	Timeout       string                 `json:"timeout,omitempty"`
 	Priority      int                    `json:"priority,omitempty"`
 	Tags          map[string]string      `json:"tags,omitempty"`
+	Outputs       *JobOutputs            `json:"outputs,omitempty"`
+	CallbackURL   string                 `json:"callback_url,omitempty"` // 任务结束后推送结果的地址
+	CallbackLogs  int                    `json:"callback_logs,omitempty"` // 回调附带的最近日志条数，默认不附带
+	
+	// 分布式执行：同一逻辑任务按k6执行段拆分到多个Agent
+	ExecutionSegment         string `json:"execution_segment,omitempty"`          // 例如"1/4:2/4"
+	ExecutionSegmentSequence string `json:"execution_segment_sequence,omitempty"` // 例如"0,1/4,2/4,3/4,1"
+	SegmentID                string `json:"segment_id,omitempty"`                 // 随结果回传，用于合并各段结果，默认为执行段本身
+	StartBarrier             *StartBarrier `json:"start_barrier,omitempty"`       // 各段就绪后同步开始
+	Lease                    *JobLease     `json:"lease,omitempty"`               // 后端分配的租约，确认后才执行
+	
+	receivedAt   time.Time // 轮询开始时间，作为任务链路的起点
+	leaseAckedAt time.Time // 发出租约确认的时间
 }
 
 // JobPollResponse 任务轮询响应
@@ -84,54 +105,110 @@ type JobResultRequest struct {
 	ExecutionTime   int64                  `json:"execution_time"`
 	Log             string                 `json:"log"`
 	Error           string                 `json:"error,omitempty"`
+	ResourceUsage   *ResourceUsage         `json:"resource_usage,omitempty"`
+	GeneratorSaturated bool                `json:"generator_saturated"`
+	GeneratorSamples   []GeneratorSample   `json:"generator_samples,omitempty"`
+	TraceID         string                 `json:"trace_id,omitempty"`
+	LogLines        int64                  `json:"log_lines"` // 日志总条数，Log只包含最近部分
+	Artifacts       *ArtifactManifest      `json:"artifacts,omitempty"`
+	SegmentID       string                 `json:"segment_id,omitempty"`        // 分布式任务的段ID
+	ExecutionSegment string                `json:"execution_segment,omitempty"`
+	LatencySketches map[string]*sketch.Sketch `json:"latency_sketches,omitempty"` // 各trend指标的可合并草图
+	LeaseID         string                 `json:"lease_id,omitempty"`          // 租约失效后后端可据此丢弃结果
 	Timestamp       time.Time              `json:"timestamp"`
 }
 
-// ExecuteRequest 执行请求结构（保持向后兼容）
+// ExecuteRequest 执行请求结构（保持向后兼容），字段与轮询的Job一一对应
 type ExecuteRequest struct {
+	Type          string                 `json:"type,omitempty"` // 默认k6
 	ScriptID      string                 `json:"scriptId"`
 	ScriptContent string                 `json:"scriptContent"`
+	Command       string                 `json:"command,omitempty"`
 	Parameters    map[string]interface{} `json:"parameters"`
 	Options       map[string]interface{} `json:"options"`
+	Timeout       string                 `json:"timeout,omitempty"`
+	Priority      int                    `json:"priority,omitempty"`
+	Tags          map[string]string      `json:"tags,omitempty"`
+	Outputs       *JobOutputs            `json:"outputs,omitempty"`
 	CallbackURL   string                 `json:"callbackUrl"`
+	CallbackLogs  int                    `json:"callbackLogs,omitempty"`
+	ExecutionSegment         string      `json:"executionSegment,omitempty"`
+	ExecutionSegmentSequence string      `json:"executionSegmentSequence,omitempty"`
+	SegmentID                string      `json:"segmentId,omitempty"`
+	StartBarrier             *StartBarrier `json:"startBarrier,omitempty"`
 }
 
 // TaskStatus 任务状态
 type TaskStatus struct {
 	ID          string                 `json:"id"`
-	Status      string                 `json:"status"` // pending, running, completed, failed, stopped
+	Type        string                 `json:"type"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Priority    int                    `json:"priority,omitempty"`
+	Status      string                 `json:"status"` // pending, ready, running, completed, failed, stopped, oom_killed
 	StartTime   time.Time              `json:"startTime"`
 	EndTime     *time.Time             `json:"endTime,omitempty"`
 	Progress    float64                `json:"progress"`
-	Logs        []string               `json:"logs"`
+	Logs        []string               `json:"logs"` // 最近的日志，完整日志通过 /tasks/:taskId/logs 分页读取
 	Result      map[string]interface{} `json:"result,omitempty"`
 	Error       string                 `json:"error,omitempty"`
 	ScriptID    string                 `json:"scriptId"`
 	Parameters  map[string]interface{} `json:"parameters"`
+	ResourceUsage *ResourceUsage       `json:"resourceUsage,omitempty"`
+	Generator   *GeneratorReport       `json:"generator,omitempty"`
+	TraceID     string                 `json:"traceId,omitempty"`
+	Artifacts   *ArtifactManifest      `json:"artifacts,omitempty"`
+	Callback    *CallbackDelivery      `json:"callback,omitempty"`
+	ThresholdsBreached bool            `json:"thresholdsBreached,omitempty"` // k6阈值未通过
+	TimedOut    bool                   `json:"timedOut,omitempty"`           // 超过任务timeout被终止
+	SegmentID   string                 `json:"segmentId,omitempty"`
+	ExecutionSegment string            `json:"executionSegment,omitempty"`
+	Barrier     *BarrierStatus         `json:"barrier,omitempty"`
+	LatencySketches map[string]*sketch.Sketch `json:"latencySketches,omitempty"`
+	Paused      bool                   `json:"paused,omitempty"` // k6已通过控制接口暂停
+	Lease       *LeaseStatus           `json:"lease,omitempty"`
 }
 
 // Task 执行任务
 type Task struct {
-	Status    *TaskStatus
+	Status    *TaskStatus // 写入经过update，其他goroutine通过snapshot读取
+	mu        sync.RWMutex // 保护Status，以及运行中写入、接口并发读取的OutputDir和K6Address
 	Cmd       *exec.Cmd
 	Ctx       context.Context
 	Cancel    context.CancelFunc
-	LogChan   chan string
-	Clients   map[*websocket.Conn]bool
-	ClientsMu sync.RWMutex
+	Log       *taskLog
+	Events    *taskHub // 实时事件，供WebSocket等订阅
+	OutputDir string   // 产物目录，其他goroutine通过outputDir读取
+	Cgroup    *taskCgroup
+	Limits    ResourceLimits // 合并任务参数后生效的资源限制
+	TraceCtx  context.Context // 携带任务根span
+	Span      trace.Span
+	Barrier     *StartBarrier    // 同步开始屏障，为nil表示直接开始
+	StartSignal chan time.Time   // 开始信号，零值表示立即开始
+	K6Address   string           // k6 REST API地址，为空表示不支持实时控制；其他goroutine通过k6Address读取
+	Lease       *taskLease       // 后端分配的租约，为nil表示没有租约
+	
+	timeout      time.Duration           // 任务超时，为0表示不限制，由startTimeout开始计时
+	cancelCause  context.CancelCauseFunc // 超时时以DeadlineExceeded为原因取消Ctx
+	timeoutOnce  sync.Once
+	timeoutTimer *time.Timer
 }
 
 // Agent 代理结构
 type Agent struct {
 	// 基本信息
 	info     *AgentInfo
+	infoMu   sync.RWMutex
+	sampler  *hostSampler
 	serverURL string
 	registrationToken string
 	registered bool
 	
 	// 任务管理
-	tasks   map[string]*Task
-	tasksMu sync.RWMutex
+	tasks    map[string]*Task
+	tasksMu  sync.RWMutex
+	seenJobs map[string]TaskSummary // 已清理任务的最终状态，用于去重，由tasksMu保护
+	callbacks sync.WaitGroup        // 后台投递中的任务回调
+	claiming map[string]bool        // 已占用ID、正在确认的任务，值表示是否占用了并发名额，由tasksMu保护
 	
 	// WebSocket
 	upgrader websocket.Upgrader
@@ -143,9 +220,41 @@ type Agent struct {
 	// HTTP客户端
 	httpClient *http.Client
 	
-	// 配置
+	// 监控指标
+	metrics *agentMetrics
+	
+	// OpenTelemetry导出
+	telemetry *telemetry
+	
+	// 产物上传的对象存储，为nil表示未启用
+	storage *s3Client
+	
+	// 任务生命周期通知
+	notifier *notifier
+	
+	// 根据心跳往返估计的后端时钟偏移
+	clock *clockSync
+	
+	// 协调者模式，为nil表示未启用
+	coordinator *coordinator
+	
+	// 与后端的控制通道，为nil表示未启用
+	channel *controlChannel
+	
+	// 任务来源，默认轮询后端；控制通道推送的任务始终通过httpSource维护租约
+	source     JobSource
+	httpSource *httpJobSource
+	
+	// 配置，可由控制通道修改
+	intervalMu        sync.RWMutex
 	heartbeatInterval time.Duration
 	pollInterval      time.Duration
+	
+	// 资源限制，cgroupRoot为空表示未启用cgroup
+	cgroupRoot    string
+	defaultLimits ResourceLimits
+	// 初始化时发现的配置错误，例如显式启用的cgroup初始化失败、协调者配置无效，Start时返回
+	initErr error
 }
 
 // NewAgent 创建新的Agent实例
@@ -159,17 +268,36 @@ func NewAgent() *Agent {
 	// 生成Agent ID
 	agentID := generateAgentID()
 	
+	// 创建监控指标
+	metrics := newAgentMetrics()
+	
+	// 创建OpenTelemetry导出器，配置无效时退化为空操作
+	tel, err := newTelemetry(telemetryConfigFromViper())
+	if err != nil {
+		logrus.Warnf("OpenTelemetry初始化失败: %v", err)
+	}
+	
+	// 产物对象存储，配置无效时只保留本地产物
+	var storage *s3Client
+	if cfg := s3ConfigFromViper(); cfg.Enabled {
+		if storage, err = newS3Client(cfg, nil); err != nil {
+			logrus.Warnf("对象存储配置无效，产物不会上传: %v", err)
+		}
+	}
+	
+	// 采集主机资源
+	sampler := newHostSampler(workspaceDir(), viper.GetString("backend.url"))
+	resources := sampler.collect()
+	
 	info := &AgentInfo{
 		AgentID:   agentID,
 		Hostname:  hostname,
-		IP:        getLocalIP(),
+		IP:        primaryIP(resources.IPs),
+		IPs:       resources.IPs,
 		OS:        runtime.GOOS,
 		Arch:      runtime.GOARCH,
 		K6Version: k6Version,
-		Resources: map[string]int{
-			"cpu":    runtime.NumCPU(),
-			"memory": getMemoryMB(),
-		},
+		Resources: resources,
 		Tags:      make(map[string]string),
 		Timestamp: time.Now(),
 	}
@@ -179,12 +307,15 @@ func NewAgent() *Agent {
 		info.Tags = viper.GetStringMapString("agent.tags")
 	}
 	
-	return &Agent{
+	agent := &Agent{
 		info:              info,
+		sampler:           sampler,
 		serverURL:         viper.GetString("backend.url"),
 		registrationToken: viper.GetString("agent.registration_token"),
 		registered:        false,
 		tasks:             make(map[string]*Task),
+		seenJobs:          make(map[string]TaskSummary),
+		claiming:          make(map[string]bool),
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true // 允许跨域
@@ -192,14 +323,79 @@ func NewAgent() *Agent {
 		},
 		ctx:               ctx,
 		cancel:            cancel,
-		httpClient:        &http.Client{Timeout: 30 * time.Second},
+		httpClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &instrumentedTransport{next: http.DefaultTransport, metrics: metrics},
+		},
+		metrics:           metrics,
+		telemetry:         tel,
+		storage:           storage,
+		clock:             newClockSync(viper.GetInt("agent.clock_sync_samples")),
 		heartbeatInterval: time.Duration(viper.GetInt("agent.heartbeat_interval")) * time.Second,
 		pollInterval:      time.Duration(viper.GetInt("agent.poll_interval")) * time.Second,
 	}
+	
+	// 协调者模式，配置无效时Agent拒绝启动
+	if viper.GetBool("coordinator.enabled") {
+		if cfg, err := coordinatorConfigFromViper(); err != nil {
+			agent.initErr = fmt.Errorf("协调者配置无效: %v", err)
+		} else {
+			// 节点请求不经过后端客户端，不计入后端请求指标
+			agent.coordinator = newCoordinator(cfg, &http.Client{Timeout: 30 * time.Second})
+		}
+	}
+	
+	// 任务来源，配置无效时回退到轮询后端
+	agent.httpSource = &httpJobSource{agent: agent}
+	if agent.source, err = newJobSource(agent); err != nil {
+		logrus.Warnf("任务来源配置无效，使用HTTP轮询: %v", err)
+		agent.source = agent.httpSource
+	}
+	
+	// 控制通道，配置无效时只使用轮询
+	if viper.GetBool("channel.enabled") && !agent.standalone() {
+		if cfg, err := channelConfigFromViper(agent.serverURL); err != nil {
+			logrus.Warnf("控制通道未启用: %v", err)
+		} else {
+			agent.channel = &controlChannel{cfg: cfg}
+		}
+	}
+	
+	// 回调不签名时接收方无法校验来源
+	if viper.GetString("callback.secret") == "" {
+		logrus.Warn("未配置callback.secret，任务回调(callbackUrl)将不签名发送，接收方无法校验回调来源")
+	}
+	
+	// 任务通知
+	agent.notifier = newNotifierFromViper()
+	agent.notifier.onResult = func(name, result string) {
+		metrics.notifications.WithLabelValues(name, result).Inc()
+	}
+	
+	// 初始化资源限制
+	if err := agent.initResourceLimits(); err != nil && agent.initErr == nil {
+		agent.initErr = err
+	}
+	
+	return agent
 }
 
 // Start 启动Agent
 func (a *Agent) Start() error {
+	if a.initErr != nil {
+		return a.initErr
+	}
+	// 未配置后端时只通过本地API接收任务，例如由协调者分发
+	if a.standalone() {
+		go a.startTaskCleanup()
+		// 消息队列等不依赖后端的任务来源照常拉取
+		if !a.pollsBackend() {
+			go a.startJobPolling()
+		}
+		logrus.Infof("Agent %s 以独立模式启动，未连接后端", a.info.AgentID)
+		return nil
+	}
+	
 	// 注册到后端
 	if err := a.register(); err != nil {
 		logrus.Errorf("Agent注册失败: %v", err)
@@ -209,25 +405,53 @@ func (a *Agent) Start() error {
 	// 启动心跳
 	go a.startHeartbeat()
 	
-	// 启动任务轮询
+	// 启动任务轮询，控制通道连接期间暂停
 	go a.startJobPolling()
+	if a.channel != nil {
+		go a.startChannel()
+	}
+	
+	// 定期清理已结束的任务
+	go a.startTaskCleanup()
 	
 	logrus.Infof("Agent %s 启动成功", a.info.AgentID)
 	return nil
 }
 
+// standalone 是否以独立模式运行（backend.url为空）
+func (a *Agent) standalone() bool {
+	return a.serverURL == ""
+}
+
 // Stop 停止Agent
 func (a *Agent) Stop() {
 	a.cancel()
+	if closer, ok := a.source.(io.Closer); ok {
+		closer.Close()
+	}
+	// 取消后回调不再重试，等待进行中的请求返回
+	a.callbacks.Wait()
+	if !a.notifier.wait(notifierStopTimeout) {
+		logrus.Warnf("等待任务通知发送超时，未完成的通知被放弃")
+	}
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a.telemetry.shutdown(ctx)
+	
 	logrus.Infof("Agent %s 已停止", a.info.AgentID)
 }
 
 // register 注册到后端
 func (a *Agent) register() error {
+	a.refreshResources()
+	
+	a.infoMu.RLock()
 	req := RegisterRequest{
 		AgentInfo:         *a.info,
 		RegistrationToken: a.registrationToken,
 	}
+	a.infoMu.RUnlock()
 	
 	reqBody, err := json.Marshal(req)
 	if err != nil {
@@ -275,7 +499,8 @@ func (a *Agent) register() error {
 
 // startHeartbeat 启动心跳
 func (a *Agent) startHeartbeat() {
-	ticker := time.NewTicker(a.heartbeatInterval)
+	heartbeat, _ := a.intervals()
+	ticker := time.NewTicker(heartbeat)
 	defer ticker.Stop()
 	
 	for {
@@ -286,26 +511,56 @@ func (a *Agent) startHeartbeat() {
 			if err := a.sendHeartbeat(); err != nil {
 				logrus.Errorf("发送心跳失败: %v", err)
 			}
+			heartbeat, _ = a.intervals()
+			ticker.Reset(heartbeat)
 		}
 	}
 }
 
+// intervals 当前的心跳和轮询间隔
+func (a *Agent) intervals() (heartbeat, poll time.Duration) {
+	a.intervalMu.RLock()
+	defer a.intervalMu.RUnlock()
+	return a.heartbeatInterval, a.pollInterval
+}
+
+// setIntervals 修改心跳和轮询间隔，为0的项保持不变，下一个周期生效
+func (a *Agent) setIntervals(heartbeat, poll time.Duration) {
+	a.intervalMu.Lock()
+	defer a.intervalMu.Unlock()
+	if heartbeat > 0 {
+		a.heartbeatInterval = heartbeat
+	}
+	if poll > 0 {
+		a.pollInterval = poll
+	}
+}
+
 // sendHeartbeat 发送心跳
 func (a *Agent) sendHeartbeat() error {
-	a.info.Timestamp = time.Now()
+	// 每次心跳重新采集主机资源
+	a.refreshResources()
 	
+	a.infoMu.RLock()
 	// 构造心跳请求数据，匹配后端期望的格式
 	heartbeatData := map[string]interface{}{
 		"agent_id":  a.info.AgentID,
 		"timestamp": a.info.Timestamp.Format(time.RFC3339),
+		"ip":        a.info.IP,
 		"resources": a.info.Resources,
 	}
+	a.infoMu.RUnlock()
+	if offset, rtt, ok := a.clock.estimate(); ok {
+		heartbeatData["clock_offset_ms"] = float64(offset.Microseconds()) / 1000
+		heartbeatData["rtt_ms"] = float64(rtt.Microseconds()) / 1000
+	}
 	
 	reqBody, err := json.Marshal(heartbeatData)
 	if err != nil {
 		return fmt.Errorf("序列化心跳请求失败: %v", err)
 	}
 	
+	sent := time.Now()
 	resp, err := a.httpClient.Post(
 		a.serverURL+"/api/v1/agents/heartbeat",
 		"application/json",
@@ -314,6 +569,7 @@ func (a *Agent) sendHeartbeat() error {
 	if err != nil {
 		return fmt.Errorf("发送心跳请求失败: %v", err)
 	}
+	received := time.Now()
 	defer resp.Body.Close()
 	
 	// 接受200和201状态码作为成功响应
@@ -325,13 +581,18 @@ func (a *Agent) sendHeartbeat() error {
 	// 读取并记录成功响应
 	body, _ := io.ReadAll(resp.Body)
 	logrus.Debugf("心跳成功，响应: %s", string(body))
+	a.metrics.markHeartbeat()
+	
+	// 用往返时间估计与后端的时钟偏移，供同步开始使用
+	a.clock.observe(sent, received, heartbeatServerTime(resp, body))
 	
 	return nil
 }
 
 // startJobPolling 启动任务轮询
 func (a *Agent) startJobPolling() {
-	ticker := time.NewTicker(a.pollInterval)
+	_, poll := a.intervals()
+	ticker := time.NewTicker(poll)
 	defer ticker.Stop()
 	
 	for {
@@ -339,46 +600,51 @@ func (a *Agent) startJobPolling() {
 		case <-a.ctx.Done():
 			return
 		case <-ticker.C:
-			if err := a.pollJob(); err != nil {
-				logrus.Errorf("轮询任务失败: %v", err)
+			// 任务由控制通道推送时不需要轮询后端
+			if !a.channel.up() || !a.pollsBackend() {
+				if err := a.pollJob(); err != nil {
+					logrus.Errorf("轮询任务失败: %v", err)
+				}
 			}
+			_, poll = a.intervals()
+			ticker.Reset(poll)
 		}
 	}
 }
 
-// pollJob 轮询任务
+// pollJob 从任务来源取一个任务并执行
 func (a *Agent) pollJob() error {
-	if !a.registered {
-		return nil // 未注册时不轮询
-	}
-	
-	resp, err := a.httpClient.Get(
-		fmt.Sprintf("%s/api/v1/agents/jobs/poll?agent_id=%s", a.serverURL, a.info.AgentID),
-	)
+	pollStart := time.Now()
+	job, err := a.source.Fetch(a.ctx)
 	if err != nil {
-		return fmt.Errorf("发送轮询请求失败: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
-	
-	// 接受200和201状态码作为成功响应
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("轮询失败，状态码: %d, 响应: %s", resp.StatusCode, string(body))
+	if job == nil {
+		logrus.Debugf("暂无新任务")
+		return nil
 	}
 	
-	var pollResp JobPollResponse
-	if err := json.NewDecoder(resp.Body).Decode(&pollResp); err != nil {
-		return fmt.Errorf("解析轮询响应失败: %v", err)
+	// 确认租约后执行，重复下发的任务只回报已有状态
+	logrus.Infof("接收到新任务: %s", job.ID)
+	if _, dup := a.handleDuplicate(job, a.source.Name()); dup {
+		return nil
 	}
-	
-	// 如果有新任务，执行它
-	if pollResp.Job != nil {
-		logrus.Infof("接收到新任务: %s", pollResp.Job.ID)
-		go a.executeJob(pollResp.Job)
-	} else {
-		logrus.Debugf("暂无新任务")
+	if err := a.claimJob(job); err != nil {
+		a.releaseJob(job.ID)
+		logrus.Warnf("任务 %s 未执行: %v", job.ID, err)
+		return nil
+	}
+	job.receivedAt = pollStart
+	task, err := a.newTask(job)
+	if err != nil {
+		return err
 	}
 	
+	// 轮询本身作为任务链路的第一段
+	_, span := task.startSpan("job.poll", trace.WithTimestamp(pollStart))
+	span.End()
+	
+	go a.runTask(task, job)
 	return nil
 }
 
@@ -391,12 +657,16 @@ func (a *Agent) GetInfo(c *gin.Context) {
 	runningTasks := 0
 	a.tasksMu.RLock()
 	for _, task := range a.tasks {
-		if task.Status.Status == "running" {
+		if task.snapshot().Status == "running" {
 			runningTasks++
 		}
 	}
 	a.tasksMu.RUnlock()
 
+	a.infoMu.RLock()
+	resources := a.info.Resources
+	a.infoMu.RUnlock()
+
 	c.JSON(200, gin.H{
 		"agentId":      a.info.AgentID,
 		"hostname":     a.info.Hostname,
@@ -407,19 +677,42 @@ func (a *Agent) GetInfo(c *gin.Context) {
 		"runningTasks": runningTasks,
 		"timestamp":    time.Now(),
 		"capabilities": []string{"k6", "shell", "websocket", "realtime-logs"},
-		"resources":    a.info.Resources,
+		"resources":    resources,
 		"tags":         a.info.Tags,
 	})
 }
 
-// executeJob 执行任务
+// executeJob 执行任务，同ID的任务已存在时不重复执行
 func (a *Agent) executeJob(job *Job) {
-	logrus.Infof("开始执行任务: %s, 类型: %s", job.ID, job.Type)
-	
-	// 创建任务
+	if _, dup := a.handleDuplicate(job, jobSourceLocal); dup {
+		return
+	}
+	task, err := a.newTask(job)
+	if err != nil {
+		logrus.Errorf("任务 %s 未执行: %v", job.ID, err)
+		return
+	}
+	a.runTask(task, job)
+}
+
+// newTask 创建并登记任务，登记后即可通过状态接口查询。同ID的任务已登记时拒绝，
+// 不会覆盖正在运行的任务和它的日志
+func (a *Agent) newTask(job *Job) (*Task, error) {
+	a.tasksMu.RLock()
+	_, exists := a.tasks[job.ID]
+	a.tasksMu.RUnlock()
+	if exists {
+		return nil, fmt.Errorf("任务 %s 已存在", job.ID)
+	}
+
 	task := &Task{
 		Status: &TaskStatus{
 			ID:         job.ID,
+			Type:       job.Type,
+			Tags:       job.Tags,
+			Priority:   job.Priority,
+			SegmentID:  job.segmentID(),
+			ExecutionSegment: job.ExecutionSegment,
 			Status:     "pending",
 			StartTime:  time.Now(),
 			Progress:   0,
@@ -427,66 +720,198 @@ func (a *Agent) executeJob(job *Job) {
 			ScriptID:   job.ScriptID,
 			Parameters: job.Params,
 		},
-		LogChan: make(chan string, 100),
-		Clients: make(map[*websocket.Conn]bool),
+		Events: newTaskHub(viper.GetInt("events.history_size"), viper.GetInt("events.client_buffer")),
+	}
+	if job.StartBarrier != nil {
+		task.Barrier = job.StartBarrier
+		task.StartSignal = make(chan time.Time, 1)
 	}
+	if job.Lease != nil {
+		task.Lease = newTaskLease(job.Lease, leaseConfigFromViper())
+		if !job.leaseAckedAt.IsZero() {
+			task.Lease.extend(job.leaseAckedAt, false)
+		}
+	}
+	task.Events.onLag = a.metrics.eventSubscribersLagged.Inc
 	
 	// 创建上下文
-	task.Ctx, task.Cancel = context.WithCancel(context.Background())
+	task.Ctx, task.cancelCause = context.WithCancelCause(context.Background())
+	task.Cancel = func() { task.cancelCause(nil) }
+	
+	// 任务日志，目录不可用时只保留在内存中
+	log, err := newTaskLog(taskLogConfigFromViper(job.ID))
+	if err != nil {
+		logrus.Warnf("任务 %s 的日志无法落盘: %v", job.ID, err)
+	}
+	task.Log = log
 	
-	// 设置超时
+	// 创建任务链路
+	a.infoMu.RLock()
+	agentID := a.info.AgentID
+	a.infoMu.RUnlock()
+	task.TraceCtx, task.Span = a.telemetry.startJobSpan(job, agentID, job.receivedAt)
+	task.Status.TraceID = task.traceID()
+	
+	// 设置超时，在runTask或同步开始屏障放行后才开始计时
 	if job.Timeout != "" {
 		if timeout, err := time.ParseDuration(job.Timeout); err == nil {
-			task.Ctx, task.Cancel = context.WithTimeout(task.Ctx, timeout)
+			task.timeout = timeout
 		}
 	}
 	
-	// 保存任务
+	// 保存任务，检查和登记之间被同ID的任务抢先时放弃
 	a.tasksMu.Lock()
+	if _, exists := a.tasks[job.ID]; exists {
+		a.tasksMu.Unlock()
+		err := fmt.Errorf("任务 %s 已存在", job.ID)
+		task.Cancel()
+		task.Log.close()
+		endSpan(task.Span, err)
+		return nil, err
+	}
 	a.tasks[job.ID] = task
+	delete(a.claiming, job.ID)
 	a.tasksMu.Unlock()
 	
+	a.metrics.jobQueued(job.Type)
+	return task, nil
+}
+
+// startTimeout 开始计算任务超时，重复调用无效。
+// 有同步开始屏障的任务在屏障放行后才调用，等待开始的时间不计入超时，由屏障自己的时限约束
+func (t *Task) startTimeout() {
+	t.timeoutOnce.Do(func() {
+		if t.timeout > 0 {
+			t.timeoutTimer = time.AfterFunc(t.timeout, func() { t.cancelCause(context.DeadlineExceeded) })
+		}
+	})
+}
+
+// stopTimeout 任务结束后停止超时计时
+func (t *Task) stopTimeout() {
+	t.timeoutOnce.Do(func() {})
+	if t.timeoutTimer != nil {
+		t.timeoutTimer.Stop()
+	}
+}
+
+// timedOut 任务是否因超时被取消
+func (t *Task) timedOut() bool {
+	return errors.Is(context.Cause(t.Ctx), context.DeadlineExceeded)
+}
+
+// runTask 运行已登记的任务并回传结果
+func (a *Agent) runTask(task *Task, job *Job) {
+	logrus.Infof("开始执行任务: %s, 类型: %s", job.ID, job.Type)
+	
+	// 运行期间持续续约，直到结果回传
+	stopLease := a.keepLease(task, job)
+	
 	// 上报任务开始
+	a.metrics.jobStarted(job.Type)
 	a.reportJobStatus(job.ID, "running", 0, "任务开始执行")
+	a.notifyTask(task, notifyStarted)
 	
-	// 根据任务类型执行
-	var err error
-	switch job.Type {
-	case "k6":
-		err = a.executeK6Job(task, job)
-	case "shell":
-		err = a.executeShellJob(task, job)
-	case "python":
-		err = a.executePythonJob(task, job)
-	case "docker":
-		err = a.executeDockerJob(task, job)
-	default:
-		err = fmt.Errorf("不支持的任务类型: %s", job.Type)
+	// 创建任务cgroup后根据任务类型执行
+	// 产物目录不可用时任务照常执行，只是不收集产物
+	if err := task.prepareOutputDir(); err != nil {
+		logrus.Warnf("任务 %s: %v", job.ID, err)
+	}
+	
+	// 同步开始屏障只作用于k6任务，其他任务立即开始计算超时
+	if task.Barrier == nil || job.Type != "k6" {
+		task.startTimeout()
+	}
+	err := a.setupTaskCgroup(task, job)
+	if err == nil {
+		err = a.dispatchJob(task, job)
+	}
+	task.stopTimeout()
+	
+	// 区分k6阈值未通过和任务超时
+	if err != nil {
+		var exitErr *exec.ExitError
+		if job.Type == "k6" && errors.As(err, &exitErr) && exitErr.ExitCode() == k6ThresholdsFailedExitCode {
+			task.update(func(s *TaskStatus) { s.ThresholdsBreached = true })
+		}
+		if task.timedOut() {
+			task.update(func(s *TaskStatus) { s.TimedOut = true })
+			err = fmt.Errorf("任务超过超时时间 %s 被终止: %w", job.Timeout, err)
+		}
+		if task.Lease.lost() {
+			err = fmt.Errorf("任务租约失效被终止: %w", err)
+		}
 	}
 	
 	// 处理执行结果
 	now := time.Now()
-	task.Status.EndTime = &now
+	task.update(func(s *TaskStatus) { s.EndTime = &now })
 	
-	if err != nil {
-		task.Status.Status = "failed"
-		task.Status.Error = err.Error()
+	// 回收cgroup并记录资源使用
+	usage := a.releaseTaskCgroup(task)
+	releaseK6Address(task.k6Address())
+	
+	// 生成产物清单并上传到对象存储
+	a.finalizeArtifacts(task)
+	a.uploadArtifacts(task)
+	
+	if usage != nil && usage.OOMKilled {
+		task.fail("oom_killed", fmt.Sprintf("任务内存超出限制被OOM终止 (峰值 %d 字节, 限制 %d 字节)", usage.PeakMemoryBytes, usage.MemoryLimit))
+		logrus.Errorf("任务被OOM终止: %s", job.ID)
+	} else if err != nil {
+		task.fail("failed", err.Error())
 		logrus.Errorf("任务执行失败: %s, 错误: %v", job.ID, err)
 	} else {
-		task.Status.Status = "completed"
-		task.Status.Progress = 1.0
+		task.setProgress(1.0)
+		task.setStatus("completed")
 		logrus.Infof("任务执行完成: %s", job.ID)
 	}
+	status := task.snapshot()
+	a.metrics.jobFinished(job.Type, status.Status, now.Sub(status.StartTime))
+	a.notifyTaskFinished(task)
 	
 	// 回传结果
 	a.reportJobResult(job.ID, task)
+	stopLease()
+	if job.CallbackURL != "" {
+		a.startCallback(task, job)
+	}
 	
-	// 清理
-	close(task.LogChan)
+	// 结束任务链路
+	task.Span.SetAttributes(attribute.String("job.status", status.Status))
+	if status.Error != "" {
+		endSpan(task.Span, errors.New(status.Error))
+	} else {
+		endSpan(task.Span, nil)
+	}
+	
+	// 清理，关闭实时订阅
+	task.Events.close()
+	task.Log.close()
+}
+
+// dispatchJob 根据任务类型执行
+func (a *Agent) dispatchJob(task *Task, job *Job) error {
+	switch job.Type {
+	case "k6":
+		return a.executeK6Job(task, job)
+	case "shell":
+		return a.executeShellJob(task, job)
+	case "python":
+		return a.executePythonJob(task, job)
+	case "docker":
+		return a.executeDockerJob(task, job)
+	default:
+		return fmt.Errorf("不支持的任务类型: %s", job.Type)
+	}
 }
 
 // reportJobStatus 上报任务状态
 func (a *Agent) reportJobStatus(jobID, status string, progress float64, log string) {
+	if a.standalone() {
+		return
+	}
+	
 	req := JobStatusRequest{
 		JobID:     jobID,
 		Status:    status,
@@ -520,40 +945,76 @@ func (a *Agent) reportJobStatus(jobID, status string, progress float64, log stri
 
 // reportJobResult 回传任务结果
 func (a *Agent) reportJobResult(jobID string, task *Task) {
+	_, span := task.startSpan("job.report")
+	var reportErr error
+	defer func() { endSpan(span, reportErr) }()
+	
+	status := task.snapshot()
 	executionTime := int64(0)
-	if task.Status.EndTime != nil {
-		executionTime = task.Status.EndTime.Sub(task.Status.StartTime).Milliseconds()
+	if status.EndTime != nil {
+		executionTime = status.EndTime.Sub(status.StartTime).Milliseconds()
 	}
 	
-	// 收集日志
-	allLogs := strings.Join(task.Status.Logs, "\n")
+	// 只回传最近的日志，完整日志可通过日志接口读取
+	lines := task.logLines()
+	logLines := int64(len(lines))
+	if task.Log != nil {
+		logLines = task.Log.count()
+	}
+	if omitted := logLines - int64(len(lines)); omitted > 0 {
+		lines = append([]string{fmt.Sprintf("... 省略前 %d 条日志，完整日志见 GET /tasks/%s/logs", omitted, task.Status.ID)}, lines...)
+	}
+	allLogs := strings.Join(lines, "\n")
 	
 	req := JobResultRequest{
 		JobID:         jobID,
-		Status:        task.Status.Status,
+		Status:        status.Status,
 		ExitCode:      0,
 		ExecutionTime: executionTime,
 		Log:           allLogs,
-		Error:         task.Status.Error,
+		LogLines:      logLines,
+		Error:         status.Error,
+		ResourceUsage: status.ResourceUsage,
+		TraceID:       status.TraceID,
+		Artifacts:     status.Artifacts,
+		SegmentID:     status.SegmentID,
+		ExecutionSegment: status.ExecutionSegment,
+		LatencySketches: status.LatencySketches,
 		Timestamp:     time.Now(),
 	}
+	if task.Lease != nil {
+		req.LeaseID = task.Lease.current().ID
+	}
+	
+	// 压测机饱和度
+	if status.Generator != nil {
+		req.GeneratorSaturated = status.Generator.Saturated
+		req.GeneratorSamples = status.Generator.Samples
+	}
 	
 	// 如果有结果数据，添加到请求中
-	if task.Status.Result != nil {
-		if metricsJSON, ok := task.Status.Result["metrics_json"]; ok {
+	if status.Result != nil {
+		if metricsJSON, ok := status.Result["metrics_json"]; ok {
 			if str, ok := metricsJSON.(string); ok {
 				req.MetricsJSON = str
 			}
 		}
-		if htmlURL, ok := task.Status.Result["html_report_url"]; ok {
+		if htmlURL, ok := status.Result["html_report_url"]; ok {
 			if str, ok := htmlURL.(string); ok {
 				req.HTMLReportURL = str
 			}
 		}
 	}
+	if req.HTMLReportURL == "" {
+		req.HTMLReportURL = status.Artifacts.reportURL()
+	}
+	if a.standalone() {
+		return
+	}
 	
 	reqBody, err := json.Marshal(req)
 	if err != nil {
+		reportErr = err
 		logrus.Errorf("序列化结果回传请求失败: %v", err)
 		return
 	}
@@ -564,6 +1025,7 @@ func (a *Agent) reportJobResult(jobID string, task *Task) {
 		bytes.NewBuffer(reqBody),
 	)
 	if err != nil {
+		reportErr = err
 		logrus.Errorf("发送结果回传请求失败: %v", err)
 		return
 	}
@@ -571,6 +1033,7 @@ func (a *Agent) reportJobResult(jobID string, task *Task) {
 	
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
+		reportErr = fmt.Errorf("状态码: %d", resp.StatusCode)
 		logrus.Errorf("结果回传失败，状态码: %d, 响应: %s", resp.StatusCode, string(body))
 	} else {
 		logrus.Infof("任务结果回传成功: %s", jobID)
@@ -579,23 +1042,29 @@ func (a *Agent) reportJobResult(jobID string, task *Task) {
 
 // ExecuteScript 执行脚本（保持向后兼容）
 func (a *Agent) ExecuteScript(c *gin.Context) {
-	var req ExecuteRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(400, gin.H{"error": "无效的请求参数: " + err.Error()})
+	req, ferr := decodeExecuteRequest(c.Request.Body)
+	if ferr == nil {
+		ferr = req.validate()
+	}
+	if ferr != nil {
+		c.JSON(400, gin.H{"error": "无效的请求参数: " + ferr.Error(), "field": ferr.Field})
 		return
 	}
-
-	// 转换为Job格式
-	job := &Job{
-		ID:            generateTaskID(),
-		Type:          "k6",
-		ScriptID:      req.ScriptID,
-		ScriptContent: req.ScriptContent,
-		Params:        req.Parameters,
+	if !localJobTypeAllowed(req.Type) {
+		c.JSON(403, gin.H{"error": fmt.Sprintf("本Agent不允许通过本地API执行 %s 任务，需加入agent.allowed_job_types", req.Type), "field": "type"})
+		return
 	}
 
-	// 异步执行
-	go a.executeJob(job)
+	// 转换为Job格式，与轮询到的任务走相同的执行流程
+	job := req.toJob(generateTaskID())
+
+	// 先登记任务再异步执行，保证返回的taskId立即可查询
+	task, err := a.newTask(job)
+	if err != nil {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	go a.runTask(task, job)
 
 	c.JSON(200, gin.H{
 		"taskId": job.ID,
@@ -617,11 +1086,13 @@ func (a *Agent) GetTaskStatus(c *gin.Context) {
 		return
 	}
 
-	c.JSON(200, task.Status)
+	status := task.snapshot()
+	status.Logs = task.logLines()
+	c.JSON(200, status)
 }
 
-// StopTask 停止任务
-func (a *Agent) StopTask(c *gin.Context) {
+// GetTaskLogs 分页读取任务日志
+func (a *Agent) GetTaskLogs(c *gin.Context) {
 	taskID := c.Param("taskId")
 
 	a.tasksMu.RLock()
@@ -633,18 +1104,77 @@ func (a *Agent) StopTask(c *gin.Context) {
 		return
 	}
 
-	if task.Status.Status == "running" {
+	query := logQuery{Limit: 100, Level: c.Query("level"), Source: c.Query("source")}
+	if v := c.Query("offset"); v != "" {
+		offset, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || offset < 0 {
+			c.JSON(400, gin.H{"error": "无效的offset"})
+			return
+		}
+		query.Offset = offset
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > 1000 {
+			c.JSON(400, gin.H{"error": "limit必须在1到1000之间"})
+			return
+		}
+		query.Limit = limit
+	}
+	if _, ok := logLevelRank[query.Level]; query.Level != "" && !ok {
+		c.JSON(400, gin.H{"error": "无效的level，可选值: debug, info, warn, error"})
+		return
+	}
+
+	if task.Log == nil {
+		c.JSON(404, gin.H{"error": "任务没有可读取的日志"})
+		return
+	}
+	page, err := task.Log.read(query)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, page)
+}
+
+// stopTask 停止运行中或等待开始的任务，任务不存在时返回false
+func (a *Agent) stopTask(taskID string) bool {
+	a.tasksMu.RLock()
+	task, exists := a.tasks[taskID]
+	a.tasksMu.RUnlock()
+	if !exists {
+		return false
+	}
+	
+	// 状态检查和修改在同一次加锁内完成，任务正好结束时不会被改成stopped
+	stopped := false
+	task.update(func(s *TaskStatus) {
+		if s.Status == "running" || s.Status == "ready" {
+			now := time.Now()
+			s.EndTime = &now
+			stopped = true
+		}
+	})
+	if stopped {
 		task.Cancel()
-		task.Status.Status = "stopped"
-		now := time.Now()
-		task.Status.EndTime = &now
+		task.setStatus("stopped")
 		logrus.Infof("任务 %s 已停止", taskID)
 	}
+	return true
+}
+
+// StopTask 停止任务
+func (a *Agent) StopTask(c *gin.Context) {
+	if !a.stopTask(c.Param("taskId")) {
+		c.JSON(404, gin.H{"error": "任务不存在"})
+		return
+	}
 
 	c.JSON(200, gin.H{"message": "任务已停止"})
 }
 
-// HandleWebSocket 处理WebSocket连接
+// HandleWebSocket 处理WebSocket连接，以JSON推送任务事件，?from=<seq>从指定序号续传
 func (a *Agent) HandleWebSocket(c *gin.Context) {
 	taskID := c.Param("taskId")
 
@@ -657,6 +1187,12 @@ func (a *Agent) HandleWebSocket(c *gin.Context) {
 		return
 	}
 
+	from, err := parseEventSeq(c.Query("from"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "无效的from"})
+		return
+	}
+
 	conn, err := a.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		logrus.Errorf("WebSocket升级失败: %v", err)
@@ -664,64 +1200,244 @@ func (a *Agent) HandleWebSocket(c *gin.Context) {
 	}
 	defer conn.Close()
 
-	// 添加客户端
-	task.ClientsMu.Lock()
-	task.Clients[conn] = true
-	task.ClientsMu.Unlock()
+	a.metrics.wsClients.Inc()
+	defer a.metrics.wsClients.Dec()
 
-	// 发送历史日志
-	for _, log := range task.Status.Logs {
-		conn.WriteMessage(websocket.TextMessage, []byte(log))
-	}
+	sub, replay := task.Events.subscribe(from)
+	defer task.Events.unsubscribe(sub)
 
-	// 监听日志
+	// 读循环只处理pong和关闭帧，超过两个保活周期没有响应视为断开
+	pingInterval := eventPingInterval()
+	conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	})
+	readDone := make(chan struct{})
 	go func() {
-		for log := range task.LogChan {
-			task.ClientsMu.RLock()
-			for client := range task.Clients {
-				if err := client.WriteMessage(websocket.TextMessage, []byte(log)); err != nil {
-					client.Close()
-					delete(task.Clients, client)
-				}
+		defer close(readDone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
 			}
-			task.ClientsMu.RUnlock()
 		}
 	}()
 
-	// 保持连接
+	// 所有写操作都在当前goroutine中完成
+	write := func(event TaskEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(event)
+	}
+	for _, event := range replay {
+		if err := write(event); err != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
 	for {
-		_, _, err := conn.ReadMessage()
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				closeWebSocket(conn, sub, readDone)
+				return
+			}
+			if err := write(event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-readDone:
+			return
+		}
+	}
+}
+
+// HandleTaskEvents 以Server-Sent Events推送任务事件，内容与WebSocket相同，
+// 支持Last-Event-ID续传，供无法使用WebSocket的代理环境
+func (a *Agent) HandleTaskEvents(c *gin.Context) {
+	taskID := c.Param("taskId")
+
+	a.tasksMu.RLock()
+	task, exists := a.tasks[taskID]
+	a.tasksMu.RUnlock()
+
+	if !exists {
+		c.JSON(404, gin.H{"error": "任务不存在"})
+		return
+	}
+
+	// 浏览器重连时带Last-Event-ID，首次连接可用from指定起点
+	var from int64
+	if lastID := c.GetHeader("Last-Event-ID"); lastID != "" {
+		seq, err := parseEventSeq(lastID)
 		if err != nil {
-			break
+			c.JSON(400, gin.H{"error": "无效的Last-Event-ID"})
+			return
+		}
+		from = seq + 1
+	} else {
+		seq, err := parseEventSeq(c.Query("from"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": "无效的from"})
+			return
+		}
+		from = seq
+	}
+
+	sub, replay := task.Events.subscribe(from)
+	defer task.Events.unsubscribe(sub)
+
+	// 任务已结束且没有需要补发的事件，204使EventSource停止重连
+	if len(replay) == 0 && task.Events.isClosed() {
+		c.Status(204)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // 关闭nginx缓冲
+	c.Status(200)
+
+	write := func(event TaskEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if event.Seq > 0 {
+			fmt.Fprintf(c.Writer, "id: %d\n", event.Seq)
+		}
+		_, err = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event.Type, data)
+		return err
+	}
+	for _, event := range replay {
+		if err := write(event); err != nil {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(eventPingInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				// 客户端过慢时直接断开，EventSource会带Last-Event-ID重连续传；
+				// 任务结束时发送end事件，客户端收到后应关闭连接
+				if !sub.lagged {
+					fmt.Fprint(c.Writer, "event: end\ndata: {}\n\n")
+					c.Writer.Flush()
+				}
+				return
+			}
+			if err := write(event); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-ticker.C:
+			// 注释行作为心跳，防止代理关闭空闲连接
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
 		}
 	}
+}
 
-	// 移除客户端
-	task.ClientsMu.Lock()
-	delete(task.Clients, conn)
-	task.ClientsMu.Unlock()
+// parseEventSeq 解析事件序号，空字符串为0
+func parseEventSeq(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, fmt.Errorf("无效的事件序号: %s", v)
+	}
+	return seq, nil
+}
+
+// closeWebSocket 订阅结束时发送关闭帧：任务结束为1000，客户端过慢为1013并提示续传序号
+func closeWebSocket(conn *websocket.Conn, sub *hubSubscriber, readDone <-chan struct{}) {
+	code, reason := websocket.CloseNormalClosure, "任务已结束"
+	if sub.lagged {
+		code = websocket.CloseTryAgainLater
+		reason = fmt.Sprintf("客户端处理过慢，请从序号 %d 续传", sub.lastSeq()+1)
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+
+	// 等待客户端回应关闭帧
+	select {
+	case <-readDone:
+	case <-time.After(time.Second):
+	}
 }
 
 // executeK6Job 执行k6任务
 func (a *Agent) executeK6Job(task *Task, job *Job) error {
+	if _, err := checkExecutionSegment(job.ExecutionSegment, job.ExecutionSegmentSequence); err != nil {
+		return fmt.Errorf("执行段配置无效: %v", err)
+	}
+	
 	// 使用现有的executor.go中的逻辑
 	executor := NewExecutor()
 	executor.SetAgent(a)
+	
+	// 实时k6指标，任务结束后保留一段时间供Prometheus抓取
+	executor.SetLiveStats(a.metrics.k6.track(job))
+	defer a.metrics.k6.release(job.ID)
+	
+	// 任务级外部输出
+	if job.Outputs != nil && job.Outputs.InfluxDB != nil {
+		sink, err := newInfluxSink(*job.Outputs.InfluxDB, a.jobOutputTags(job))
+		if err != nil {
+			return fmt.Errorf("InfluxDB输出配置无效: %v", err)
+		}
+		defer sink.close() // k6未能启动时也要释放
+		executor.AddSink(sink)
+	}
+	if sink := a.telemetry.k6Sink(job.ID, a.jobOutputTags(job)); sink != nil {
+		executor.AddSink(sink)
+	}
+	
+	// 可合并的延迟草图，随结果上报，供后端计算分布式任务的整体分位数
+	var sketches *k6Sketches
+	if cfg := sketchConfigFromViper(); cfg.Enabled {
+		sketches = newK6Sketches(cfg)
+		executor.AddSink(sketches)
+	}
+	
 	req := ExecuteRequest{
 		ScriptID:      job.ScriptID,
 		ScriptContent: job.ScriptContent,
 		Parameters:    job.Params,
+		Options:       job.Options,
+		ExecutionSegment:         job.ExecutionSegment,
+		ExecutionSegmentSequence: job.ExecutionSegmentSequence,
+	}
+	err := executor.Execute(task, req)
+	if sketches != nil {
+		result := sketches.result()
+		task.update(func(s *TaskStatus) { s.LatencySketches = result })
 	}
-	return executor.Execute(task, req)
+	return err
 }
 
+// processWaitDelay 任务进程被终止后等待输出管道关闭的最长时间
+const processWaitDelay = 2 * time.Second
+
 // executeShellJob 执行Shell任务
 func (a *Agent) executeShellJob(task *Task, job *Job) error {
 	if job.Command == "" {
 		return fmt.Errorf("Shell任务缺少命令")
 	}
 	
-	task.Status.Status = "running"
+	task.setStatus("running")
 	a.reportJobStatus(job.ID, "running", 0.1, "开始执行Shell命令")
 	
 	// 创建命令
@@ -731,6 +1447,8 @@ func (a *Agent) executeShellJob(task *Task, job *Job) error {
 	} else {
 		cmd = exec.CommandContext(task.Ctx, "/bin/sh", "-c", job.Command)
 	}
+	cmd.WaitDelay = processWaitDelay // 超时终止后不等待仍持有输出管道的子进程
+	task.useOutputDir(cmd, true)
 	
 	// 设置输出
 	var stdout, stderr bytes.Buffer
@@ -738,20 +1456,14 @@ func (a *Agent) executeShellJob(task *Task, job *Job) error {
 	cmd.Stderr = &stderr
 	
 	// 执行命令
-	err := cmd.Run()
+	err := task.runCommand(cmd)
 	
 	// 收集输出
 	outputLog := stdout.String()
 	errorLog := stderr.String()
 	
-	if outputLog != "" {
-		task.Status.Logs = append(task.Status.Logs, "STDOUT: "+outputLog)
-		a.broadcastLog(task, "STDOUT: "+outputLog)
-	}
-	if errorLog != "" {
-		task.Status.Logs = append(task.Status.Logs, "STDERR: "+errorLog)
-		a.broadcastLog(task, "STDERR: "+errorLog)
-	}
+	a.logOutput(task, "stdout", outputLog)
+	a.logOutput(task, "stderr", errorLog)
 	
 	if err != nil {
 		a.reportJobStatus(job.ID, "failed", 0.5, fmt.Sprintf("Shell命令执行失败: %v", err))
@@ -768,11 +1480,11 @@ func (a *Agent) executePythonJob(task *Task, job *Job) error {
 		return fmt.Errorf("Python任务缺少脚本内容")
 	}
 	
-	task.Status.Status = "running"
+	task.setStatus("running")
 	a.reportJobStatus(job.ID, "running", 0.1, "开始执行Python脚本")
 	
 	// 创建临时脚本文件
-	tempDir := filepath.Join(os.TempDir(), "k6-agent", job.ID)
+	tempDir := filepath.Join(taskWorkspace(job.ID), "python")
 	if err := os.MkdirAll(tempDir, 0755); err != nil {
 		return fmt.Errorf("创建临时目录失败: %v", err)
 	}
@@ -785,26 +1497,22 @@ func (a *Agent) executePythonJob(task *Task, job *Job) error {
 	
 	// 执行Python脚本
 	cmd := exec.CommandContext(task.Ctx, "python", scriptFile)
+	cmd.WaitDelay = processWaitDelay
 	cmd.Dir = tempDir
+	task.useOutputDir(cmd, false)
 	
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	
-	err := cmd.Run()
+	err := task.runCommand(cmd)
 	
 	// 收集输出
 	outputLog := stdout.String()
 	errorLog := stderr.String()
 	
-	if outputLog != "" {
-		task.Status.Logs = append(task.Status.Logs, "STDOUT: "+outputLog)
-		a.broadcastLog(task, "STDOUT: "+outputLog)
-	}
-	if errorLog != "" {
-		task.Status.Logs = append(task.Status.Logs, "STDERR: "+errorLog)
-		a.broadcastLog(task, "STDERR: "+errorLog)
-	}
+	a.logOutput(task, "stdout", outputLog)
+	a.logOutput(task, "stderr", errorLog)
 	
 	if err != nil {
 		a.reportJobStatus(job.ID, "failed", 0.5, fmt.Sprintf("Python脚本执行失败: %v", err))
@@ -821,7 +1529,7 @@ func (a *Agent) executeDockerJob(task *Task, job *Job) error {
 		return fmt.Errorf("Docker任务缺少命令")
 	}
 	
-	task.Status.Status = "running"
+	task.setStatus("running")
 	a.reportJobStatus(job.ID, "running", 0.1, "开始执行Docker命令")
 	
 	// 解析Docker命令
@@ -832,25 +1540,20 @@ func (a *Agent) executeDockerJob(task *Task, job *Job) error {
 	
 	// 执行Docker命令
 	cmd := exec.CommandContext(task.Ctx, "docker", args...)
+	cmd.WaitDelay = processWaitDelay
 	
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	
-	err := cmd.Run()
+	err := task.runCommand(cmd)
 	
 	// 收集输出
 	outputLog := stdout.String()
 	errorLog := stderr.String()
 	
-	if outputLog != "" {
-		task.Status.Logs = append(task.Status.Logs, "STDOUT: "+outputLog)
-		a.broadcastLog(task, "STDOUT: "+outputLog)
-	}
-	if errorLog != "" {
-		task.Status.Logs = append(task.Status.Logs, "STDERR: "+errorLog)
-		a.broadcastLog(task, "STDERR: "+errorLog)
-	}
+	a.logOutput(task, "stdout", outputLog)
+	a.logOutput(task, "stderr", errorLog)
 	
 	if err != nil {
 		a.reportJobStatus(job.ID, "failed", 0.5, fmt.Sprintf("Docker命令执行失败: %v", err))
@@ -861,14 +1564,6 @@ func (a *Agent) executeDockerJob(task *Task, job *Job) error {
 	return nil
 }
 
-// broadcastLog 广播日志到WebSocket客户端
-func (a *Agent) broadcastLog(task *Task, log string) {
-	select {
-	case task.LogChan <- log:
-	default:
-		// 如果通道满了，跳过这条日志
-	}
-}
 
 // 辅助函数
 func generateAgentID() string {
@@ -900,13 +1595,22 @@ func getK6Version() string {
 	return "unknown"
 }
 
-func getLocalIP() string {
-	// 简单实现，实际可能需要更复杂的逻辑
+// primaryIP 取主IP，没有可用网卡地址时回退到回环地址
+func primaryIP(ips []string) string {
+	if len(ips) > 0 {
+		return ips[0]
+	}
 	return "127.0.0.1"
 }
 
-func getMemoryMB() int {
-	// 简单实现，返回固定值
-	// 实际应该读取系统内存信息
-	return 8192
+// refreshResources 重新采集主机资源并更新Agent信息
+func (a *Agent) refreshResources() {
+	resources := a.sampler.collect()
+	
+	a.infoMu.Lock()
+	a.info.Resources = resources
+	a.info.IPs = resources.IPs
+	a.info.IP = primaryIP(resources.IPs)
+	a.info.Timestamp = time.Now()
+	a.infoMu.Unlock()
 }
\ No newline at end of file
@@ -2,14 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMain(m *testing.M) {
@@ -22,6 +28,13 @@ func setupTestAgent() *Agent {
 	return NewAgent()
 }
 
+// newTestTask 登记任务，同ID的任务已存在时测试失败
+func newTestTask(t *testing.T, agent *Agent, job *Job) *Task {
+	task, err := agent.newTask(job)
+	require.NoError(t, err)
+	return task
+}
+
 func TestNewAgent(t *testing.T) {
 	agent := NewAgent()
 	assert.NotNil(t, agent)
@@ -120,6 +133,155 @@ func TestExecuteScriptInvalidRequest(t *testing.T) {
 	assert.Contains(t, response, "error")
 }
 
+func TestExecuteScriptValidation(t *testing.T) {
+	agent := setupTestAgent()
+	router := gin.New()
+	router.POST("/execute", agent.ExecuteScript)
+
+	cases := []struct {
+		body  string
+		field string
+	}{
+		{`{"scriptContent": "x", "vu": 1}`, "vu"},
+		{`{"scriptContent": "x", "priority": "high"}`, "priority"},
+		{`{"type": "ruby", "command": "x"}`, "type"},
+		{`{"type": "k6"}`, "scriptContent"},
+		{`{"type": "shell"}`, "command"},
+		{`{"type": "python", "command": "x", "scriptContent": "print(1)"}`, "command"},
+		{`{"type": "shell", "command": "true", "options": {"vus": 1}}`, "options"},
+		{`{"scriptContent": "x", "options": {"vus": 1.5}}`, "options.vus"},
+		{`{"scriptContent": "x", "options": {"duration": "soon"}}`, "options.duration"},
+		{`{"scriptContent": "x", "options": {"rps": 10}}`, "options.rps"},
+		{`{"scriptContent": "x", "options": {"stages": [{"duration": "10s", "target": -1}]}}`, "options.stages[0].target"},
+		{`{"scriptContent": "x", "timeout": "10"}`, "timeout"},
+		{`{"scriptContent": "x", "priority": -1}`, "priority"},
+		{`{"scriptContent": "x", "tags": {"": "v"}}`, "tags"},
+		{`{"scriptContent": "x", "outputs": {"influxdb": {"url": "http://influx:8086"}}}`, "outputs.influxdb"},
+		{`{"scriptContent": "x", "callbackUrl": "backend/callback"}`, "callbackUrl"},
+		{`{"scriptContent": "x", "executionSegment": "1/4:3/4", "executionSegmentSequence": "0,1/4,2/4,3/4,1"}`, "executionSegment"},
+		{`{"scriptContent": "x", "executionSegment": "0:1/2", "executionSegmentSequence": "0,1/2,1/2,1"}`, "executionSegmentSequence"},
+		{`{"type": "shell", "command": "true", "segmentId": "a"}`, "executionSegment"},
+		{`{"type": "shell", "command": "true", "startBarrier": {"id": "run-1"}}`, "startBarrier"},
+		{`{"scriptContent": "x", "startBarrier": {"timeout": "soon"}}`, "startBarrier.timeout"},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest("POST", "/execute", bytes.NewBufferString(tc.body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code, tc.body)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, tc.field, response["field"], tc.body)
+	}
+}
+
+func TestExecuteRejectsDisallowedTypes(t *testing.T) {
+	agent := setupTestAgent()
+	router := gin.New()
+	router.POST("/execute", agent.ExecuteScript)
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/execute", bytes.NewBufferString(body)))
+		return w.Code
+	}
+
+	// 未配置allowed_job_types时本地API只接受k6任务
+	assert.Equal(t, 403, post(`{"type": "shell", "command": "id"}`))
+	assert.Equal(t, 403, post(`{"type": "docker", "command": "run alpine"}`))
+
+	viper.Set("agent.allowed_job_types", []string{"python"})
+	defer viper.Set("agent.allowed_job_types", []string{})
+	assert.Equal(t, 403, post(`{"type": "shell", "command": "id"}`))
+	assert.Equal(t, 403, post(`{"scriptContent": "export default function() {}"}`))
+	agent.tasksMu.RLock()
+	assert.Empty(t, agent.tasks)
+	agent.tasksMu.RUnlock()
+}
+
+func TestExecuteRequestToJob(t *testing.T) {
+	req, ferr := decodeExecuteRequest(strings.NewReader(`{
+		"scriptId": "script-1",
+		"parameters": {"BASE_URL": "http://example.com"},
+		"options": {"vus": 10, "duration": "30s", "stages": [{"duration": "10s", "target": 5}, {"duration": "1m", "target": 0}]},
+		"timeout": "10m",
+		"priority": 3,
+		"tags": {"env": "staging"},
+		"callbackUrl": "http://backend/callback"
+	}`))
+	require.Nil(t, ferr)
+	require.Nil(t, req.validate())
+
+	job := req.toJob("task-1")
+	assert.Equal(t, "k6", job.Type)
+	assert.Equal(t, "script-1", job.ScriptID)
+	assert.Equal(t, float64(10), job.Options["vus"])
+	assert.Equal(t, "10m", job.Timeout)
+	assert.Equal(t, 3, job.Priority)
+	assert.Equal(t, map[string]string{"env": "staging"}, job.Tags)
+	assert.Equal(t, "http://backend/callback", job.CallbackURL)
+	assert.Equal(t, "10s:5,1m:0", k6StagesArg(job.Options["stages"]))
+}
+
+func TestK6StagesArgLargeTarget(t *testing.T) {
+	req, ferr := decodeExecuteRequest(strings.NewReader(`{
+		"scriptContent": "export default function() {}",
+		"options": {"vus": 2000000, "iterations": 10000000, "stages": [{"duration": "1m", "target": 1000000}, {"duration": "30s", "target": 25000000}]}
+	}`))
+	require.Nil(t, ferr)
+	require.Nil(t, req.validate())
+
+	// 较大的整数不能格式化为科学计数法
+	assert.Equal(t, "1m:1000000,30s:25000000", k6StagesArg(req.Options["stages"]))
+	assert.Equal(t, "2000000", k6IntArg(req.Options["vus"]))
+	assert.Equal(t, "10000000", k6IntArg(req.Options["iterations"]))
+}
+
+func TestExecuteShellJobWithCallback(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("依赖/bin/sh")
+	}
+	viper.Set("resources.workspace_dir", t.TempDir())
+	defer viper.Set("resources.workspace_dir", "")
+
+	callbacks := make(chan map[string]interface{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		callbacks <- payload
+	}))
+	defer backend.Close()
+
+	viper.Set("agent.allowed_job_types", []string{"k6", "shell"})
+	defer viper.Set("agent.allowed_job_types", []string{})
+
+	agent := setupTestAgent()
+	router := gin.New()
+	router.POST("/execute", agent.ExecuteScript)
+
+	body := fmt.Sprintf(`{"type": "shell", "command": "echo hello", "timeout": "30s", "priority": 2, "tags": {"team": "perf"}, "callbackUrl": %q, "callbackLogs": 10}`, backend.URL)
+	req, _ := http.NewRequest("POST", "/execute", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code, w.Body.String())
+
+	select {
+	case payload := <-callbacks:
+		assert.Equal(t, "completed", payload["status"])
+		assert.Contains(t, fmt.Sprint(payload["logs"]), "hello")
+
+		agent.tasksMu.RLock()
+		task := agent.tasks[payload["taskId"].(string)]
+		agent.tasksMu.RUnlock()
+		require.NotNil(t, task)
+		assert.Equal(t, "shell", task.Status.Type)
+		assert.Equal(t, 2, task.Status.Priority)
+		assert.Equal(t, map[string]string{"team": "perf"}, task.Status.Tags)
+	case <-time.After(10 * time.Second):
+		t.Fatal("未收到回调")
+	}
+}
+
 func TestGetTaskStatus(t *testing.T) {
 	agent := setupTestAgent()
 	router := gin.New()
@@ -135,8 +297,6 @@ func TestGetTaskStatus(t *testing.T) {
 			Progress:  50,
 			Logs:      []string{"Test log entry"},
 		},
-		LogChan: make(chan string, 100),
-		Clients: make(map[*websocket.Conn]bool),
 	}
 
 	agent.tasksMu.Lock()
@@ -192,10 +352,8 @@ func TestStopTask(t *testing.T) {
 			Status:    "running",
 			StartTime: time.Now(),
 		},
-		Ctx:     ctx,
-		Cancel:  cancel,
-		LogChan: make(chan string, 100),
-		Clients: make(map[*websocket.Conn]bool),
+		Ctx:    ctx,
+		Cancel: cancel,
 	}
 
 	agent.tasksMu.Lock()
@@ -232,7 +390,7 @@ func TestGenerateTaskID(t *testing.T) {
 }
 
 func TestGetAgentID(t *testing.T) {
-	agentID := getAgentID()
+	agentID := generateAgentID()
 	assert.NotEmpty(t, agentID)
 	assert.Contains(t, agentID, "agent-")
 }
@@ -255,4 +413,4 @@ func BenchmarkGetInfo(b *testing.B) {
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
 	}
-}
\ No newline at end of file
+}
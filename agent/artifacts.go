@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// outputDirEnv 告知脚本产物目录的环境变量
+const outputDirEnv = "K6_AGENT_OUTPUT_DIR"
+
+// Artifact 任务产物目录中的一个文件
+type Artifact struct {
+	Path        string    `json:"path"` // 相对产物目录，使用/分隔
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	ContentType string    `json:"content_type,omitempty"`
+	ModTime     time.Time `json:"mod_time"`
+	URL         string    `json:"url,omitempty"`          // 上传到对象存储后的访问地址
+	UploadError string    `json:"upload_error,omitempty"` // 上传失败的原因
+}
+
+// ArtifactManifest 任务产物清单
+type ArtifactManifest struct {
+	Files     []Artifact `json:"files"`
+	TotalSize int64      `json:"total_size"`
+}
+
+// taskOutputDir 任务的产物目录，k6的handleSummary、CSV导出等应写入这里
+func taskOutputDir(taskID string) string {
+	return filepath.Join(taskWorkspace(taskID), "output")
+}
+
+// prepareOutputDir 创建任务的产物目录
+func (t *Task) prepareOutputDir() error {
+	dir := taskOutputDir(t.Status.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("创建产物目录失败: %v", err)
+	}
+	t.mu.Lock()
+	t.OutputDir = dir
+	t.mu.Unlock()
+	return nil
+}
+
+// outputDir 在任务锁内读取产物目录，供接口等其他goroutine使用
+func (t *Task) outputDir() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.OutputDir
+}
+
+// useOutputDir 通过环境变量告知进程产物目录，chdir为true时同时作为工作目录
+func (t *Task) useOutputDir(cmd *exec.Cmd, chdir bool) {
+	if t.OutputDir == "" {
+		return
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, outputDirEnv+"="+t.OutputDir)
+	if chdir {
+		cmd.Dir = t.OutputDir
+	}
+}
+
+// collectArtifacts 遍历产物目录，计算每个文件的大小和校验和
+func collectArtifacts(dir string) (*ArtifactManifest, error) {
+	manifest := &ArtifactManifest{Files: []Artifact{}}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// 只收集普通文件，不跟随符号链接
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := fileSHA256(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		manifest.Files = append(manifest.Files, Artifact{
+			Path:        filepath.ToSlash(rel),
+			Size:        info.Size(),
+			SHA256:      sum,
+			ContentType: mime.TypeByExtension(filepath.Ext(p)),
+			ModTime:     info.ModTime(),
+		})
+		manifest.TotalSize += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Path < manifest.Files[j].Path
+	})
+	return manifest, nil
+}
+
+func fileSHA256(p string) (string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// finalizeArtifacts 任务结束后生成产物清单
+func (a *Agent) finalizeArtifacts(task *Task) {
+	if task.OutputDir == "" {
+		return
+	}
+	manifest, err := collectArtifacts(task.OutputDir)
+	if err != nil {
+		logrus.Warnf("收集任务 %s 的产物失败: %v", task.Status.ID, err)
+		return
+	}
+	task.update(func(s *TaskStatus) { s.Artifacts = manifest })
+	if len(manifest.Files) > 0 {
+		logrus.Infof("任务 %s 产生 %d 个产物，共 %d 字节", task.Status.ID, len(manifest.Files), manifest.TotalSize)
+	}
+}
+
+// reportURL 已上传的HTML报告地址，优先使用report.html
+func (m *ArtifactManifest) reportURL() string {
+	if m == nil {
+		return ""
+	}
+	url := ""
+	for _, artifact := range m.Files {
+		if artifact.URL == "" || !strings.EqualFold(path.Ext(artifact.Path), ".html") {
+			continue
+		}
+		if path.Base(artifact.Path) == "report.html" {
+			return artifact.URL
+		}
+		if url == "" {
+			url = artifact.URL
+		}
+	}
+	return url
+}
+
+// ListArtifacts 返回任务的产物清单，运行中的任务返回当前目录内容
+func (a *Agent) ListArtifacts(c *gin.Context) {
+	task, ok := a.lookupTask(c)
+	if !ok {
+		return
+	}
+
+	if manifest := task.snapshot().Artifacts; manifest != nil {
+		c.JSON(200, manifest)
+		return
+	}
+	dir := task.outputDir()
+	if dir == "" {
+		c.JSON(200, &ArtifactManifest{Files: []Artifact{}})
+		return
+	}
+	manifest, err := collectArtifacts(dir)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, manifest)
+}
+
+// DownloadArtifact 下载任务的单个产物
+func (a *Agent) DownloadArtifact(c *gin.Context) {
+	task, ok := a.lookupTask(c)
+	if !ok {
+		return
+	}
+	dir := task.outputDir()
+	if dir == "" {
+		c.JSON(404, gin.H{"error": "产物不存在"})
+		return
+	}
+
+	// 清理路径并确认解析后仍位于产物目录内，防止目录穿越和符号链接逃逸
+	rel := strings.TrimPrefix(path.Clean("/"+c.Param("path")), "/")
+	if rel == "" {
+		c.JSON(404, gin.H{"error": "产物不存在"})
+		return
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "产物不存在"})
+		return
+	}
+	target, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(rel)))
+	if err != nil || !strings.HasPrefix(target, root+string(filepath.Separator)) {
+		c.JSON(404, gin.H{"error": "产物不存在"})
+		return
+	}
+	info, err := os.Stat(target)
+	if err != nil || !info.Mode().IsRegular() {
+		c.JSON(404, gin.H{"error": "产物不存在"})
+		return
+	}
+
+	c.FileAttachment(target, path.Base(rel))
+}
+
+// lookupTask 按路径参数查找任务，不存在时写入404
+func (a *Agent) lookupTask(c *gin.Context) (*Task, bool) {
+	a.tasksMu.RLock()
+	task, exists := a.tasks[c.Param("taskId")]
+	a.tasksMu.RUnlock()
+
+	if !exists {
+		c.JSON(404, gin.H{"error": "任务不存在"})
+	}
+	return task, exists
+}
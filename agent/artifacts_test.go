@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "screenshots"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "summary.json"), []byte(`{"ok":true}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "screenshots", "home.png"), []byte("png"), 0644))
+	require.NoError(t, os.Symlink("/etc/passwd", filepath.Join(dir, "link")))
+
+	manifest, err := collectArtifacts(dir)
+	require.NoError(t, err)
+	require.Len(t, manifest.Files, 2) // 符号链接不收集
+	assert.Equal(t, "screenshots/home.png", manifest.Files[0].Path)
+	assert.Equal(t, "image/png", manifest.Files[0].ContentType)
+	assert.Equal(t, "summary.json", manifest.Files[1].Path)
+	assert.Equal(t, int64(11), manifest.Files[1].Size)
+
+	sum := sha256.Sum256([]byte(`{"ok":true}`))
+	assert.Equal(t, hex.EncodeToString(sum[:]), manifest.Files[1].SHA256)
+	assert.Equal(t, int64(14), manifest.TotalSize)
+}
+
+func TestArtifactEndpoints(t *testing.T) {
+	agent := setupTestAgent()
+	router := gin.New()
+	router.GET("/tasks/:taskId/artifacts", agent.ListArtifacts)
+	router.GET("/tasks/:taskId/artifacts/*path", agent.DownloadArtifact)
+
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644))
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "csv"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "csv", "export.csv"), []byte("a,b\n1,2\n"), 0644))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(dir, "escape.txt")))
+
+	agent.tasksMu.Lock()
+	agent.tasks["art-task"] = &Task{
+		Status:    &TaskStatus{ID: "art-task", Status: "running"},
+		OutputDir: dir,
+	}
+	agent.tasksMu.Unlock()
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	// 运行中的任务返回当前目录内容
+	w := get("/tasks/art-task/artifacts")
+	require.Equal(t, http.StatusOK, w.Code)
+	var manifest ArtifactManifest
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &manifest))
+	require.Len(t, manifest.Files, 1)
+	assert.Equal(t, "csv/export.csv", manifest.Files[0].Path)
+
+	w = get("/tasks/art-task/artifacts/csv/export.csv")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "a,b\n1,2\n", w.Body.String())
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "export.csv")
+
+	// 目录穿越、符号链接逃逸、目录和不存在的文件都返回404
+	for _, p := range []string{"/../../etc/passwd", "/escape.txt", "/csv", "/missing.txt", "/"} {
+		assert.Equal(t, http.StatusNotFound, get("/tasks/art-task/artifacts"+p).Code, p)
+	}
+	assert.Equal(t, http.StatusNotFound, get("/tasks/missing/artifacts").Code)
+}
+
+func TestArtifactEndpointsDuringRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("依赖/bin/sh")
+	}
+	viper.Set("resources.workspace_dir", t.TempDir())
+	defer viper.Set("resources.workspace_dir", "")
+
+	// 任务运行期间并发访问产物接口，-race下不应有数据竞争
+	agent := setupTestAgent()
+	router := gin.New()
+	router.GET("/tasks/:taskId/artifacts", agent.ListArtifacts)
+	router.GET("/tasks/:taskId/artifacts/*path", agent.DownloadArtifact)
+	job := &Job{ID: "art-run", Type: "shell", Command: "echo ok > out.txt"}
+	task := newTestTask(t, agent, job)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		agent.runTask(task, job)
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		for _, url := range []string{"/tasks/art-run/artifacts", "/tasks/art-run/artifacts/out.txt"} {
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/tasks/art-run/artifacts/out.txt", nil))
+	assert.Equal(t, "ok\n", w.Body.String())
+}
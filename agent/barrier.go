@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// StartBarrier 多Agent同步开始：各Agent准备好后上报ready，在统一的时间或收到开始信号后才启动k6
+type StartBarrier struct {
+	ID      string     `json:"id,omitempty"`       // 屏障ID，同一逻辑任务的各段相同
+	StartAt *time.Time `json:"start_at,omitempty"` // 后端时钟下的开始时间，为空时等待开始信号
+	Timeout string     `json:"timeout,omitempty"`  // 等待开始的最长时间，默认agent.start_barrier_timeout
+}
+
+// BarrierStatus 任务在开始屏障上的等待情况
+type BarrierStatus struct {
+	ID            string     `json:"id,omitempty"`
+	ReadyAt       time.Time  `json:"readyAt"`
+	StartAt       *time.Time `json:"startAt,omitempty"`   // 后端时钟下的开始时间
+	StartedAt     *time.Time `json:"startedAt,omitempty"` // 本地实际开始时间
+	ClockOffsetMs float64    `json:"clockOffsetMs"`       // 后端时钟减本地时钟
+}
+
+// clockSample 一次心跳往返得到的时钟偏移
+type clockSample struct {
+	offset time.Duration
+	rtt    time.Duration
+}
+
+// clockSync 根据心跳往返估计后端与本地的时钟偏移，取最近若干次中往返时间最短的一次
+type clockSync struct {
+	mu      sync.RWMutex
+	samples []clockSample
+	size    int
+}
+
+func newClockSync(size int) *clockSync {
+	if size <= 0 {
+		size = 8
+	}
+	return &clockSync{size: size}
+}
+
+// observe 记录一次往返：sent/received为本地时间，server为后端处理请求时的时间
+func (c *clockSync) observe(sent, received, server time.Time) {
+	rtt := received.Sub(sent)
+	if rtt < 0 || server.IsZero() {
+		return
+	}
+	// 假设请求和响应耗时相同，后端时间对应往返的中点
+	sample := clockSample{offset: server.Sub(sent.Add(rtt / 2)), rtt: rtt}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples = append(c.samples, sample)
+	if len(c.samples) > c.size {
+		c.samples = c.samples[len(c.samples)-c.size:]
+	}
+}
+
+// estimate 当前的时钟偏移估计，ok为false表示还没有样本
+func (c *clockSync) estimate() (offset, rtt time.Duration, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.samples) == 0 {
+		return 0, 0, false
+	}
+	best := make([]clockSample, len(c.samples))
+	copy(best, c.samples)
+	sort.Slice(best, func(i, j int) bool { return best[i].rtt < best[j].rtt })
+	return best[0].offset, best[0].rtt, true
+}
+
+// toLocal 把后端时间换算为本地时间
+func (c *clockSync) toLocal(server time.Time) time.Time {
+	offset, _, _ := c.estimate()
+	return server.Add(-offset)
+}
+
+// heartbeatServerTime 从心跳响应中取后端时间：优先使用响应体的server_time，其次使用Date头
+func heartbeatServerTime(resp *http.Response, body []byte) time.Time {
+	var payload struct {
+		ServerTime time.Time `json:"server_time"`
+	}
+	if json.Unmarshal(body, &payload) == nil && !payload.ServerTime.IsZero() {
+		return payload.ServerTime
+	}
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		// Date头只精确到秒，取该秒的中点
+		return date.Add(500 * time.Millisecond)
+	}
+	return time.Time{}
+}
+
+// waitForStart 上报ready并等待开始时间或开始信号，返回后任务进入running
+func (a *Agent) waitForStart(task *Task) error {
+	barrier := task.Barrier
+	timeout := viper.GetDuration("agent.start_barrier_timeout")
+	if d, err := time.ParseDuration(barrier.Timeout); err == nil && d > 0 {
+		timeout = d
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+
+	offset, _, _ := a.clock.estimate()
+	status := &BarrierStatus{
+		ID:            barrier.ID,
+		ReadyAt:       time.Now(),
+		StartAt:       barrier.StartAt,
+		ClockOffsetMs: float64(offset.Microseconds()) / 1000,
+	}
+	task.update(func(s *TaskStatus) { s.Barrier = status })
+	task.setStatus("ready")
+	a.reportJobStatus(task.Status.ID, "ready", task.snapshot().Progress, "已就绪，等待同步开始")
+	logrus.Info(task.appendLog("info", "agent", fmt.Sprintf("已就绪，等待同步开始，时钟偏移 %.1fms", status.ClockOffsetMs)))
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	// 没有预定开始时间时等待开始信号，信号可以再指定开始时间
+	startAt := barrier.StartAt
+	if startAt == nil {
+		select {
+		case signal := <-task.StartSignal:
+			if !signal.IsZero() {
+				startAt = &signal
+				task.update(func(s *TaskStatus) { s.Barrier.StartAt = startAt })
+			}
+		case <-deadline.C:
+			return fmt.Errorf("等待开始信号超时 (%s)", timeout)
+		case <-task.Ctx.Done():
+			return fmt.Errorf("等待开始时任务被取消")
+		}
+	}
+
+	// 开始时间按后端时钟给出，换算为本地时间后等待
+	if startAt != nil {
+		if wait := time.Until(a.clock.toLocal(*startAt)); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-deadline.C:
+				return fmt.Errorf("开始时间 %s 超出等待时限 (%s)", startAt.Format(time.RFC3339Nano), timeout)
+			case <-task.Ctx.Done():
+				return fmt.Errorf("等待开始时任务被取消")
+			}
+		}
+	}
+
+	now := time.Now()
+	task.update(func(s *TaskStatus) { s.Barrier.StartedAt = &now })
+	task.setStatus("running")
+	a.reportJobStatus(task.Status.ID, "running", task.snapshot().Progress, "同步开始执行")
+	logrus.Info(task.appendLog("info", "agent", "同步开始执行"))
+	return nil
+}
+
+// StartTask 向等待同步开始的任务发送开始信号，请求体可以携带后端时钟下的startAt
+func (a *Agent) StartTask(c *gin.Context) {
+	task, ok := a.lookupTask(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		StartAt *time.Time `json:"startAt"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "无效的请求参数: " + err.Error(), "field": "startAt"})
+			return
+		}
+	}
+
+	status := task.snapshot()
+	if task.Barrier == nil || status.EndTime != nil || (status.Barrier != nil && status.Barrier.StartedAt != nil) {
+		c.JSON(409, gin.H{"error": "任务没有在等待开始信号"})
+		return
+	}
+	var signal time.Time
+	if req.StartAt != nil {
+		signal = *req.StartAt
+	}
+	select {
+	case task.StartSignal <- signal:
+	default:
+		c.JSON(409, gin.H{"error": "任务已收到开始信号"})
+		return
+	}
+	logrus.Infof("任务 %s 收到开始信号", task.Status.ID)
+	c.JSON(200, gin.H{"taskId": task.Status.ID, "startAt": req.StartAt})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClockSyncUsesLowestRTT(t *testing.T) {
+	c := newClockSync(3)
+	_, _, ok := c.estimate()
+	assert.False(t, ok)
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// 后端快2s，往返200ms时后端时间对应中点
+	c.observe(base, base.Add(200*time.Millisecond), base.Add(2100*time.Millisecond))
+	// 往返更短的样本更可信
+	c.observe(base, base.Add(20*time.Millisecond), base.Add(2010*time.Millisecond))
+	c.observe(base, base.Add(400*time.Millisecond), base.Add(2500*time.Millisecond))
+
+	offset, rtt, ok := c.estimate()
+	require.True(t, ok)
+	assert.Equal(t, 2*time.Second, offset)
+	assert.Equal(t, 20*time.Millisecond, rtt)
+	assert.Equal(t, base, c.toLocal(base.Add(2*time.Second)))
+
+	// 只保留最近的样本
+	c.observe(base, base.Add(100*time.Millisecond), base.Add(50*time.Millisecond))
+	c.observe(base, base.Add(100*time.Millisecond), base.Add(50*time.Millisecond))
+	c.observe(base, base.Add(100*time.Millisecond), base.Add(50*time.Millisecond))
+	offset, _, _ = c.estimate()
+	assert.Equal(t, 0*time.Millisecond, offset)
+}
+
+func TestHeartbeatClockOffset(t *testing.T) {
+	skew := 3 * time.Second
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"server_time": %q}`, time.Now().Add(skew).Format(time.RFC3339Nano))
+	}))
+	defer backend.Close()
+
+	agent := setupTestAgent()
+	agent.serverURL = backend.URL
+	require.NoError(t, agent.sendHeartbeat())
+
+	offset, _, ok := agent.clock.estimate()
+	require.True(t, ok)
+	assert.InDelta(t, skew.Seconds(), offset.Seconds(), 0.1)
+}
+
+func TestStartBarrier(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("依赖/bin/sh")
+	}
+	dir := t.TempDir()
+	viper.Set("resources.workspace_dir", dir)
+	defer viper.Set("resources.workspace_dir", "")
+
+	// 记录启动时间的k6
+	fakeK6 := filepath.Join(dir, "k6")
+	require.NoError(t, os.WriteFile(fakeK6, []byte("#!/bin/sh\ndate +%s%N > \"$K6_AGENT_OUTPUT_DIR/started.txt\"\n"), 0755))
+	viper.Set("k6.binary", fakeK6)
+	defer viper.Set("k6.binary", "k6")
+
+	statuses := make(chan string, 16)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/agents/jobs/status" {
+			body, _ := io.ReadAll(r.Body)
+			select {
+			case statuses <- string(body):
+			default:
+			}
+		}
+	}))
+	defer backend.Close()
+
+	agent := setupTestAgent()
+	agent.serverURL = backend.URL
+	router := gin.New()
+	router.POST("/tasks/:taskId/start", agent.StartTask)
+	start := func(id, body string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/tasks/"+id+"/start", strings.NewReader(body)))
+		return w.Code
+	}
+
+	// 等待开始信号
+	job := &Job{ID: "barrier-task", Type: "k6", ScriptContent: "export default function() {}", StartBarrier: &StartBarrier{ID: "run-1"}}
+	task := newTestTask(t, agent, job)
+	done := make(chan struct{})
+	go func() {
+		agent.runTask(task, job)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		select {
+		case s := <-statuses:
+			return strings.Contains(s, `"status":"ready"`)
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err := os.Stat(filepath.Join(taskOutputDir(job.ID), "started.txt"))
+	assert.True(t, os.IsNotExist(err), "收到开始信号前不应启动k6")
+
+	signaled := time.Now()
+	assert.Equal(t, 200, start(job.ID, ""))
+	<-done
+	assert.Equal(t, "completed", task.Status.Status, task.Status.Error)
+	require.NotNil(t, task.Status.Barrier.StartedAt)
+	assert.False(t, task.Status.Barrier.StartedAt.Before(signaled))
+	assert.Equal(t, 409, start(job.ID, ""))
+	assert.Equal(t, 404, start("missing", ""))
+
+	// 预定开始时间按后端时钟换算：后端快1s
+	now := time.Now()
+	agent.clock.observe(now, now, now.Add(time.Second))
+	startAt := time.Now().Add(time.Second + 300*time.Millisecond)
+	timed := &Job{ID: "timed-task", Type: "k6", ScriptContent: "x", StartBarrier: &StartBarrier{StartAt: &startAt}}
+	timedTask := newTestTask(t, agent, timed)
+	agent.runTask(timedTask, timed)
+	assert.Equal(t, "completed", timedTask.Status.Status, timedTask.Status.Error)
+	started := *timedTask.Status.Barrier.StartedAt
+	assert.WithinDuration(t, startAt.Add(-time.Second), started, 150*time.Millisecond)
+	assert.InDelta(t, 1000, timedTask.Status.Barrier.ClockOffsetMs, 1)
+
+	// 任务超时从屏障放行后开始计算，等待开始的时间不计入
+	delayedAt := time.Now().Add(time.Second + 500*time.Millisecond)
+	delayed := &Job{ID: "delayed-task", Type: "k6", ScriptContent: "x", Timeout: "300ms", StartBarrier: &StartBarrier{StartAt: &delayedAt}}
+	delayedTask := newTestTask(t, agent, delayed)
+	agent.runTask(delayedTask, delayed)
+	assert.Equal(t, "completed", delayedTask.Status.Status, delayedTask.Status.Error)
+	assert.False(t, delayedTask.Status.TimedOut)
+
+	// 超时未收到开始信号
+	late := &Job{ID: "late-task", Type: "k6", ScriptContent: "x", StartBarrier: &StartBarrier{Timeout: "50ms"}}
+	lateTask := newTestTask(t, agent, late)
+	agent.runTask(lateTask, late)
+	assert.Equal(t, "failed", lateTask.Status.Status)
+	assert.Contains(t, lateTask.Status.Error, "等待开始信号超时")
+}
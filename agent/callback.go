@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// 回调请求头，接收方用时间戳和签名校验回调确实来自Agent
+const (
+	callbackTimestampHeader = "X-K6-Agent-Timestamp"
+	callbackSignatureHeader = "X-K6-Agent-Signature"
+	callbackAttemptHeader   = "X-K6-Agent-Attempt"
+	callbackAgentHeader     = "X-K6-Agent-Id"
+)
+
+// callbackConfig 回调投递配置
+type callbackConfig struct {
+	Secret      string        // HMAC密钥，为空时不签名
+	Timeout     time.Duration // 单次请求超时
+	MaxAttempts int
+	Backoff     time.Duration // 首次重试间隔，之后每次翻倍
+	MaxBackoff  time.Duration
+}
+
+// callbackConfigFromViper 读取callback.*配置
+func callbackConfigFromViper() callbackConfig {
+	cfg := callbackConfig{
+		Secret:      viper.GetString("callback.secret"),
+		MaxAttempts: viper.GetInt("callback.max_attempts"),
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	durations := []struct {
+		key    string
+		target *time.Duration
+		def    time.Duration
+	}{
+		{"callback.timeout", &cfg.Timeout, 10 * time.Second},
+		{"callback.backoff", &cfg.Backoff, time.Second},
+		{"callback.max_backoff", &cfg.MaxBackoff, 30 * time.Second},
+	}
+	for _, d := range durations {
+		*d.target = d.def
+		if v, err := time.ParseDuration(viper.GetString(d.key)); err == nil && v > 0 {
+			*d.target = v
+		}
+	}
+	return cfg
+}
+
+// CallbackDelivery 任务回调的投递情况
+type CallbackDelivery struct {
+	URL      string            `json:"url"`
+	Status   string            `json:"status"` // pending, delivered, failed
+	Attempts []CallbackAttempt `json:"attempts"`
+}
+
+// CallbackAttempt 一次投递尝试
+type CallbackAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// CallbackPayload 回调内容，默认不含日志
+type CallbackPayload struct {
+	TaskID        string            `json:"taskId"`
+	AgentID       string            `json:"agentId"`
+	Type          string            `json:"type"`
+	Status        string            `json:"status"`
+	Error         string            `json:"error,omitempty"`
+	StartTime     time.Time         `json:"startTime"`
+	EndTime       *time.Time        `json:"endTime,omitempty"`
+	Tags          map[string]string `json:"tags,omitempty"`
+	TraceID       string            `json:"traceId,omitempty"`
+	SegmentID     string            `json:"segmentId,omitempty"`
+	Metrics       interface{}       `json:"metrics,omitempty"`
+	HTMLReportURL string            `json:"htmlReportUrl,omitempty"`
+	LogLines      int64             `json:"logLines"`
+	Logs          []string          `json:"logs,omitempty"` // 仅当任务设置了callbackLogs
+}
+
+// signCallback 计算回调签名：HMAC-SHA256(secret, timestamp + "." + body)
+func signCallback(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// callbackPayload 生成精简的回调内容，logLines大于0时附带最近的日志
+func (a *Agent) callbackPayload(task *Task, logLines int) CallbackPayload {
+	a.infoMu.RLock()
+	agentID := a.info.AgentID
+	a.infoMu.RUnlock()
+
+	status := task.snapshot()
+	payload := CallbackPayload{
+		TaskID:        status.ID,
+		AgentID:       agentID,
+		Type:          status.Type,
+		Status:        status.Status,
+		Error:         status.Error,
+		StartTime:     status.StartTime,
+		EndTime:       status.EndTime,
+		Tags:          status.Tags,
+		TraceID:       status.TraceID,
+		SegmentID:     status.SegmentID,
+		HTMLReportURL: status.Artifacts.reportURL(),
+	}
+	if status.Result != nil {
+		payload.Metrics = status.Result["metrics"]
+		if url, ok := status.Result["html_report_url"].(string); ok && url != "" {
+			payload.HTMLReportURL = url
+		}
+	}
+	if task.Log != nil {
+		payload.LogLines = task.Log.count()
+	}
+	if logLines > 0 {
+		logs := task.logLines()
+		if len(logs) > logLines {
+			logs = logs[len(logs)-logLines:]
+		}
+		payload.Logs = logs
+	}
+	return payload
+}
+
+// startCallback 在后台投递回调，重试不会推迟任务结束和清理，Stop时等待投递结束
+func (a *Agent) startCallback(task *Task, job *Job) {
+	a.callbacks.Add(1)
+	go func() {
+		defer a.callbacks.Done()
+		a.sendCallback(task, job)
+	}()
+}
+
+// setCallbackStatus 在任务锁内更新投递状态，可选追加一次尝试记录
+func setCallbackStatus(task *Task, status string, attempt *CallbackAttempt) {
+	task.update(func(s *TaskStatus) {
+		s.Callback.Status = status
+		if attempt != nil {
+			s.Callback.Attempts = append(s.Callback.Attempts, *attempt)
+		}
+	})
+}
+
+// sendCallback 任务结束后把结果推送到任务指定的回调地址，5xx、429和网络错误时退避重试
+func (a *Agent) sendCallback(task *Task, job *Job) {
+	cfg := callbackConfigFromViper()
+	task.update(func(s *TaskStatus) {
+		s.Callback = &CallbackDelivery{URL: job.CallbackURL, Status: "pending", Attempts: []CallbackAttempt{}}
+	})
+
+	body, err := json.Marshal(a.callbackPayload(task, job.CallbackLogs))
+	if err != nil {
+		setCallbackStatus(task, "failed", nil)
+		logrus.Errorf("序列化回调数据失败: %v", err)
+		return
+	}
+
+	a.infoMu.RLock()
+	agentID := a.info.AgentID
+	a.infoMu.RUnlock()
+
+	client := &http.Client{Timeout: cfg.Timeout}
+	backoff := cfg.Backoff
+	for attempt := 1; attempt <= cfg.MaxAttempts; attempt++ {
+		record, retry := a.deliverCallback(client, cfg, agentID, job.CallbackURL, body, attempt)
+		if record.Error == "" {
+			setCallbackStatus(task, "delivered", &record)
+			logrus.Infof("任务 %s 回调发送成功: %s", task.Status.ID, job.CallbackURL)
+			return
+		}
+		setCallbackStatus(task, "pending", &record)
+		logrus.Warnf("任务 %s 第 %d 次回调失败: %s", task.Status.ID, attempt, record.Error)
+		if !retry || attempt == cfg.MaxAttempts {
+			break
+		}
+
+		select {
+		case <-a.ctx.Done():
+			setCallbackStatus(task, "failed", nil)
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > cfg.MaxBackoff {
+			backoff = cfg.MaxBackoff
+		}
+	}
+	setCallbackStatus(task, "failed", nil)
+	logrus.Errorf("任务 %s 回调最终失败，共尝试 %d 次", task.Status.ID, len(task.snapshot().Callback.Attempts))
+}
+
+// deliverCallback 发送一次回调，返回本次尝试的记录以及是否值得重试
+func (a *Agent) deliverCallback(client *http.Client, cfg callbackConfig, agentID, callbackURL string, body []byte, attempt int) (CallbackAttempt, bool) {
+	start := time.Now()
+	record := CallbackAttempt{Time: start}
+
+	req, err := http.NewRequestWithContext(a.ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		record.Error = err.Error()
+		return record, false
+	}
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(callbackAgentHeader, agentID)
+	req.Header.Set(callbackAttemptHeader, strconv.Itoa(attempt))
+	req.Header.Set(callbackTimestampHeader, timestamp)
+	if cfg.Secret != "" {
+		req.Header.Set(callbackSignatureHeader, signCallback(cfg.Secret, timestamp, body))
+	}
+
+	resp, err := client.Do(req)
+	record.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		record.Error = err.Error()
+		return record, true
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	record.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return record, false
+	}
+	record.Error = fmt.Sprintf("状态码: %d", resp.StatusCode)
+	return record, retryableStatus(resp.StatusCode)
+}
+
+// retryableStatus 5xx和429是临时错误，值得重试
+func retryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
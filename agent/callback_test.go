@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// verifyCallback 接收方的校验逻辑：签名一致且时间戳在容忍范围内
+func verifyCallback(secret, timestamp, signature string, body []byte, tolerance time.Duration, now time.Time) bool {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > tolerance || age < -tolerance {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(signCallback(secret, timestamp, body)))
+}
+
+func TestVerifyCallback(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"taskId":"task-1"}`)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := signCallback("secret", timestamp, body)
+
+	assert.True(t, verifyCallback("secret", timestamp, signature, body, 5*time.Minute, now))
+	assert.False(t, verifyCallback("other", timestamp, signature, body, 5*time.Minute, now))
+	assert.False(t, verifyCallback("secret", timestamp, signature, []byte(`{"taskId":"task-2"}`), 5*time.Minute, now))
+	// 超出时间窗口的回调视为重放
+	assert.False(t, verifyCallback("secret", timestamp, signature, body, 5*time.Minute, now.Add(10*time.Minute)))
+}
+
+// setCallbackConfig 使用较短的超时和退避，返回恢复函数
+func setCallbackConfig(secret string) func() {
+	viper.Set("callback.secret", secret)
+	viper.Set("callback.timeout", "100ms")
+	viper.Set("callback.backoff", "1ms")
+	viper.Set("callback.max_attempts", 4)
+	return func() {
+		for _, key := range []string{"callback.secret", "callback.timeout", "callback.backoff", "callback.max_attempts"} {
+			viper.Set(key, nil)
+		}
+	}
+}
+
+func TestSendCallbackRetries(t *testing.T) {
+	defer setCallbackConfig("ci-secret")()
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	var mu sync.Mutex
+	var requests []received
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, received{r.Header.Clone(), body})
+		n := len(requests)
+		mu.Unlock()
+
+		switch n {
+		case 1:
+			time.Sleep(300 * time.Millisecond) // 超时
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	agent := setupTestAgent()
+	end := time.Now()
+	task := &Task{Status: &TaskStatus{ID: "task-1", Type: "k6", Status: "completed", EndTime: &end,
+		Logs: []string{"line 1", "line 2"}, Result: map[string]interface{}{"metrics": map[string]int{"http_reqs": 10}, "metrics_json": "{}"}}}
+	agent.sendCallback(task, &Job{ID: "task-1", CallbackURL: server.URL})
+
+	delivery := task.Status.Callback
+	require.NotNil(t, delivery)
+	assert.Equal(t, "delivered", delivery.Status)
+	require.Len(t, delivery.Attempts, 3)
+	assert.NotEmpty(t, delivery.Attempts[0].Error)
+	assert.Equal(t, http.StatusServiceUnavailable, delivery.Attempts[1].StatusCode)
+	assert.Equal(t, http.StatusOK, delivery.Attempts[2].StatusCode)
+	assert.Empty(t, delivery.Attempts[2].Error)
+
+	// 每次尝试重新签名，接收方可以校验来源
+	mu.Lock()
+	defer mu.Unlock()
+	last := requests[2]
+	assert.Equal(t, "3", last.header.Get(callbackAttemptHeader))
+	assert.True(t, verifyCallback("ci-secret", last.header.Get(callbackTimestampHeader), last.header.Get(callbackSignatureHeader), last.body, time.Minute, time.Now()))
+
+	// 默认不附带日志和原始metrics_json
+	var payload map[string]interface{}
+	require.NoError(t, json.Unmarshal(last.body, &payload))
+	assert.Equal(t, "task-1", payload["taskId"])
+	assert.NotContains(t, payload, "logs")
+	assert.NotContains(t, payload, "metrics_json")
+	assert.Equal(t, map[string]interface{}{"http_reqs": float64(10)}, payload["metrics"])
+}
+
+func TestSendCallbackPermanentFailure(t *testing.T) {
+	defer setCallbackConfig("")()
+
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		assert.Empty(t, r.Header.Get(callbackSignatureHeader))
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	agent := setupTestAgent()
+	task := &Task{Status: &TaskStatus{ID: "task-2", Status: "failed", Logs: []string{"line 1", "line 2", "line 3"}}}
+	agent.sendCallback(task, &Job{ID: "task-2", CallbackURL: server.URL, CallbackLogs: 2})
+
+	// 4xx不重试
+	assert.Equal(t, "failed", task.Status.Callback.Status)
+	require.Len(t, task.Status.Callback.Attempts, 1)
+	assert.Equal(t, http.StatusBadRequest, task.Status.Callback.Attempts[0].StatusCode)
+
+	var payload CallbackPayload
+	require.NoError(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, []string{"line 2", "line 3"}, payload.Logs)
+}
+
+func TestCallbackRetriesDoNotDelayTaskEnd(t *testing.T) {
+	defer setCallbackConfig("")()
+	viper.Set("callback.backoff", "1h")
+	viper.Set("resources.workspace_dir", t.TempDir())
+	defer viper.Set("resources.workspace_dir", "")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// 回调在后台重试，任务照常结束；Agent停止时放弃重试
+	agent := setupTestAgent()
+	job := &Job{ID: "callback-task", Type: "shell", Command: "true", CallbackURL: server.URL}
+	task := newTestTask(t, agent, job)
+	agent.runTask(task, job)
+	assert.True(t, task.finished())
+
+	require.Eventually(t, func() bool {
+		callback := task.snapshot().Callback
+		return callback != nil && len(callback.Attempts) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	agent.cancel()
+	agent.callbacks.Wait()
+	assert.Equal(t, "failed", task.snapshot().Callback.Status)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// resourcesParamKey 任务参数中用于覆盖资源限制的键，不会作为环境变量传给k6
+const resourcesParamKey = "resources"
+
+// ResourceLimits 任务资源限制
+type ResourceLimits struct {
+	MaxMemoryBytes int64   // memory.max，0表示不限制
+	MaxCPUPercent  float64 // 占整机CPU的百分比，0表示不限制
+}
+
+// ResourceUsage 任务资源使用统计
+type ResourceUsage struct {
+	PeakMemoryBytes int64   `json:"peak_memory_bytes"`
+	CPUUsageSeconds float64 `json:"cpu_usage_seconds"`
+	AvgCPUPercent   float64 `json:"avg_cpu_percent"`
+	MemoryLimit     int64   `json:"memory_limit_bytes,omitempty"`
+	CPULimitPercent float64 `json:"cpu_limit_percent,omitempty"`
+	OOMKilled       bool    `json:"oom_killed"`
+	OOMKillCount    int64   `json:"oom_kill_count,omitempty"`
+}
+
+// resourceLimitsFromJob 以配置的默认限制为基础，合并任务参数中的资源覆盖项
+func resourceLimitsFromJob(defaults ResourceLimits, job *Job) (ResourceLimits, error) {
+	limits := defaults
+	if job == nil || job.Params == nil {
+		return limits, nil
+	}
+
+	raw, ok := job.Params[resourcesParamKey]
+	if !ok {
+		return limits, nil
+	}
+	overrides, ok := raw.(map[string]interface{})
+	if !ok {
+		return limits, fmt.Errorf("参数 %s 必须是对象", resourcesParamKey)
+	}
+
+	if v, ok := overrides["max_memory"]; ok {
+		bytes, err := parseByteSize(fmt.Sprintf("%v", v))
+		if err != nil {
+			return limits, fmt.Errorf("无效的max_memory: %v", err)
+		}
+		limits.MaxMemoryBytes = bytes
+	}
+	if v, ok := overrides["max_cpu_percent"]; ok {
+		percent, err := strconv.ParseFloat(fmt.Sprintf("%v", v), 64)
+		if err != nil || percent < 0 {
+			return limits, fmt.Errorf("无效的max_cpu_percent: %v", v)
+		}
+		limits.MaxCPUPercent = percent
+	}
+
+	return limits, nil
+}
+
+// parseByteSize 解析 "512MB"、"1GB"、"1048576" 这类容量字符串，按1024进制换算
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+		{"B", 1},
+	}
+	factor := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			factor = u.factor
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("无法解析容量: %q", s)
+	}
+	return int64(value * float64(factor)), nil
+}
+
+// startCommand 启动命令并放入任务的cgroup，未启用cgroup时直接启动
+func (t *Task) startCommand(cmd *exec.Cmd) error {
+	if t.Cgroup == nil {
+		return cmd.Start()
+	}
+	t.Cgroup.attach(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	t.Cgroup.place(cmd.Process.Pid)
+	return nil
+}
+
+// runCommand 在任务的cgroup中运行命令并等待结束
+func (t *Task) runCommand(cmd *exec.Cmd) error {
+	if err := t.startCommand(cmd); err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// initResourceLimits 读取资源限制配置并初始化cgroup根节点。
+// resources.enable_cgroup默认false；为auto时初始化失败只告警，为true时返回错误，Agent拒绝启动
+func (a *Agent) initResourceLimits() error {
+	if maxMemory := viper.GetString("resources.max_memory"); maxMemory != "" {
+		bytes, err := parseByteSize(maxMemory)
+		if err != nil {
+			logrus.Warnf("resources.max_memory配置无效: %v", err)
+		} else {
+			a.defaultLimits.MaxMemoryBytes = bytes
+		}
+	}
+	a.defaultLimits.MaxCPUPercent = viper.GetFloat64("resources.max_cpu_percent")
+
+	mode := strings.ToLower(viper.GetString("resources.enable_cgroup"))
+	switch mode {
+	case "", "false":
+		return nil
+	case "auto", "true":
+	default:
+		return fmt.Errorf("resources.enable_cgroup必须是auto、true或false: %q", mode)
+	}
+	root, err := initCgroupRoot(viper.GetString("resources.cgroup_root"), mode == "true")
+	if err != nil {
+		if mode == "true" {
+			return fmt.Errorf("cgroup初始化失败: %v", err)
+		}
+		logrus.Warnf("cgroup初始化失败，任务将不受资源限制: %v", err)
+		return nil
+	}
+	a.cgroupRoot = root
+	logrus.Infof("已启用cgroup资源限制: %s", root)
+	return nil
+}
+
+// setupTaskCgroup 按配置和任务参数为任务创建cgroup
+func (a *Agent) setupTaskCgroup(task *Task, job *Job) error {
+	limits, err := resourceLimitsFromJob(a.defaultLimits, job)
+	if err != nil {
+		return err
+	}
+	task.Limits = limits
+	if a.cgroupRoot == "" {
+		return nil
+	}
+
+	cg, err := newTaskCgroup(a.cgroupRoot, job.ID, limits)
+	if err != nil {
+		// 单个任务的cgroup创建失败不阻塞执行
+		logrus.Warnf("任务 %s 创建cgroup失败，将不受资源限制: %v", job.ID, err)
+		return nil
+	}
+	task.Cgroup = cg
+	return nil
+}
+
+// releaseTaskCgroup 读取任务的资源使用并删除cgroup
+func (a *Agent) releaseTaskCgroup(task *Task) *ResourceUsage {
+	if task.Cgroup == nil {
+		return nil
+	}
+
+	usage := task.Cgroup.usage()
+	task.update(func(s *TaskStatus) { s.ResourceUsage = &usage })
+	if err := task.Cgroup.destroy(); err != nil {
+		logrus.Warnf("任务 %s 清理cgroup失败: %v", task.Status.ID, err)
+	}
+	return &usage
+}
@@ -0,0 +1,424 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cgroupCPUPeriod cpu.max使用的调度周期（微秒）
+const cgroupCPUPeriod = 100000
+
+// cgroupMount cgroup v2的挂载点
+const cgroupMount = "/sys/fs/cgroup"
+
+// cgroupFDSupported 内核支持启动时直接进入cgroup（clone3，5.7以上且未被seccomp拦截），
+// 由initCgroupRoot探测；不支持时在进程启动后写入cgroup.procs
+var cgroupFDSupported bool
+
+// taskCgroup 单个任务独占的cgroup v2节点
+type taskCgroup struct {
+	path   string
+	dir    *os.File
+	limits ResourceLimits
+
+	mu          sync.Mutex
+	startTime   time.Time
+	sampledPeak int64
+	stopSample  chan struct{}
+	stopOnce    sync.Once
+}
+
+// initCgroupRoot 准备任务cgroup的父节点并向下开启cpu、memory控制器，返回父节点路径。
+// root为空时建在Agent自己的cgroup下：cgroup v2不允许有进程的节点向子节点开启控制器，
+// 容器中Agent所在的cgroup就是容器的根节点，所以先把Agent移入<cgroup>/agent叶子节点，
+// 任务节点位于<cgroup>/tasks下。该cgroup中还有其他进程（例如登录会话或服务）时，
+// 只有explicit（resources.enable_cgroup为true）才一并移动；任一步失败都撤销移动
+func initCgroupRoot(root string, explicit bool) (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("未检测到cgroup v2: %v", err)
+	}
+
+	var dirs []string
+	if root != "" {
+		// 显式配置的节点，其父节点中不能有进程
+		dirs = []string{filepath.Dir(root), root}
+	} else {
+		content, err := os.ReadFile("/proc/self/cgroup")
+		if err != nil {
+			return "", fmt.Errorf("读取/proc/self/cgroup失败: %v", err)
+		}
+		self, err := parseSelfCgroup(string(content))
+		if err != nil {
+			return "", err
+		}
+		// 根cgroup不受无内部进程的限制，也不应移动主机上的其他进程
+		if self != cgroupMount {
+			leaf := filepath.Join(self, "agent")
+			moved, err := moveCgroupProcesses(self, leaf, explicit)
+			if err != nil {
+				return "", err
+			}
+			tasks := filepath.Join(self, "tasks")
+			defer func() {
+				if err != nil {
+					undoCgroupMove(self, leaf, tasks, moved)
+				}
+			}()
+			root, err = prepareCgroupRoot(tasks, []string{self, tasks})
+			return root, err
+		}
+		root = filepath.Join(self, "tasks")
+		dirs = []string{self, root}
+	}
+	return prepareCgroupRoot(root, dirs)
+}
+
+// prepareCgroupRoot 创建任务cgroup的父节点，在dirs中依次开启控制器并探测启动方式
+func prepareCgroupRoot(root string, dirs []string) (string, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", fmt.Errorf("创建cgroup根节点失败: %v", err)
+	}
+	// 父节点和根节点都需要开启控制器，子节点才能设置memory.max和cpu.max
+	for _, dir := range dirs {
+		if err := enableCgroupControllers(dir); err != nil {
+			return "", err
+		}
+	}
+	cgroupFDSupported = probeCgroupFD(root)
+	if !cgroupFDSupported {
+		logrus.Warn("内核不支持启动时进入cgroup，任务进程将在启动后移入cgroup")
+	}
+	return root, nil
+}
+
+// probeCgroupFD 在临时子节点中用UseCgroupFD启动一个空进程，判断能否在启动时直接进入cgroup
+func probeCgroupFD(root string) bool {
+	bin, err := exec.LookPath("true")
+	if err != nil {
+		return false
+	}
+	dir := filepath.Join(root, fmt.Sprintf("probe-%d", os.Getpid()))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return false
+	}
+	defer os.Remove(dir)
+	f, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	cmd := exec.Command(bin)
+	cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(f.Fd())}
+	return cmd.Run() == nil
+}
+
+// parseSelfCgroup 从/proc/self/cgroup的内容中取cgroup v2路径（"0::"开头的行），返回对应的目录
+func parseSelfCgroup(content string) (string, error) {
+	for _, line := range strings.Split(content, "\n") {
+		if path, ok := strings.CutPrefix(strings.TrimSpace(line), "0::"); ok {
+			return filepath.Join(cgroupMount, path), nil
+		}
+	}
+	return "", fmt.Errorf("/proc/self/cgroup中没有cgroup v2条目")
+}
+
+// moveCgroupProcesses 把from中的全部进程移入叶子节点to，返回已移动的进程。
+// from中除Agent外还有其他进程时，只有all为true才移动；失败时把已移动的进程移回
+func moveCgroupProcesses(from, to string, all bool) ([]string, error) {
+	pids, err := cgroupProcesses(from)
+	if err != nil {
+		return nil, err
+	}
+	if !all && !onlyProcess(pids, os.Getpid()) {
+		return nil, fmt.Errorf("%s 中还有Agent以外的进程，需设置resources.cgroup_root，或将resources.enable_cgroup设为true以移动全部进程", from)
+	}
+	if err := os.Mkdir(to, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("创建Agent的cgroup叶子节点失败: %v", err)
+	}
+
+	var moved []string
+	// 移动期间可能有新进程产生，重复直到节点中没有进程
+	for i := 0; i < 10; i++ {
+		if i > 0 {
+			if pids, err = cgroupProcesses(from); err != nil {
+				undoCgroupMove(from, to, "", moved)
+				return nil, err
+			}
+		}
+		if len(pids) == 0 {
+			return moved, nil
+		}
+		for _, pid := range pids {
+			if err := writeCgroupFile(to, "cgroup.procs", pid); err != nil {
+				if errors.Is(err, syscall.ESRCH) {
+					continue
+				}
+				undoCgroupMove(from, to, "", moved)
+				return nil, fmt.Errorf("移动进程 %s 到 %s 失败: %v", pid, to, err)
+			}
+			moved = append(moved, pid)
+		}
+	}
+	undoCgroupMove(from, to, "", moved)
+	return nil, fmt.Errorf("%s 中的进程未能全部移出", from)
+}
+
+// undoCgroupMove 撤销Agent cgroup的初始化：删除任务父节点，关闭开启的控制器，
+// 把进程移回原cgroup并删除叶子节点，尽力而为
+func undoCgroupMove(self, leaf, tasks string, pids []string) {
+	if tasks != "" {
+		os.Remove(tasks)
+		// 开启了控制器的节点不能有进程，移回前先关闭
+		for _, controller := range []string{"memory", "cpu"} {
+			writeCgroupFile(self, "cgroup.subtree_control", "-"+controller)
+		}
+	}
+	for _, pid := range pids {
+		if err := writeCgroupFile(self, "cgroup.procs", pid); err != nil && !errors.Is(err, syscall.ESRCH) {
+			logrus.Warnf("将进程 %s 移回 %s 失败: %v", pid, self, err)
+		}
+	}
+	os.Remove(leaf)
+}
+
+// cgroupProcesses 读取cgroup中的进程列表
+func cgroupProcesses(dir string) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return nil, fmt.Errorf("读取 %s 的进程列表失败: %v", dir, err)
+	}
+	return strings.Fields(string(content)), nil
+}
+
+// onlyProcess pids中只有pid一个进程
+func onlyProcess(pids []string, pid int) bool {
+	return len(pids) == 1 && pids[0] == strconv.Itoa(pid)
+}
+
+// enableCgroupControllers 在指定节点的cgroup.subtree_control中开启cpu和memory
+func enableCgroupControllers(dir string) error {
+	content, err := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return fmt.Errorf("读取 %s 的subtree_control失败: %v", dir, err)
+	}
+	enabled := strings.Fields(string(content))
+
+	for _, controller := range []string{"cpu", "memory"} {
+		if containsString(enabled, controller) {
+			continue
+		}
+		if err := writeCgroupFile(dir, "cgroup.subtree_control", "+"+controller); err != nil {
+			return fmt.Errorf("开启 %s 控制器失败: %v", controller, err)
+		}
+	}
+	return nil
+}
+
+// newTaskCgroup 为任务创建cgroup并写入资源限制
+func newTaskCgroup(root, taskID string, limits ResourceLimits) (*taskCgroup, error) {
+	path := filepath.Join(root, taskID)
+	if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("创建任务cgroup失败: %v", err)
+	}
+
+	if limits.MaxMemoryBytes > 0 {
+		if err := writeCgroupFile(path, "memory.max", strconv.FormatInt(limits.MaxMemoryBytes, 10)); err != nil {
+			os.Remove(path)
+			return nil, fmt.Errorf("设置memory.max失败: %v", err)
+		}
+		// OOM时整组终止，避免只杀掉k6的部分子进程
+		if err := writeCgroupFile(path, "memory.oom.group", "1"); err != nil {
+			logrus.Warnf("设置memory.oom.group失败: %v", err)
+		}
+	}
+	if limits.MaxCPUPercent > 0 {
+		if err := writeCgroupFile(path, "cpu.max", formatCPUMax(limits.MaxCPUPercent, runtime.NumCPU())); err != nil {
+			os.Remove(path)
+			return nil, fmt.Errorf("设置cpu.max失败: %v", err)
+		}
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("打开任务cgroup失败: %v", err)
+	}
+
+	cg := &taskCgroup{
+		path:       path,
+		dir:        dir,
+		limits:     limits,
+		startTime:  time.Now(),
+		stopSample: make(chan struct{}),
+	}
+	go cg.sampleMemory()
+	return cg, nil
+}
+
+// formatCPUMax 将整机CPU百分比换算为cpu.max的 "quota period" 格式
+func formatCPUMax(percent float64, numCPU int) string {
+	quota := int64(percent / 100 * float64(numCPU) * cgroupCPUPeriod)
+	if quota < 1000 {
+		quota = 1000 // 内核要求quota不小于1ms
+	}
+	return fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)
+}
+
+// attach 让命令在启动时直接进入该cgroup，子进程随之继承；内核不支持时由place在启动后移入
+func (cg *taskCgroup) attach(cmd *exec.Cmd) {
+	if cgroupFDSupported {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cg.dir.Fd())
+	}
+
+	cg.mu.Lock()
+	cg.startTime = time.Now()
+	cg.mu.Unlock()
+}
+
+// place 不支持启动时进入cgroup时，把已启动的进程写入cgroup.procs
+func (cg *taskCgroup) place(pid int) {
+	if cgroupFDSupported {
+		return
+	}
+	if err := writeCgroupFile(cg.path, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+		logrus.Warnf("进程 %d 移入任务cgroup失败，将不受资源限制: %v", pid, err)
+	}
+}
+
+// sampleMemory 周期采样memory.current，用于不支持memory.peak的内核
+func (cg *taskCgroup) sampleMemory() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cg.stopSample:
+			return
+		case <-ticker.C:
+			if current, err := readCgroupInt(cg.path, "memory.current"); err == nil {
+				cg.mu.Lock()
+				if current > cg.sampledPeak {
+					cg.sampledPeak = current
+				}
+				cg.mu.Unlock()
+			}
+		}
+	}
+}
+
+// usage 读取cgroup中记录的资源使用情况
+func (cg *taskCgroup) usage() ResourceUsage {
+	cg.mu.Lock()
+	elapsed := time.Since(cg.startTime)
+	peak := cg.sampledPeak
+	cg.mu.Unlock()
+
+	usage := ResourceUsage{
+		MemoryLimit:     cg.limits.MaxMemoryBytes,
+		CPULimitPercent: cg.limits.MaxCPUPercent,
+	}
+
+	if v, err := readCgroupInt(cg.path, "memory.peak"); err == nil {
+		peak = v
+	} else if v, err := readCgroupInt(cg.path, "memory.current"); err == nil && v > peak {
+		peak = v
+	}
+	usage.PeakMemoryBytes = peak
+
+	if stat, err := readCgroupKeyed(cg.path, "cpu.stat"); err == nil {
+		usage.CPUUsageSeconds = float64(stat["usage_usec"]) / 1e6
+		if elapsed > 0 {
+			usage.AvgCPUPercent = usage.CPUUsageSeconds / elapsed.Seconds() / float64(runtime.NumCPU()) * 100
+		}
+	}
+
+	if events, err := readCgroupKeyed(cg.path, "memory.events"); err == nil {
+		usage.OOMKillCount = events["oom_kill"]
+		usage.OOMKilled = usage.OOMKillCount > 0
+	}
+
+	return usage
+}
+
+// destroy 结束残留进程并删除cgroup
+func (cg *taskCgroup) destroy() error {
+	cg.stopOnce.Do(func() { close(cg.stopSample) })
+
+	// cgroup.kill需要5.14以上内核，失败时依赖进程已自行退出
+	writeCgroupFile(cg.path, "cgroup.kill", "1")
+	cg.dir.Close()
+
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(cg.path); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("删除任务cgroup失败: %v", err)
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	return os.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
+
+func readCgroupInt(dir, name string) (int64, error) {
+	content, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// cpuThrottling 读取cpu.stat中累计的调度周期数和被限流的周期数，cg为nil时ok为false
+func (cg *taskCgroup) cpuThrottling() (periods, throttled int64, ok bool) {
+	if cg == nil {
+		return 0, 0, false
+	}
+	stat, err := readCgroupKeyed(cg.path, "cpu.stat")
+	if err != nil {
+		return 0, 0, false
+	}
+	return stat["nr_periods"], stat["nr_throttled"], true
+}
+
+// readCgroupKeyed 解析 "key value" 形式的cgroup统计文件
+func readCgroupKeyed(dir, name string) (map[string]int64, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v
+		}
+	}
+	return values, scanner.Err()
+}
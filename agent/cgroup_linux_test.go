@@ -0,0 +1,177 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]int64{
+		"":       0,
+		"1024":   1024,
+		"1KB":    1 << 10,
+		"512MB":  512 << 20,
+		"1GB":    1 << 30,
+		"1.5G":   3 << 29,
+		" 2 gb ": 2 << 30,
+	}
+	for input, expected := range cases {
+		got, err := parseByteSize(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, got, input)
+	}
+
+	_, err := parseByteSize("lots")
+	assert.Error(t, err)
+}
+
+func TestResourceLimitsFromJob(t *testing.T) {
+	defaults := ResourceLimits{MaxMemoryBytes: 1 << 30, MaxCPUPercent: 80}
+
+	limits, err := resourceLimitsFromJob(defaults, &Job{ID: "job-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, defaults, limits)
+
+	limits, err = resourceLimitsFromJob(defaults, &Job{
+		ID: "job-2",
+		Params: map[string]interface{}{
+			"resources": map[string]interface{}{"max_memory": "256MB", "max_cpu_percent": 25},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(256<<20), limits.MaxMemoryBytes)
+	assert.Equal(t, float64(25), limits.MaxCPUPercent)
+
+	_, err = resourceLimitsFromJob(defaults, &Job{
+		ID:     "job-3",
+		Params: map[string]interface{}{"resources": "big"},
+	})
+	assert.Error(t, err)
+}
+
+func TestFormatCPUMax(t *testing.T) {
+	assert.Equal(t, "400000 100000", formatCPUMax(50, 8))
+	assert.Equal(t, "1000 100000", formatCPUMax(0.001, 1))
+}
+
+func TestTaskCgroupLimitsAndUsage(t *testing.T) {
+	// 普通目录模拟cgroupfs，验证限制写入和统计读取
+	root := t.TempDir()
+	cg, err := newTaskCgroup(root, "task-1", ResourceLimits{MaxMemoryBytes: 64 << 20, MaxCPUPercent: 50})
+	require.NoError(t, err)
+
+	path := filepath.Join(root, "task-1")
+	memMax, _ := os.ReadFile(filepath.Join(path, "memory.max"))
+	assert.Equal(t, "67108864", string(memMax))
+	oomGroup, _ := os.ReadFile(filepath.Join(path, "memory.oom.group"))
+	assert.Equal(t, "1", string(oomGroup))
+	_, err = os.Stat(filepath.Join(path, "cpu.max"))
+	assert.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(path, "memory.peak"), []byte("5242880\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(path, "cpu.stat"), []byte("usage_usec 2500000\nuser_usec 2000000\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(path, "memory.events"), []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"), 0644))
+
+	usage := cg.usage()
+	assert.Equal(t, int64(5242880), usage.PeakMemoryBytes)
+	assert.Equal(t, 2.5, usage.CPUUsageSeconds)
+	assert.Equal(t, int64(64<<20), usage.MemoryLimit)
+	assert.True(t, usage.OOMKilled)
+	assert.Equal(t, int64(1), usage.OOMKillCount)
+
+	// 模拟目录中残留普通文件，无法rmdir
+	assert.Error(t, cg.destroy())
+}
+
+func TestParseSelfCgroup(t *testing.T) {
+	path, err := parseSelfCgroup("0::/system.slice/docker-abc.scope\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/sys/fs/cgroup/system.slice/docker-abc.scope", path)
+
+	// 混合模式下只取v2条目；容器中通常是根路径
+	path, err = parseSelfCgroup("12:memory:/docker/abc\n1:name=systemd:/docker/abc\n0::/\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/sys/fs/cgroup", path)
+
+	_, err = parseSelfCgroup("12:memory:/docker/abc\n")
+	assert.Error(t, err)
+}
+
+func TestCgroupInitFailure(t *testing.T) {
+	// 普通目录没有cgroup.subtree_control，初始化必然失败
+	viper.Set("resources.cgroup_root", filepath.Join(t.TempDir(), "k6-agent"))
+	defer viper.Set("resources.cgroup_root", "")
+	defer viper.Set("resources.enable_cgroup", "")
+
+	viper.Set("resources.enable_cgroup", "auto")
+	agent := NewAgent()
+	assert.NoError(t, agent.initErr)
+	assert.Empty(t, agent.cgroupRoot)
+
+	// 显式启用时拒绝启动
+	viper.Set("resources.enable_cgroup", true)
+	agent = NewAgent()
+	assert.Error(t, agent.Start())
+	assert.Empty(t, agent.cgroupRoot)
+
+	viper.Set("resources.enable_cgroup", "sometimes")
+	assert.Error(t, NewAgent().initErr)
+}
+
+func TestCgroupThrottlingSample(t *testing.T) {
+	root := t.TempDir()
+	cg, err := newTaskCgroup(root, "task-1", ResourceLimits{MaxCPUPercent: 50})
+	require.NoError(t, err)
+	stat := filepath.Join(root, "task-1", "cpu.stat")
+	require.NoError(t, os.WriteFile(stat, []byte("usage_usec 100\nnr_periods 100\nnr_throttled 10\n"), 0644))
+
+	m := newGeneratorMonitor("task-1", 0, time.Hour, 80)
+	m.cgroup = cg
+	m.start()
+	require.NoError(t, os.WriteFile(stat, []byte("usage_usec 200\nnr_periods 200\nnr_throttled 60\n"), 0644))
+	report := m.finish()
+
+	require.Len(t, report.Samples, 1)
+	assert.Equal(t, float64(50), report.Samples[0].CPUThrottledPercent)
+	assert.True(t, report.Saturated)
+}
+
+func TestTaskCommandPlacedAfterStart(t *testing.T) {
+	// 不支持启动时进入cgroup时，启动后写入cgroup.procs
+	defer func(supported bool) { cgroupFDSupported = supported }(cgroupFDSupported)
+	cgroupFDSupported = false
+
+	root := t.TempDir()
+	cg, err := newTaskCgroup(root, "task-1", ResourceLimits{})
+	require.NoError(t, err)
+	defer cg.stopOnce.Do(func() { close(cg.stopSample) })
+
+	task := &Task{Cgroup: cg}
+	cmd := exec.Command("true")
+	require.NoError(t, task.runCommand(cmd))
+	assert.Nil(t, cmd.SysProcAttr)
+	procs, err := os.ReadFile(filepath.Join(root, "task-1", "cgroup.procs"))
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(cmd.Process.Pid), string(procs))
+}
+
+func TestMoveCgroupProcessesRequiresOnlyProcess(t *testing.T) {
+	// auto模式下不移动Agent以外的进程
+	from := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(from, "cgroup.procs"), []byte("1\n"+strconv.Itoa(os.Getpid())+"\n"), 0644))
+	_, err := moveCgroupProcesses(from, filepath.Join(from, "agent"), false)
+	assert.Error(t, err)
+	assert.NoDirExists(t, filepath.Join(from, "agent"))
+
+	assert.True(t, onlyProcess([]string{strconv.Itoa(os.Getpid())}, os.Getpid()))
+}
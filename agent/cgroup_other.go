@@ -0,0 +1,29 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// taskCgroup 非Linux平台不支持cgroup，仅保留类型以便编译
+type taskCgroup struct{}
+
+func initCgroupRoot(root string, explicit bool) (string, error) {
+	return "", fmt.Errorf("cgroup v2 仅支持Linux")
+}
+
+func newTaskCgroup(root, taskID string, limits ResourceLimits) (*taskCgroup, error) {
+	return nil, fmt.Errorf("cgroup v2 仅支持Linux")
+}
+
+func (cg *taskCgroup) attach(cmd *exec.Cmd) {}
+
+func (cg *taskCgroup) place(pid int) {}
+
+func (cg *taskCgroup) usage() ResourceUsage { return ResourceUsage{} }
+
+func (cg *taskCgroup) cpuThrottling() (periods, throttled int64, ok bool) { return 0, 0, false }
+
+func (cg *taskCgroup) destroy() error { return nil }
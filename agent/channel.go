@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 控制通道：与后端保持一条WebSocket长连接，后端推送任务、停止命令和配置变更，Agent逐条确认。
+// 通道连接期间暂停轮询，断开后回退到按poll_interval轮询，并以指数退避重连。
+
+// 后端推送的消息类型
+const (
+	channelMsgJob    = "job"    // job为要执行的任务
+	channelMsgStop   = "stop"   // job_id为要停止的任务
+	channelMsgConfig = "config" // config为要修改的配置
+)
+
+// channelConfig 控制通道配置
+type channelConfig struct {
+	Enabled          bool
+	URL              string // WebSocket地址，由backend.url和channel.path得到
+	PingInterval     time.Duration
+	ReconnectBackoff time.Duration
+	MaxBackoff       time.Duration
+}
+
+func channelConfigFromViper(serverURL string) (channelConfig, error) {
+	cfg := channelConfig{
+		Enabled:          viper.GetBool("channel.enabled"),
+		PingInterval:     viper.GetDuration("channel.ping_interval"),
+		ReconnectBackoff: viper.GetDuration("channel.reconnect_backoff"),
+		MaxBackoff:       viper.GetDuration("channel.max_backoff"),
+	}
+	if cfg.PingInterval <= 0 {
+		cfg.PingInterval = 30 * time.Second
+	}
+	if cfg.ReconnectBackoff <= 0 {
+		cfg.ReconnectBackoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.ReconnectBackoff {
+		cfg.MaxBackoff = time.Minute
+	}
+
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return cfg, fmt.Errorf("backend.url无效: %v", err)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return cfg, fmt.Errorf("backend.url必须是http(s)地址")
+	}
+	path := viper.GetString("channel.path")
+	if path == "" {
+		path = "/api/v1/agents/channel"
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + path
+	cfg.URL = u.String()
+	return cfg, nil
+}
+
+// ChannelMessage 后端推送的消息
+type ChannelMessage struct {
+	ID     string                 `json:"id"`
+	Type   string                 `json:"type"`
+	Job    *Job                   `json:"job,omitempty"`
+	JobID  string                 `json:"job_id,omitempty"`
+	Config map[string]interface{} `json:"config,omitempty"`
+}
+
+// ChannelAck Agent对每条消息的确认
+type ChannelAck struct {
+	Type       string `json:"type"` // 固定为ack
+	ID         string `json:"id"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	Duplicate  bool   `json:"duplicate,omitempty"`   // 任务已接收过，没有重复执行
+	TaskStatus string `json:"task_status,omitempty"` // 重复任务的已有状态
+}
+
+// channelHello 连接建立后Agent发送的第一条消息
+type channelHello struct {
+	Type         string   `json:"type"` // 固定为hello
+	AgentID      string   `json:"agent_id"`
+	RunningTasks []string `json:"running_tasks"`
+}
+
+// controlChannel 控制通道的连接状态
+type controlChannel struct {
+	cfg channelConfig
+
+	mu        sync.RWMutex
+	connected bool
+}
+
+// up 通道是否已连接，连接期间不需要轮询
+func (ch *controlChannel) up() bool {
+	if ch == nil {
+		return false
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.connected
+}
+
+func (ch *controlChannel) setConnected(connected bool) {
+	ch.mu.Lock()
+	ch.connected = connected
+	ch.mu.Unlock()
+}
+
+// startChannel 保持控制通道连接，断开后退避重连
+func (a *Agent) startChannel() {
+	backoff := a.channel.cfg.ReconnectBackoff
+	for {
+		connectedAt := time.Now()
+		err := a.runChannel()
+		if a.ctx.Err() != nil {
+			return
+		}
+		// 连接维持过一段时间说明后端正常，重新从最小间隔开始退避
+		if time.Since(connectedAt) > a.channel.cfg.MaxBackoff {
+			backoff = a.channel.cfg.ReconnectBackoff
+		}
+		logrus.Warnf("控制通道断开，回退到轮询，%s后重连: %v", backoff, err)
+
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > a.channel.cfg.MaxBackoff {
+			backoff = a.channel.cfg.MaxBackoff
+		}
+	}
+}
+
+// runChannel 建立一次连接并处理消息，直到连接断开
+func (a *Agent) runChannel() error {
+	cfg := a.channel.cfg
+	a.infoMu.RLock()
+	agentID := a.info.AgentID
+	a.infoMu.RUnlock()
+
+	header := http.Header{}
+	header.Set("X-Agent-Id", agentID)
+	header.Set("X-Registration-Token", a.registrationToken)
+	conn, resp, err := websocket.DefaultDialer.DialContext(a.ctx, cfg.URL+"?agent_id="+url.QueryEscape(agentID), header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("连接失败，状态码: %d", resp.StatusCode)
+		}
+		return err
+	}
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	write := func(v interface{}) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(v)
+	}
+
+	if err := write(channelHello{Type: "hello", AgentID: agentID, RunningTasks: a.runningTaskIDs()}); err != nil {
+		return err
+	}
+	a.channel.setConnected(true)
+	a.metrics.channelConnected.Set(1)
+	defer func() {
+		a.channel.setConnected(false)
+		a.metrics.channelConnected.Set(0)
+	}()
+	logrus.Infof("控制通道已连接: %s", cfg.URL)
+
+	// 定期ping，两个周期内没有收到任何数据视为断开
+	conn.SetReadDeadline(time.Now().Add(2 * cfg.PingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * cfg.PingInterval))
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(cfg.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-a.ctx.Done():
+				conn.Close()
+				return
+			case <-ticker.C:
+				writeMu.Lock()
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+				writeMu.Unlock()
+				if err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * cfg.PingInterval))
+
+		var msg ChannelMessage
+		ack := ChannelAck{Type: "ack", OK: true}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			// 尽量取出消息ID，让后端知道哪条消息被拒绝
+			var envelope struct {
+				ID string `json:"id"`
+			}
+			json.Unmarshal(data, &envelope)
+			msg.ID = envelope.ID
+			err = fmt.Errorf("无法解析消息: %v", err)
+			ack.OK, ack.Error = false, err.Error()
+		} else if err := a.handleChannelMessage(&msg, &ack); err != nil {
+			ack.OK, ack.Error = false, err.Error()
+		}
+		ack.ID = msg.ID
+
+		result := "ok"
+		if !ack.OK {
+			result = "rejected"
+			logrus.Warnf("控制消息 %s (%s) 被拒绝: %s", msg.ID, msg.Type, ack.Error)
+		}
+		a.metrics.channelMessages.WithLabelValues(msg.Type, result).Inc()
+		if err := write(ack); err != nil {
+			return err
+		}
+	}
+}
+
+// handleChannelMessage 处理一条后端推送的消息，需要附加的信息写入ack
+func (a *Agent) handleChannelMessage(msg *ChannelMessage, ack *ChannelAck) error {
+	switch msg.Type {
+	case channelMsgJob:
+		if msg.Job == nil || msg.Job.ID == "" {
+			return fmt.Errorf("任务消息缺少job")
+		}
+		// 重复下发的任务确认成功并带上已有状态
+		if summary, dup := a.handleDuplicate(msg.Job, jobSourceChannel); dup {
+			ack.Duplicate, ack.TaskStatus = true, summary.Status
+			return nil
+		}
+		return a.acceptPushedJob(msg.Job)
+	case channelMsgStop:
+		if msg.JobID == "" {
+			return fmt.Errorf("停止消息缺少job_id")
+		}
+		if !a.stopTask(msg.JobID) {
+			return fmt.Errorf("任务 %s 不存在", msg.JobID)
+		}
+		return nil
+	case channelMsgConfig:
+		return a.applyRemoteConfig(msg.Config)
+	default:
+		return fmt.Errorf("不支持的消息类型: %q", msg.Type)
+	}
+}
+
+// acceptPushedJob 登记并执行推送的任务，与轮询到的任务走相同流程
+func (a *Agent) acceptPushedJob(job *Job) error {
+	logrus.Infof("通过控制通道接收到新任务: %s", job.ID)
+	if err := a.claimJob(job); err != nil {
+		a.releaseJob(job.ID)
+		return err
+	}
+	job.receivedAt = time.Now()
+	task, err := a.newTask(job)
+	if err != nil {
+		return err
+	}
+	_, span := task.startSpan("job.push", trace.WithTimestamp(job.receivedAt))
+	span.End()
+	go a.runTask(task, job)
+	return nil
+}
+
+// applyRemoteConfig 应用后端下发的配置，任一项无效时都不修改
+func (a *Agent) applyRemoteConfig(config map[string]interface{}) error {
+	if len(config) == 0 {
+		return fmt.Errorf("配置消息缺少config")
+	}
+	seconds := func(key string) (time.Duration, error) {
+		v, ok := config[key].(float64)
+		if !ok || v < 1 || v != float64(int64(v)) {
+			return 0, fmt.Errorf("%s必须是正整数秒", key)
+		}
+		return time.Duration(v) * time.Second, nil
+	}
+
+	var apply []func()
+	for key, value := range config {
+		switch key {
+		case "poll_interval":
+			d, err := seconds(key)
+			if err != nil {
+				return err
+			}
+			apply = append(apply, func() { a.setIntervals(0, d) })
+		case "heartbeat_interval":
+			d, err := seconds(key)
+			if err != nil {
+				return err
+			}
+			apply = append(apply, func() { a.setIntervals(d, 0) })
+		case "log_level":
+			s, _ := value.(string)
+			level, err := logrus.ParseLevel(s)
+			if err != nil {
+				return fmt.Errorf("log_level无效: %q", s)
+			}
+			apply = append(apply, func() { logrus.SetLevel(level) })
+		default:
+			return fmt.Errorf("不支持修改配置项 %q", key)
+		}
+	}
+	for _, fn := range apply {
+		fn()
+	}
+	logrus.Infof("已应用后端下发的配置: %v", config)
+	return nil
+}
+
+// runningTaskIDs 未结束的任务，连接后告知后端
+func (a *Agent) runningTaskIDs() []string {
+	a.tasksMu.RLock()
+	defer a.tasksMu.RUnlock()
+	ids := []string{}
+	for id, task := range a.tasks {
+		if task.snapshot().EndTime == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelConfigURL(t *testing.T) {
+	cfg, err := channelConfigFromViper("https://backend.example.com/base/")
+	require.NoError(t, err)
+	assert.Equal(t, "wss://backend.example.com/base/api/v1/agents/channel", cfg.URL)
+	_, err = channelConfigFromViper("backend:3001")
+	assert.Error(t, err)
+}
+
+func TestControlChannel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("依赖/bin/sh")
+	}
+	viper.Set("resources.workspace_dir", t.TempDir())
+	defer viper.Set("resources.workspace_dir", "")
+
+	var polls int64
+	conns := make(chan *websocket.Conn, 2)
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/agents/channel":
+			assert.Equal(t, "default-token", r.Header.Get("X-Registration-Token"))
+			conn, err := upgrader.Upgrade(w, r, nil)
+			require.NoError(t, err)
+			conns <- conn
+		case "/api/v1/agents/jobs/poll":
+			atomic.AddInt64(&polls, 1)
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer backend.Close()
+
+	agent := setupTestAgent()
+	agent.serverURL = backend.URL
+	agent.registrationToken = "default-token"
+	agent.registered = true
+	cfg, err := channelConfigFromViper(backend.URL)
+	require.NoError(t, err)
+	cfg.ReconnectBackoff = 20 * time.Millisecond
+	agent.channel = &controlChannel{cfg: cfg}
+	agent.setIntervals(time.Hour, 20*time.Millisecond)
+	defer agent.cancel()
+	go agent.startJobPolling()
+	go agent.startChannel()
+
+	conn := <-conns
+	var hello channelHello
+	require.NoError(t, conn.ReadJSON(&hello))
+	assert.Equal(t, "hello", hello.Type)
+	assert.Equal(t, agent.info.AgentID, hello.AgentID)
+
+	send := func(msg string) ChannelAck {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(msg)))
+		var ack ChannelAck
+		require.NoError(t, conn.ReadJSON(&ack))
+		return ack
+	}
+
+	// 推送的任务立即开始执行
+	ack := send(`{"id": "m1", "type": "job", "job": {"id": "pushed", "type": "shell", "command": "sleep 5"}}`)
+	assert.Equal(t, ChannelAck{Type: "ack", ID: "m1", OK: true}, ack)
+	agent.tasksMu.RLock()
+	task := agent.tasks["pushed"]
+	agent.tasksMu.RUnlock()
+	require.NotNil(t, task)
+
+	// 重复推送不会再次执行，确认中带上已有任务的状态
+	ack = send(`{"id": "m2", "type": "job", "job": {"id": "pushed", "type": "shell", "command": "true"}}`)
+	assert.True(t, ack.OK)
+	assert.True(t, ack.Duplicate)
+	assert.NotEmpty(t, ack.TaskStatus)
+	agent.tasksMu.RLock()
+	assert.Same(t, task, agent.tasks["pushed"])
+	agent.tasksMu.RUnlock()
+
+	assert.True(t, send(`{"id": "m3", "type": "stop", "job_id": "pushed"}`).OK)
+	assert.Equal(t, "stopped", task.Status.Status)
+	assert.False(t, send(`{"id": "m4", "type": "stop", "job_id": "missing"}`).OK)
+
+	// 配置变更要么全部生效，要么全部拒绝
+	ack = send(`{"id": "m5", "type": "config", "config": {"heartbeat_interval": 10, "poll_interval": 0}}`)
+	assert.False(t, ack.OK)
+	heartbeat, _ := agent.intervals()
+	assert.Equal(t, time.Hour, heartbeat)
+	assert.True(t, send(`{"id": "m6", "type": "config", "config": {"heartbeat_interval": 10}}`).OK)
+	heartbeat, _ = agent.intervals()
+	assert.Equal(t, 10*time.Second, heartbeat)
+
+	ack = send(`{"id": "m7", "type": "job", "job": "oops"}`)
+	assert.Equal(t, "m7", ack.ID)
+	assert.False(t, ack.OK)
+	assert.False(t, send(`{"id": "m8", "type": "reboot"}`).OK)
+
+	// 连接期间不轮询
+	before := atomic.LoadInt64(&polls)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, before, atomic.LoadInt64(&polls))
+
+	// 断开后回退到轮询，并自动重连
+	conn.Close()
+	require.Eventually(t, func() bool { return atomic.LoadInt64(&polls) > before }, 2*time.Second, 10*time.Millisecond)
+	select {
+	case conn = <-conns:
+		require.NoError(t, conn.ReadJSON(&hello))
+		assert.Equal(t, "hello", hello.Type)
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("控制通道没有重连")
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"k6-agent/sketch"
+)
+
+// 没有后端的环境中，一个Agent作为协调者：把任务按执行段拆分到配置的对等Agent，
+// 等所有节点就绪后同时开始，轮询各节点状态，任一节点失败时中止其余节点，最后合并结果。
+
+// 协调运行的状态
+const (
+	runDispatching = "dispatching" // 正在向各节点下发
+	runWaiting     = "waiting"     // 等待各节点就绪
+	runRunning     = "running"
+	runCompleted   = "completed"
+	runFailed      = "failed"
+	runStopped     = "stopped"
+)
+
+// peerConfig coordinator.peers中的一项
+type peerConfig struct {
+	Name string `mapstructure:"name"`
+	URL  string `mapstructure:"url"`
+}
+
+// coordinatorConfig coordinator配置
+type coordinatorConfig struct {
+	Enabled         bool
+	Peers           []peerConfig
+	PollInterval    time.Duration
+	MaxPollFailures int           // 连续多少次无法获取节点状态后视为节点失败
+	StartDelay      time.Duration // 开始时间距发出开始信号的提前量，应大于向所有节点发送信号的耗时
+	RunRetention    time.Duration // 已结束的运行保留多久
+}
+
+func coordinatorConfigFromViper() (coordinatorConfig, error) {
+	cfg := coordinatorConfig{
+		Enabled:         viper.GetBool("coordinator.enabled"),
+		PollInterval:    viper.GetDuration("coordinator.poll_interval"),
+		MaxPollFailures: viper.GetInt("coordinator.max_poll_failures"),
+		StartDelay:      viper.GetDuration("coordinator.start_delay"),
+		RunRetention:    viper.GetDuration("coordinator.run_retention"),
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 2 * time.Second
+	}
+	if cfg.MaxPollFailures <= 0 {
+		cfg.MaxPollFailures = 5
+	}
+	if cfg.StartDelay <= 0 {
+		cfg.StartDelay = time.Second
+	}
+	if cfg.RunRetention <= 0 {
+		cfg.RunRetention = 24 * time.Hour
+	}
+	if err := viper.UnmarshalKey("coordinator.peers", &cfg.Peers); err != nil {
+		return cfg, fmt.Errorf("coordinator.peers无效: %v", err)
+	}
+	if cfg.Enabled && len(cfg.Peers) == 0 {
+		return cfg, fmt.Errorf("启用协调者模式时必须配置coordinator.peers")
+	}
+	names := make(map[string]bool)
+	for i := range cfg.Peers {
+		peer := &cfg.Peers[i]
+		peer.URL = strings.TrimRight(peer.URL, "/")
+		if !strings.HasPrefix(peer.URL, "http://") && !strings.HasPrefix(peer.URL, "https://") {
+			return cfg, fmt.Errorf("节点 %q 的url必须是http(s)地址", peer.Name)
+		}
+		if peer.Name == "" {
+			peer.Name = peer.URL
+		}
+		if names[peer.Name] {
+			return cfg, fmt.Errorf("节点名称 %q 重复", peer.Name)
+		}
+		names[peer.Name] = true
+	}
+	return cfg, nil
+}
+
+// PeerTask 协调运行在一个节点上的任务
+type PeerTask struct {
+	Peer               string `json:"peer"`
+	URL                string `json:"url"`
+	TaskID             string `json:"taskId,omitempty"`
+	ExecutionSegment   string `json:"executionSegment"`
+	Status             string `json:"status"` // 节点上的任务状态，下发前为空
+	Error              string `json:"error,omitempty"`
+	ThresholdsBreached bool   `json:"thresholdsBreached,omitempty"`
+
+	pollFailures int
+	sketches     map[string]*sketch.Sketch
+}
+
+// finished 节点任务是否已结束
+func (p *PeerTask) finished() bool {
+	switch p.Status {
+	case "completed", "failed", "stopped", "oom_killed":
+		return true
+	}
+	return false
+}
+
+// CoordinatedRun 一次协调运行
+type CoordinatedRun struct {
+	ID                 string                   `json:"id"`
+	Status             string                   `json:"status"`
+	Error              string                   `json:"error,omitempty"`
+	CreatedAt          time.Time                `json:"createdAt"`
+	StartAt            *time.Time               `json:"startAt,omitempty"`   // 各节点约定的开始时间
+	StartedAt          *time.Time               `json:"startedAt,omitempty"` // 开始信号发送完成的时间
+	EndTime            *time.Time               `json:"endTime,omitempty"`
+	Peers              []*PeerTask              `json:"peers"`
+	ThresholdsBreached bool                     `json:"thresholdsBreached,omitempty"`
+	Metrics            map[string]*MergedMetric `json:"metrics,omitempty"` // 各节点延迟草图合并后的结果
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// peerStatus 节点GET /status返回中协调者关心的字段
+type peerStatus struct {
+	Status             string                    `json:"status"`
+	Error              string                    `json:"error"`
+	ThresholdsBreached bool                      `json:"thresholdsBreached"`
+	LatencySketches    map[string]*sketch.Sketch `json:"latencySketches"`
+}
+
+// coordinator 管理协调运行
+type coordinator struct {
+	cfg    coordinatorConfig
+	client *http.Client
+
+	mu   sync.RWMutex
+	runs map[string]*CoordinatedRun
+}
+
+func newCoordinator(cfg coordinatorConfig, client *http.Client) *coordinator {
+	return &coordinator{cfg: cfg, client: client, runs: make(map[string]*CoordinatedRun)}
+}
+
+// segments 把[0,1]等分为n段，返回各段及执行段序列
+func segments(n int) ([]string, string) {
+	points := make([]string, n+1)
+	for i := 0; i <= n; i++ {
+		switch i {
+		case 0:
+			points[i] = "0"
+		case n:
+			points[i] = "1"
+		default:
+			points[i] = fmt.Sprintf("%d/%d", i, n)
+		}
+	}
+	parts := make([]string, n)
+	for i := 0; i < n; i++ {
+		parts[i] = points[i] + ":" + points[i+1]
+	}
+	return parts, strings.Join(points, ",")
+}
+
+// start 创建运行并在后台执行
+func (c *coordinator) start(parent context.Context, req *ExecuteRequest) *CoordinatedRun {
+	run := &CoordinatedRun{
+		ID:        fmt.Sprintf("run-%d", time.Now().UnixNano()),
+		Status:    runDispatching,
+		CreatedAt: time.Now(),
+	}
+	parts, sequence := segments(len(c.cfg.Peers))
+	for i, peer := range c.cfg.Peers {
+		run.Peers = append(run.Peers, &PeerTask{Peer: peer.Name, URL: peer.URL, ExecutionSegment: parts[i]})
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	run.cancel = cancel
+	c.evictRuns(time.Now())
+	c.mu.Lock()
+	c.runs[run.ID] = run
+	c.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		c.run(ctx, run, req, sequence)
+	}()
+	return run
+}
+
+// run 下发、同步开始、监控直到所有节点结束
+func (c *coordinator) run(ctx context.Context, run *CoordinatedRun, req *ExecuteRequest, sequence string) {
+	if err := c.dispatch(ctx, run, req, sequence); err != nil {
+		c.abort(run, runFailed, err.Error())
+		return
+	}
+	run.mu.Lock()
+	run.Status = runWaiting
+	run.mu.Unlock()
+	logrus.Infof("协调运行 %s 已下发到 %d 个节点，等待就绪", run.ID, len(run.Peers))
+
+	ticker := time.NewTicker(c.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.abort(run, runStopped, "协调运行已停止")
+			return
+		case <-ticker.C:
+		}
+
+		c.pollPeers(ctx, run)
+
+		run.mu.Lock()
+		failed, ready, done := c.evaluate(run)
+		status := run.Status
+		run.mu.Unlock()
+
+		if failed != nil {
+			c.abort(run, runFailed, fmt.Sprintf("节点 %s 失败: %s", failed.Peer, failed.Error))
+			return
+		}
+		if status == runWaiting && ready {
+			if err := c.signalStart(ctx, run); err != nil {
+				c.abort(run, runFailed, err.Error())
+				return
+			}
+			continue
+		}
+		if done {
+			c.finish(run)
+			return
+		}
+	}
+}
+
+// dispatch 并发向各节点的/execute下发各自的执行段
+func (c *coordinator) dispatch(ctx context.Context, run *CoordinatedRun, req *ExecuteRequest, sequence string) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(run.Peers))
+	for i, peer := range run.Peers {
+		peerReq := *req
+		peerReq.ExecutionSegment = peer.ExecutionSegment
+		peerReq.ExecutionSegmentSequence = sequence
+		peerReq.SegmentID = peer.Peer
+		peerReq.StartBarrier = &StartBarrier{ID: run.ID}
+		peerReq.Tags = map[string]string{"coordinator_run": run.ID}
+		for k, v := range req.Tags {
+			peerReq.Tags[k] = v
+		}
+
+		wg.Add(1)
+		go func(i int, peer *PeerTask, body ExecuteRequest) {
+			defer wg.Done()
+			var resp struct {
+				TaskID string `json:"taskId"`
+			}
+			if err := c.call(ctx, http.MethodPost, peer.URL+"/execute", body, &resp); err != nil {
+				errs[i] = fmt.Errorf("向节点 %s 下发任务失败: %v", peer.Peer, err)
+				return
+			}
+			run.mu.Lock()
+			peer.TaskID = resp.TaskID
+			peer.Status = "pending"
+			run.mu.Unlock()
+		}(i, peer, peerReq)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pollPeers 获取未结束节点的任务状态
+func (c *coordinator) pollPeers(ctx context.Context, run *CoordinatedRun) {
+	for _, peer := range run.Peers {
+		run.mu.Lock()
+		skip := peer.finished()
+		url := peer.URL + "/status/" + peer.TaskID
+		run.mu.Unlock()
+		if skip {
+			continue
+		}
+
+		var status peerStatus
+		err := c.call(ctx, http.MethodGet, url, nil, &status)
+
+		run.mu.Lock()
+		if err != nil {
+			peer.pollFailures++
+			if peer.pollFailures >= c.cfg.MaxPollFailures {
+				peer.Status = "failed"
+				peer.Error = fmt.Sprintf("连续%d次无法获取任务状态: %v", peer.pollFailures, err)
+			}
+		} else {
+			peer.pollFailures = 0
+			peer.Status = status.Status
+			peer.Error = status.Error
+			peer.ThresholdsBreached = status.ThresholdsBreached
+			peer.sketches = status.LatencySketches
+		}
+		run.mu.Unlock()
+	}
+}
+
+// evaluate 判断是否有节点失败、是否全部就绪、是否全部结束，调用方持有run.mu
+func (c *coordinator) evaluate(run *CoordinatedRun) (failed *PeerTask, ready, done bool) {
+	ready, done = true, true
+	for _, peer := range run.Peers {
+		// 阈值未通过不是执行故障，其余节点继续跑完
+		if peer.finished() && peer.Status != "completed" && !peer.ThresholdsBreached && failed == nil {
+			failed = peer
+		}
+		if peer.Status != "ready" {
+			ready = false
+		}
+		if !peer.finished() {
+			done = false
+		}
+	}
+	return failed, ready, done
+}
+
+// signalStart 所有节点就绪后发送开始信号。信号带有绝对的开始时间，
+// 各节点在同一时刻开始，开始时间差不受信号送达先后的影响，前提是节点之间的时钟已同步
+func (c *coordinator) signalStart(ctx context.Context, run *CoordinatedRun) error {
+	startAt := time.Now().Add(c.cfg.StartDelay)
+	body := map[string]time.Time{"startAt": startAt}
+	var wg sync.WaitGroup
+	errs := make([]error, len(run.Peers))
+	for i, peer := range run.Peers {
+		wg.Add(1)
+		go func(i int, peer *PeerTask) {
+			defer wg.Done()
+			if err := c.call(ctx, http.MethodPost, peer.URL+"/tasks/"+peer.TaskID+"/start", body, nil); err != nil {
+				errs[i] = fmt.Errorf("向节点 %s 发送开始信号失败: %v", peer.Peer, err)
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	run.mu.Lock()
+	run.Status = runRunning
+	run.StartAt = &startAt
+	run.StartedAt = &now
+	run.mu.Unlock()
+	logrus.Infof("协调运行 %s 的 %d 个节点将于 %s 同时开始", run.ID, len(run.Peers), startAt.Format(time.RFC3339Nano))
+	return nil
+}
+
+// abort 停止所有未结束的节点任务并结束运行
+func (c *coordinator) abort(run *CoordinatedRun, status, reason string) {
+	run.mu.Lock()
+	var pending []*PeerTask
+	for _, peer := range run.Peers {
+		if peer.TaskID != "" && !peer.finished() {
+			pending = append(pending, peer)
+		}
+	}
+	run.mu.Unlock()
+
+	// 运行的上下文可能已被取消，停止请求使用独立的超时
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, peer := range pending {
+		wg.Add(1)
+		go func(peer *PeerTask) {
+			defer wg.Done()
+			if err := c.call(ctx, http.MethodPost, peer.URL+"/stop/"+peer.TaskID, nil, nil); err != nil {
+				logrus.Warnf("停止节点 %s 上的任务 %s 失败: %v", peer.Peer, peer.TaskID, err)
+				return
+			}
+			run.mu.Lock()
+			peer.Status = "stopped"
+			run.mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	run.mu.Lock()
+	run.Status = status
+	run.Error = reason
+	run.EndTime = &now
+	run.mu.Unlock()
+	logrus.Warnf("协调运行 %s 已中止: %s", run.ID, reason)
+}
+
+// finish 所有节点结束后合并结果
+func (c *coordinator) finish(run *CoordinatedRun) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	var sets []map[string]*sketch.Sketch
+	for _, peer := range run.Peers {
+		sets = append(sets, peer.sketches)
+		run.ThresholdsBreached = run.ThresholdsBreached || peer.ThresholdsBreached
+	}
+	metrics, err := mergeSketches(sets, nil, defaultSketchQuantiles)
+	if err != nil {
+		run.Error = "合并延迟草图失败: " + err.Error()
+	}
+	if len(metrics) > 0 {
+		run.Metrics = metrics
+	}
+
+	run.Status = runCompleted
+	if run.ThresholdsBreached {
+		run.Status = runFailed
+		run.Error = "部分节点阈值未通过"
+	}
+	now := time.Now()
+	run.EndTime = &now
+	logrus.Infof("协调运行 %s 结束: %s", run.ID, run.Status)
+}
+
+// call 请求节点API，body和out为nil时不发送或不解析内容
+func (c *coordinator) call(ctx context.Context, method, url string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("状态码: %d, 响应: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// evictRuns 删除结束超过保留期的运行
+func (c *coordinator) evictRuns(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	evicted := 0
+	for id, run := range c.runs {
+		run.mu.Lock()
+		expired := run.EndTime != nil && now.Sub(*run.EndTime) > c.cfg.RunRetention
+		run.mu.Unlock()
+		if expired {
+			delete(c.runs, id)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// lookup 查找运行
+func (c *coordinator) lookup(id string) (*CoordinatedRun, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	run, ok := c.runs[id]
+	return run, ok
+}
+
+// coordinatorEnabled 未启用协调者模式时返回404
+func (a *Agent) coordinatorEnabled(c *gin.Context) bool {
+	if a.coordinator == nil {
+		c.JSON(404, gin.H{"error": "未启用协调者模式"})
+		return false
+	}
+	return true
+}
+
+// CreateRun 接收与/execute相同的k6任务，按执行段拆分到各节点
+func (a *Agent) CreateRun(c *gin.Context) {
+	if !a.coordinatorEnabled(c) {
+		return
+	}
+	req, ferr := decodeExecuteRequest(c.Request.Body)
+	if ferr == nil {
+		ferr = req.validate()
+	}
+	if ferr == nil && req.Type != "k6" {
+		ferr = newFieldError("type", "协调运行只支持k6任务")
+	}
+	if ferr == nil && (req.ExecutionSegment != "" || req.ExecutionSegmentSequence != "" || req.SegmentID != "" || req.StartBarrier != nil) {
+		ferr = newFieldError("executionSegment", "执行段和同步开始由协调者设置")
+	}
+	if ferr == nil && req.CallbackURL != "" {
+		ferr = newFieldError("callbackUrl", "协调运行不支持callbackUrl")
+	}
+	if ferr != nil {
+		c.JSON(400, gin.H{"error": "无效的请求参数: " + ferr.Error(), "field": ferr.Field})
+		return
+	}
+
+	run := a.coordinator.start(a.ctx, req)
+	// 后台已经开始下发，状态在锁内读取
+	run.mu.Lock()
+	status := run.Status
+	run.mu.Unlock()
+	c.JSON(202, gin.H{"runId": run.ID, "status": status, "peers": len(run.Peers)})
+}
+
+// GetRun 查询协调运行
+func (a *Agent) GetRun(c *gin.Context) {
+	if !a.coordinatorEnabled(c) {
+		return
+	}
+	run, ok := a.coordinator.lookup(c.Param("runId"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "协调运行不存在"})
+		return
+	}
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	c.JSON(200, run)
+}
+
+// StopRun 停止协调运行及所有节点上的任务
+func (a *Agent) StopRun(c *gin.Context) {
+	if !a.coordinatorEnabled(c) {
+		return
+	}
+	run, ok := a.coordinator.lookup(c.Param("runId"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "协调运行不存在"})
+		return
+	}
+	run.cancel()
+	c.JSON(200, gin.H{"message": "协调运行正在停止"})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegments(t *testing.T) {
+	parts, sequence := segments(3)
+	assert.Equal(t, []string{"0:1/3", "1/3:2/3", "2/3:1"}, parts)
+	assert.Equal(t, "0,1/3,2/3,1", sequence)
+	for _, part := range parts {
+		_, err := checkExecutionSegment(part, sequence)
+		assert.NoError(t, err)
+	}
+	parts, sequence = segments(1)
+	assert.Equal(t, []string{"0:1"}, parts)
+	assert.Equal(t, "0,1", sequence)
+}
+
+// startPeers 启动n个对等Agent，返回其HTTP地址
+func startPeers(t *testing.T, n int) []peerConfig {
+	var peers []peerConfig
+	for i := 0; i < n; i++ {
+		agent := setupTestAgent()
+		router := gin.New()
+		router.POST("/execute", agent.ExecuteScript)
+		router.GET("/status/:taskId", agent.GetTaskStatus)
+		router.POST("/stop/:taskId", agent.StopTask)
+		router.POST("/tasks/:taskId/start", agent.StartTask)
+		server := httptest.NewServer(router)
+		t.Cleanup(server.Close)
+		peers = append(peers, peerConfig{Name: "peer-" + string(rune('a'+i)), URL: server.URL})
+	}
+	return peers
+}
+
+func TestCoordinatedRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("依赖/bin/sh")
+	}
+	dir := t.TempDir()
+	viper.Set("resources.workspace_dir", dir)
+	defer viper.Set("resources.workspace_dir", "")
+	viper.Set("k6.latency_sketches.enabled", true)
+	defer viper.Set("k6.latency_sketches.enabled", false)
+	t.Setenv("FIRST", "1")
+
+	trendK6 := filepath.Join(dir, "k6-trend")
+	require.NoError(t, os.WriteFile(trendK6, []byte(fakeK6Trend), 0755))
+	// 第二段很快失败，其余节点一直运行直到被停止
+	failingK6 := filepath.Join(dir, "k6-failing")
+	require.NoError(t, os.WriteFile(failingK6, []byte("#!/bin/sh\ncase \"$*\" in *\"--execution-segment 1/3:2/3 \"*) echo boom; exit 1;; esac\nexec sleep 5\n"), 0755))
+	defer viper.Set("k6.binary", "k6")
+
+	coordAgent := setupTestAgent()
+	coordAgent.coordinator = newCoordinator(coordinatorConfig{
+		Enabled:         true,
+		Peers:           startPeers(t, 3),
+		PollInterval:    20 * time.Millisecond,
+		MaxPollFailures: 3,
+		StartDelay:      50 * time.Millisecond,
+		RunRetention:    time.Hour,
+	}, http.DefaultClient)
+	router := gin.New()
+	router.POST("/coordinator/runs", coordAgent.CreateRun)
+	router.GET("/coordinator/runs/:runId", coordAgent.GetRun)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/coordinator/runs", bytes.NewBufferString(body)))
+		return w
+	}
+	waitRun := func(id string) *CoordinatedRun {
+		var run CoordinatedRun
+		require.Eventually(t, func() bool {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/coordinator/runs/"+id, nil))
+			require.Equal(t, 200, w.Code)
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &run))
+			return run.EndTime != nil
+		}, 10*time.Second, 20*time.Millisecond)
+		return &run
+	}
+	create := func() string {
+		w := post(`{"scriptContent": "export default function() {}", "tags": {"team": "perf"}}`)
+		require.Equal(t, 202, w.Code, w.Body.String())
+		var resp struct {
+			RunID string `json:"runId"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.RunID
+	}
+
+	// 三个节点同步开始，各跑一段，合并延迟草图
+	viper.Set("k6.binary", trendK6)
+	run := waitRun(create())
+	assert.Equal(t, runCompleted, run.Status, run.Error)
+	require.NotNil(t, run.StartedAt)
+	require.NotNil(t, run.StartAt)
+	assert.True(t, run.StartAt.After(run.CreatedAt))
+	require.Len(t, run.Peers, 3)
+	for _, peer := range run.Peers {
+		assert.Equal(t, "completed", peer.Status)
+		assert.NotEmpty(t, peer.TaskID)
+	}
+	assert.Equal(t, "1/3:2/3", run.Peers[1].ExecutionSegment)
+	require.Contains(t, run.Metrics, "http_req_duration")
+	assert.Equal(t, uint64(300), run.Metrics["http_req_duration"].Count)
+	assert.Equal(t, 100.0, run.Metrics["http_req_duration"].Max)
+
+	// 一个节点失败时停止其余节点
+	viper.Set("k6.binary", failingK6)
+	start := time.Now()
+	run = waitRun(create())
+	assert.Less(t, time.Since(start), 4*time.Second)
+	assert.Equal(t, runFailed, run.Status)
+	assert.Contains(t, run.Error, "peer-b")
+	assert.Equal(t, "failed", run.Peers[1].Status)
+	assert.Equal(t, "stopped", run.Peers[0].Status)
+	assert.Equal(t, "stopped", run.Peers[2].Status)
+
+	// 参数校验
+	assert.Equal(t, 400, post(`{"type": "shell", "command": "true"}`).Code)
+	assert.Equal(t, 400, post(`{"scriptContent": "x", "executionSegment": "0:1/2"}`).Code)
+
+	// 结束超过保留期的运行被删除
+	assert.Equal(t, 0, coordAgent.coordinator.evictRuns(time.Now()))
+	assert.Equal(t, 2, coordAgent.coordinator.evictRuns(time.Now().Add(2*time.Hour)))
+	_, ok := coordAgent.coordinator.lookup(run.ID)
+	assert.False(t, ok)
+}
+
+func TestCoordinatorDisabled(t *testing.T) {
+	agent := setupTestAgent()
+	router := gin.New()
+	router.POST("/coordinator/runs", agent.CreateRun)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/coordinator/runs", bytes.NewBufferString(`{"scriptContent": "x"}`)))
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestCoordinatorConfigRequiresPeers(t *testing.T) {
+	viper.Set("coordinator.enabled", true)
+	defer viper.Set("coordinator.enabled", false)
+
+	_, err := coordinatorConfigFromViper()
+	assert.Error(t, err)
+	// 启用但配置无效时Agent拒绝启动，而不是静默关闭协调者模式
+	agent := NewAgent()
+	assert.Nil(t, agent.coordinator)
+	assert.Error(t, agent.Start())
+
+	viper.Set("coordinator.peers", []map[string]interface{}{{"name": "peer-a", "url": "http://127.0.0.1:1"}})
+	defer viper.Set("coordinator.peers", nil)
+	cfg, err := coordinatorConfigFromViper()
+	require.NoError(t, err)
+	assert.Len(t, cfg.Peers, 1)
+	assert.NoError(t, NewAgent().initErr)
+}
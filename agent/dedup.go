@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// 重复任务检测：后端超时重发或重试时可能再次下发同一个Job.ID，Agent不再重复执行，
+// 而是把已有任务的状态回报给后端。任务被清理后，其最终状态在agent.dedup_window内仍可用于去重。
+
+// 任务来源，用于日志和指标
+const (
+	jobSourcePoll    = "poll"
+	jobSourceNATS    = "nats"
+	jobSourceChannel = "channel"
+	jobSourceLocal   = "local"
+)
+
+// dedupWindow 已清理任务继续参与去重的时长，0表示只在任务保留期间去重
+func dedupWindow() time.Duration {
+	d, err := time.ParseDuration(viper.GetString("agent.dedup_window"))
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// rememberJobs 记录被清理任务的最终状态，并丢弃超过去重窗口的记录，调用方持有tasksMu
+func (a *Agent) rememberJobs(evicted []TaskStatus, now time.Time) {
+	window := dedupWindow()
+	if a.seenJobs == nil {
+		a.seenJobs = make(map[string]TaskSummary)
+	}
+	for id, summary := range a.seenJobs {
+		if window == 0 || now.Sub(*summary.EndTime) > window {
+			delete(a.seenJobs, id)
+		}
+	}
+	if window == 0 {
+		return
+	}
+	for i := range evicted {
+		if now.Sub(*evicted[i].EndTime) <= window {
+			a.seenJobs[evicted[i].ID] = taskSummary(&evicted[i])
+		}
+	}
+}
+
+// reserveJob 查找同ID的已知任务，没有时占用该ID，直到newTask登记或releaseJob释放。
+// 查找和占用在同一次加锁内完成，同时到达的多次投递只有一次能占用成功。
+// task为nil时，summary.EndTime为空表示另一次投递正在确认，否则任务已被清理，只剩最终状态
+func (a *Agent) reserveJob(id string) (task *Task, summary TaskSummary, dup bool) {
+	a.tasksMu.Lock()
+	defer a.tasksMu.Unlock()
+	if task, ok := a.tasks[id]; ok {
+		status := task.snapshot()
+		return task, taskSummary(&status), true
+	}
+	if _, ok := a.claiming[id]; ok {
+		return nil, TaskSummary{ID: id, Status: "pending"}, true
+	}
+	if summary, ok := a.seenJobs[id]; ok {
+		return nil, summary, true
+	}
+	if a.claiming == nil {
+		a.claiming = make(map[string]bool)
+	}
+	a.claiming[id] = false
+	return nil, TaskSummary{}, false
+}
+
+// releaseJob 任务没能登记时释放占用的ID和并发名额
+func (a *Agent) releaseJob(id string) {
+	a.tasksMu.Lock()
+	defer a.tasksMu.Unlock()
+	delete(a.claiming, id)
+}
+
+// handleDuplicate 检查任务是否重复下发，重复时记录并把已有任务的状态回报后端，返回true表示不应再执行。
+// 返回false时已占用任务ID，调用方随后用newTask登记，或在无法执行时releaseJob
+func (a *Agent) handleDuplicate(job *Job, source string) (TaskSummary, bool) {
+	task, summary, dup := a.reserveJob(job.ID)
+	if !dup {
+		return summary, false
+	}
+
+	message := fmt.Sprintf("任务被重复下发（来源: %s），未重复执行，已有任务状态: %s", source, summary.Status)
+	logrus.Warnf("任务 %s %s", job.ID, message)
+	a.metrics.jobsDuplicate.WithLabelValues(source).Inc()
+	if task == nil && summary.EndTime == nil {
+		// 另一次投递正在确认，是否执行由它决定，这里不回报也不动这次投递的租约
+		return summary, true
+	}
+	if task == nil {
+		a.reportJobStatus(job.ID, summary.Status, summary.Progress, message)
+		a.completeLease(job.ID, job.Lease)
+		return summary, true
+	}
+	task.appendLog("warn", "agent", message)
+
+	// 后端重发时可能分配了新租约，改为续约新租约，否则它过期后任务会被再次分配
+	if job.Lease != nil && task.Lease != nil {
+		task.Lease.replace(job.Lease)
+		if summary.EndTime == nil {
+			sent := time.Now()
+			if err := a.sourceOf(job.Lease).Ack(job.ID, job.Lease); err != nil {
+				logrus.Errorf("确认重复任务 %s 的新租约失败: %v", job.ID, err)
+			} else {
+				task.Lease.extend(sent, false)
+			}
+		}
+	}
+
+	// 已结束的任务重新回传结果，后端重发多半是因为没有收到结果
+	if task.finished() {
+		a.reportJobResult(job.ID, task)
+		a.completeLease(job.ID, job.Lease)
+	} else {
+		a.reportJobStatus(job.ID, summary.Status, summary.Progress, message)
+	}
+	return summary, true
+}
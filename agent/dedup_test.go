@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicateJob(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("依赖/bin/sh")
+	}
+	viper.Set("resources.workspace_dir", t.TempDir())
+	defer viper.Set("resources.workspace_dir", "")
+
+	agent, fake := newLeaseTestAgent(t)
+	job := func(lease string) *Job {
+		return &Job{ID: "redelivered", Type: "shell", Command: "sleep 0.3", Lease: &JobLease{ID: lease, TTL: "90ms"}}
+	}
+	fake.push(job("lease-1"))
+	require.NoError(t, agent.pollJob())
+	agent.tasksMu.RLock()
+	task := agent.tasks["redelivered"]
+	agent.tasksMu.RUnlock()
+
+	// 运行期间重复下发：不再执行，回报已有状态，并改为续约新租约
+	fake.push(job("lease-2"))
+	require.NoError(t, agent.pollJob())
+	agent.tasksMu.RLock()
+	assert.Same(t, task, agent.tasks["redelivered"])
+	agent.tasksMu.RUnlock()
+	assert.Equal(t, 1.0, testutil.ToFloat64(agent.metrics.jobsDuplicate.WithLabelValues(jobSourcePoll)))
+	assert.Contains(t, strings.Join(task.logLines(), "\n"), "任务被重复下发")
+
+	require.Eventually(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.results) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return task.finished() }, time.Second, 10*time.Millisecond)
+	fake.mu.Lock()
+	assert.Equal(t, "lease-2", fake.calls["ack"][1].LeaseID)
+	assert.Equal(t, "lease-2", fake.calls["renew"][len(fake.calls["renew"])-1].LeaseID)
+	assert.Equal(t, "lease-2", fake.results[0].LeaseID)
+	reported := false
+	for _, status := range fake.statuses {
+		reported = reported || strings.Contains(status.Log, "重复下发")
+	}
+	assert.True(t, reported)
+	fake.mu.Unlock()
+
+	// 结束后重复下发：重新回传结果
+	fake.push(job("lease-2"))
+	require.NoError(t, agent.pollJob())
+	fake.mu.Lock()
+	require.Len(t, fake.results, 2)
+	assert.Equal(t, "completed", fake.results[1].Status)
+	assert.Len(t, fake.calls["ack"], 2)
+	fake.mu.Unlock()
+
+	// 任务被清理后，在去重窗口内仍然回报最终状态
+	viper.Set("agent.dedup_window", "1h")
+	defer viper.Set("agent.dedup_window", "")
+	require.Equal(t, 1, agent.evictTasks(taskRetention{MaxCount: 0, MaxAge: time.Nanosecond}, time.Now()))
+	fake.push(job("lease-3"))
+	require.NoError(t, agent.pollJob())
+	fake.mu.Lock()
+	assert.Equal(t, "completed", fake.statuses[len(fake.statuses)-1].Status)
+	assert.Len(t, fake.calls["ack"], 2)
+	fake.mu.Unlock()
+	assert.Equal(t, 3.0, testutil.ToFloat64(agent.metrics.jobsDuplicate.WithLabelValues(jobSourcePoll)))
+
+	// 超过去重窗口后按新任务执行
+	agent.evictTasks(taskRetention{}, time.Now().Add(2*time.Hour))
+	_, _, known := agent.reserveJob("redelivered")
+	assert.False(t, known)
+	agent.releaseJob("redelivered")
+}
+
+func TestConcurrentDeliveries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("依赖/bin/sh")
+	}
+	viper.Set("resources.workspace_dir", t.TempDir())
+	defer viper.Set("resources.workspace_dir", "")
+
+	// 同一任务同时从轮询和控制通道到达，只执行一次
+	agent, fake := newLeaseTestAgent(t)
+	job := func(lease string) *Job {
+		return &Job{ID: "pushed-twice", Type: "shell", Command: "sleep 0.2", Lease: &JobLease{ID: lease, TTL: "1m"}}
+	}
+	fake.push(job("lease-poll"))
+	const pushes = 8
+	acks := make([]ChannelAck, pushes)
+	errs := make([]error, pushes)
+	var wg sync.WaitGroup
+	wg.Add(pushes + 1)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, agent.pollJob())
+	}()
+	for i := 0; i < pushes; i++ {
+		go func(i int) {
+			defer wg.Done()
+			msg := &ChannelMessage{Type: channelMsgJob, Job: job(fmt.Sprintf("lease-%d", i))}
+			errs[i] = agent.handleChannelMessage(msg, &acks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	duplicates := 0
+	for i := range acks {
+		require.NoError(t, errs[i])
+		if acks[i].Duplicate {
+			duplicates++
+		}
+	}
+	pollDuplicates := testutil.ToFloat64(agent.metrics.jobsDuplicate.WithLabelValues(jobSourcePoll))
+	assert.Equal(t, pushes, duplicates+int(pollDuplicates))
+	agent.tasksMu.RLock()
+	task := agent.tasks["pushed-twice"]
+	assert.Empty(t, agent.claiming)
+	agent.tasksMu.RUnlock()
+	require.NotNil(t, task)
+	require.Eventually(t, task.finished, 5*time.Second, 10*time.Millisecond)
+	fake.mu.Lock()
+	assert.Len(t, fake.results, 1)
+	fake.mu.Unlock()
+
+	// 并发上限为1时，同时确认的不同任务只有一个能执行
+	viper.Set("k6.max_concurrent_tasks", 1)
+	defer viper.Set("k6.max_concurrent_tasks", 0)
+	started := make([]bool, pushes)
+	wg.Add(pushes)
+	for i := 0; i < pushes; i++ {
+		go func(i int) {
+			defer wg.Done()
+			j := &Job{ID: fmt.Sprintf("capped-%d", i), Type: "shell", Command: "sleep 0.2", Lease: &JobLease{ID: "lease", TTL: "1m"}}
+			started[i] = agent.acceptPushedJob(j) == nil
+		}(i)
+	}
+	wg.Wait()
+	admitted := 0
+	for _, ok := range started {
+		if ok {
+			admitted++
+		}
+	}
+	assert.Equal(t, 1, admitted)
+	assert.Equal(t, pushes-1, fake.count("release"))
+	require.Eventually(t, func() bool {
+		agent.tasksMu.RLock()
+		defer agent.tasksMu.RUnlock()
+		for _, task := range agent.tasks {
+			if !task.finished() {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestExecuteJobSkipsDuplicate(t *testing.T) {
+	agent := setupTestAgent()
+	existing := newTestTask(t, agent, &Job{ID: "local", Type: "shell"})
+	existing.setStatus("running")
+	agent.executeJob(&Job{ID: "local", Type: "shell", Command: "true"})
+
+	agent.tasksMu.RLock()
+	defer agent.tasksMu.RUnlock()
+	assert.Same(t, existing, agent.tasks["local"])
+	assert.Equal(t, "running", existing.Status.Status)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// 事件类型
+const (
+	eventLog      = "log"      // data为LogEntry
+	eventProgress = "progress" // data为{"progress": 进度}
+	eventStatus   = "status"   // data为{"status", "progress", "error"}
+	eventMetrics  = "metrics"  // data为k6LiveSnapshot
+	eventGap      = "gap"      // 续传起点已不在历史中，data为{"from", "firstAvailable"}
+	eventControl  = "control"  // data为{"action", "paused", "vus", "vusMax"}
+)
+
+// TaskEvent 推送给实时订阅者的任务事件
+type TaskEvent struct {
+	Seq  int64       `json:"seq"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// hubSubscriber 一个订阅者，拥有独立的有界缓冲
+type hubSubscriber struct {
+	events chan TaskEvent
+	lagged bool // 缓冲溢出被断开，客户端应从lastSeq+1续传
+	last   int64
+}
+
+// lastSeq 已投递给该订阅者的最后一个事件序号
+func (s *hubSubscriber) lastSeq() int64 {
+	return s.last
+}
+
+// taskHub 任务事件的扇出中心：每个事件投递给所有订阅者，并保留最近的历史用于续传
+type taskHub struct {
+	bufferSize int
+	onLag      func() // 订阅者因缓冲溢出被断开时调用
+
+	mu      sync.Mutex
+	nextSeq int64
+	history []TaskEvent // 环形缓冲
+	head    int         // 最旧事件在history中的位置
+	subs    map[*hubSubscriber]struct{}
+	closed  bool
+}
+
+// newTaskHub 创建事件中心，historySize为可续传的事件数，bufferSize为每个订阅者的缓冲大小
+func newTaskHub(historySize, bufferSize int) *taskHub {
+	if historySize <= 0 {
+		historySize = 1000
+	}
+	if bufferSize <= 0 {
+		bufferSize = 256
+	}
+	return &taskHub{
+		bufferSize: bufferSize,
+		nextSeq:    1,
+		history:    make([]TaskEvent, 0, historySize),
+		subs:       make(map[*hubSubscriber]struct{}),
+	}
+}
+
+// publish 发布事件，缓冲已满的订阅者会被断开而不是阻塞发布方
+func (h *taskHub) publish(eventType string, data interface{}) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+
+	event := TaskEvent{Seq: h.nextSeq, Type: eventType, Time: time.Now(), Data: data}
+	h.nextSeq++
+	if len(h.history) < cap(h.history) {
+		h.history = append(h.history, event)
+	} else {
+		h.history[h.head] = event
+		h.head = (h.head + 1) % len(h.history)
+	}
+
+	for sub := range h.subs {
+		select {
+		case sub.events <- event:
+			sub.last = event.Seq
+		default:
+			sub.lagged = true
+			delete(h.subs, sub)
+			close(sub.events)
+			if h.onLag != nil {
+				h.onLag()
+			}
+		}
+	}
+}
+
+// subscribe 订阅事件。from>0时先返回历史中序号不小于from的事件，
+// 若from已早于保留的历史，replay以gap事件开头
+func (h *taskHub) subscribe(from int64) (*hubSubscriber, []TaskEvent) {
+	if h == nil {
+		sub := &hubSubscriber{events: make(chan TaskEvent)}
+		close(sub.events)
+		return sub, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &hubSubscriber{events: make(chan TaskEvent, h.bufferSize), last: from - 1}
+	var replay []TaskEvent
+	if from > 0 {
+		events := make([]TaskEvent, 0, len(h.history))
+		events = append(events, h.history[h.head:]...)
+		events = append(events, h.history[:h.head]...)
+
+		first := h.nextSeq
+		if len(events) > 0 {
+			first = events[0].Seq
+		}
+		if from < first {
+			replay = append(replay, TaskEvent{
+				Type: eventGap,
+				Time: time.Now(),
+				Data: map[string]int64{"from": from, "firstAvailable": first},
+			})
+		}
+		for _, event := range events {
+			if event.Seq >= from {
+				replay = append(replay, event)
+				sub.last = event.Seq
+			}
+		}
+	}
+
+	if h.closed {
+		close(sub.events)
+	} else {
+		h.subs[sub] = struct{}{}
+	}
+	return sub, replay
+}
+
+// unsubscribe 取消订阅
+func (h *taskHub) unsubscribe(sub *hubSubscriber) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.events)
+	}
+}
+
+// isClosed 任务是否已结束
+func (h *taskHub) isClosed() bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closed
+}
+
+// close 任务结束，关闭所有订阅，之后的订阅只能读取历史
+func (h *taskHub) close() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for sub := range h.subs {
+		close(sub.events)
+	}
+	h.subs = nil
+}
+
+// eventPingInterval 实时连接的保活间隔
+func eventPingInterval() time.Duration {
+	interval, err := time.ParseDuration(viper.GetString("events.ping_interval"))
+	if err != nil || interval <= 0 {
+		return 30 * time.Second
+	}
+	return interval
+}
+
+// eventMetricsInterval 推送k6指标快照的间隔
+func eventMetricsInterval() time.Duration {
+	interval, err := time.ParseDuration(viper.GetString("events.metrics_interval"))
+	if err != nil || interval <= 0 {
+		return 2 * time.Second
+	}
+	return interval
+}
+
+// setStatus 更新任务状态并发布status事件
+func (t *Task) setStatus(status string) {
+	t.publishStatus(func(s *TaskStatus) { s.Status = status })
+}
+
+// fail 记录错误并把任务置为失败类状态，例如failed、oom_killed
+func (t *Task) fail(status, message string) {
+	t.publishStatus(func(s *TaskStatus) {
+		s.Status = status
+		s.Error = message
+	})
+}
+
+// publishStatus 在任务锁内修改状态后发布status事件
+func (t *Task) publishStatus(fn func(s *TaskStatus)) {
+	var event map[string]interface{}
+	t.update(func(s *TaskStatus) {
+		fn(s)
+		event = map[string]interface{}{
+			"status":   s.Status,
+			"progress": s.Progress,
+			"error":    s.Error,
+		}
+	})
+	t.Events.publish(eventStatus, event)
+}
+
+// setProgress 更新任务进度并发布progress事件
+func (t *Task) setProgress(progress float64) {
+	t.update(func(s *TaskStatus) { s.Progress = progress })
+	t.Events.publish(eventProgress, map[string]float64{"progress": progress})
+}
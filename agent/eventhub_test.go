@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func drain(sub *hubSubscriber) []TaskEvent {
+	var events []TaskEvent
+	for event := range sub.events {
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestTaskHubFanOut(t *testing.T) {
+	hub := newTaskHub(100, 10)
+	a, _ := hub.subscribe(0)
+	b, _ := hub.subscribe(0)
+
+	hub.publish(eventLog, "one")
+	hub.publish(eventProgress, "two")
+	hub.close()
+
+	// 每个订阅者都收到全部事件
+	for _, sub := range []*hubSubscriber{a, b} {
+		events := drain(sub)
+		require.Len(t, events, 2)
+		assert.Equal(t, int64(1), events[0].Seq)
+		assert.Equal(t, eventProgress, events[1].Type)
+		assert.False(t, sub.lagged)
+	}
+
+	// 关闭后发布无效，订阅只返回历史
+	hub.publish(eventLog, "ignored")
+	sub, replay := hub.subscribe(2)
+	assert.Len(t, replay, 1)
+	assert.Empty(t, drain(sub))
+}
+
+func TestTaskHubSlowSubscriber(t *testing.T) {
+	hub := newTaskHub(100, 2)
+	lagged := 0
+	hub.onLag = func() { lagged++ }
+
+	slow, _ := hub.subscribe(0)
+	fast, _ := hub.subscribe(0)
+	for i := 0; i < 2; i++ {
+		hub.publish(eventLog, i)
+		<-fast.events
+	}
+	// 慢订阅者缓冲已满，第三个事件使其断开，不影响其他订阅者
+	hub.publish(eventLog, 2)
+
+	events := drain(slow)
+	assert.Len(t, events, 2)
+	assert.True(t, slow.lagged)
+	assert.Equal(t, int64(2), slow.lastSeq())
+	assert.Equal(t, 1, lagged)
+	assert.Equal(t, int64(3), (<-fast.events).Seq)
+
+	// 从断开处续传
+	resumed, replay := hub.subscribe(slow.lastSeq() + 1)
+	require.Len(t, replay, 1)
+	assert.Equal(t, int64(3), replay[0].Seq)
+	hub.unsubscribe(resumed)
+}
+
+func TestTaskHubResumeGap(t *testing.T) {
+	hub := newTaskHub(3, 10)
+	for i := 0; i < 5; i++ {
+		hub.publish(eventLog, i)
+	}
+
+	_, replay := hub.subscribe(1)
+	require.Len(t, replay, 4)
+	assert.Equal(t, eventGap, replay[0].Type)
+	assert.Equal(t, map[string]int64{"from": 1, "firstAvailable": 3}, replay[0].Data)
+	assert.Equal(t, int64(3), replay[1].Seq)
+	assert.Equal(t, int64(5), replay[3].Seq)
+}
+
+func TestHandleWebSocketEvents(t *testing.T) {
+	agent := setupTestAgent()
+	router := gin.New()
+	router.GET("/ws/:taskId", agent.HandleWebSocket)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	task := &Task{
+		Status: &TaskStatus{ID: "ws-task", Status: "running"},
+		Events: newTaskHub(100, 10),
+	}
+	agent.tasksMu.Lock()
+	agent.tasks["ws-task"] = task
+	agent.tasksMu.Unlock()
+
+	task.appendLog("info", "agent", "first")
+	task.appendLog("info", "agent", "second")
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/ws-task?from=2"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// 续传从序号2开始
+	var event TaskEvent
+	require.NoError(t, conn.ReadJSON(&event))
+	assert.Equal(t, int64(2), event.Seq)
+	assert.Equal(t, eventLog, event.Type)
+	assert.Equal(t, "second", event.Data.(map[string]interface{})["message"])
+
+	task.setProgress(50)
+	require.NoError(t, conn.ReadJSON(&event))
+	assert.Equal(t, eventProgress, event.Type)
+
+	task.setStatus("completed")
+	require.NoError(t, conn.ReadJSON(&event))
+	assert.Equal(t, eventStatus, event.Type)
+	assert.Equal(t, "completed", event.Data.(map[string]interface{})["status"])
+
+	// 任务结束后服务端正常关闭连接
+	task.Events.close()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), "err: %v", err)
+}
+
+// readSSE 读取SSE流直到遇到指定事件类型，返回读到的事件类型、id和注释行
+func readSSE(t *testing.T, reader *bufio.Reader, until string) (types, ids, comments []string) {
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			types = append(types, strings.TrimPrefix(line, "event: "))
+			if types[len(types)-1] == until {
+				return
+			}
+		case strings.HasPrefix(line, "id: "):
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		case strings.HasPrefix(line, ":"):
+			comments = append(comments, line)
+			if until == ":" {
+				return
+			}
+		}
+	}
+}
+
+func TestHandleTaskEventsSSE(t *testing.T) {
+	viper.Set("events.ping_interval", "50ms")
+	defer viper.Set("events.ping_interval", "30s")
+
+	agent := setupTestAgent()
+	router := gin.New()
+	router.GET("/tasks/:taskId/events", agent.HandleTaskEvents)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	task := &Task{
+		Status: &TaskStatus{ID: "sse-task", Status: "running"},
+		Events: newTaskHub(100, 10),
+	}
+	agent.tasksMu.Lock()
+	agent.tasks["sse-task"] = task
+	agent.tasksMu.Unlock()
+
+	task.appendLog("info", "agent", "first")
+	task.appendLog("info", "agent", "second")
+
+	// 带Last-Event-ID重连，从下一个事件开始
+	req, _ := http.NewRequest("GET", server.URL+"/tasks/sse-task/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	types, ids, _ := readSSE(t, reader, eventLog)
+	assert.Equal(t, []string{eventLog}, types)
+	assert.Equal(t, []string{"2"}, ids)
+
+	// 空闲时发送心跳注释
+	_, _, comments := readSSE(t, reader, ":")
+	assert.Equal(t, []string{": ping"}, comments)
+
+	task.setStatus("completed")
+	task.Events.close()
+	types, ids, _ = readSSE(t, reader, "end")
+	assert.Equal(t, []string{eventStatus, "end"}, types)
+	assert.Equal(t, []string{"3"}, ids)
+
+	// 任务结束后没有新事件，204使客户端停止重连
+	req.Header.Set("Last-Event-ID", "3")
+	resp2, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp2.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp2.StatusCode)
+
+	req.Header.Set("Last-Event-ID", "abc")
+	resp3, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp3.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp3.StatusCode)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// fieldError 请求校验错误，Field为出错字段的JSON路径
+type fieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *fieldError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+func newFieldError(field, format string, args ...interface{}) *fieldError {
+	return &fieldError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// decodeExecuteRequest 严格解析直接执行请求，不接受未知字段
+func decodeExecuteRequest(body io.Reader) (*ExecuteRequest, *fieldError) {
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+
+	var req ExecuteRequest
+	if err := decoder.Decode(&req); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &typeErr):
+			return nil, newFieldError(typeErr.Field, "类型错误，应为%s", typeErr.Type.String())
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			return nil, newFieldError(field, "不支持的字段")
+		default:
+			return nil, newFieldError("", "无效的JSON: %v", err)
+		}
+	}
+	if decoder.More() {
+		return nil, newFieldError("", "无效的JSON: 请求体只能包含一个对象")
+	}
+	return &req, nil
+}
+
+// localJobTypeAllowed 本地API没有认证，只接受agent.allowed_job_types中的任务类型；
+// 未配置时只接受k6，避免任何能访问端口的调用方在压测机上执行任意命令
+func localJobTypeAllowed(jobType string) bool {
+	allowed := viper.GetStringSlice("agent.allowed_job_types")
+	if len(allowed) == 0 {
+		return jobType == "k6"
+	}
+	for _, t := range allowed {
+		if t == jobType {
+			return true
+		}
+	}
+	return false
+}
+
+// validate 按任务类型校验请求，返回第一个出错的字段
+func (r *ExecuteRequest) validate() *fieldError {
+	if r.Type == "" {
+		r.Type = "k6"
+	}
+
+	switch r.Type {
+	case "k6":
+		if r.ScriptID == "" && r.ScriptContent == "" {
+			return newFieldError("scriptContent", "k6任务需要scriptId或scriptContent")
+		}
+		if r.Command != "" {
+			return newFieldError("command", "k6任务不支持command")
+		}
+	case "shell", "docker":
+		if strings.TrimSpace(r.Command) == "" {
+			return newFieldError("command", "%s任务需要command", r.Type)
+		}
+	case "python":
+		if r.ScriptContent == "" {
+			return newFieldError("scriptContent", "python任务需要scriptContent")
+		}
+		if r.Command != "" {
+			return newFieldError("command", "python任务不支持command")
+		}
+	default:
+		return newFieldError("type", "不支持的任务类型%q，应为k6、shell、python或docker", r.Type)
+	}
+
+	if r.Type != "k6" {
+		if r.ScriptID != "" {
+			return newFieldError("scriptId", "只有k6任务支持scriptId")
+		}
+		if len(r.Options) > 0 {
+			return newFieldError("options", "只有k6任务支持options")
+		}
+		if r.Outputs != nil {
+			return newFieldError("outputs", "只有k6任务支持outputs")
+		}
+		if r.ExecutionSegment != "" || r.ExecutionSegmentSequence != "" || r.SegmentID != "" {
+			return newFieldError("executionSegment", "只有k6任务支持执行段")
+		}
+		if r.StartBarrier != nil {
+			return newFieldError("startBarrier", "只有k6任务支持同步开始")
+		}
+	}
+	if r.StartBarrier != nil && r.StartBarrier.Timeout != "" {
+		if d, err := time.ParseDuration(r.StartBarrier.Timeout); err != nil || d <= 0 {
+			return newFieldError("startBarrier.timeout", "无效的时长%q，例如\"5m\"", r.StartBarrier.Timeout)
+		}
+	}
+	if part, err := checkExecutionSegment(r.ExecutionSegment, r.ExecutionSegmentSequence); err != nil {
+		if part == "sequence" {
+			return newFieldError("executionSegmentSequence", "%v", err)
+		}
+		return newFieldError("executionSegment", "%v", err)
+	}
+	if err := validateK6Options(r.Options); err != nil {
+		return err
+	}
+
+	if r.Timeout != "" {
+		if d, err := time.ParseDuration(r.Timeout); err != nil || d <= 0 {
+			return newFieldError("timeout", "无效的时长%q，例如\"30m\"", r.Timeout)
+		}
+	}
+	if r.Priority < 0 {
+		return newFieldError("priority", "不能为负数")
+	}
+	for key := range r.Tags {
+		if key == "" {
+			return newFieldError("tags", "标签名不能为空")
+		}
+	}
+	if r.Outputs != nil && r.Outputs.InfluxDB != nil {
+		if _, err := influxWriteURL(*r.Outputs.InfluxDB); err != nil {
+			return newFieldError("outputs.influxdb", "%v", err)
+		}
+	}
+	if r.CallbackLogs < 0 || r.CallbackLogs > 1000 {
+		return newFieldError("callbackLogs", "必须在0到1000之间")
+	}
+	if r.CallbackLogs > 0 && r.CallbackURL == "" {
+		return newFieldError("callbackLogs", "需要同时设置callbackUrl")
+	}
+	if r.CallbackURL != "" {
+		u, err := url.Parse(r.CallbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return newFieldError("callbackUrl", "应为http或https地址")
+		}
+	}
+	return nil
+}
+
+// validateK6Options 校验k6执行选项，只接受Agent会转换为命令行参数的选项
+func validateK6Options(options map[string]interface{}) *fieldError {
+	for key, value := range options {
+		field := "options." + key
+		switch key {
+		case "vus", "iterations":
+			if !isPositiveInteger(value) {
+				return newFieldError(field, "应为正整数")
+			}
+		case "duration":
+			if !isDuration(value) {
+				return newFieldError(field, "应为时长字符串，例如\"30s\"")
+			}
+		case "stages":
+			stages, ok := value.([]interface{})
+			if !ok || len(stages) == 0 {
+				return newFieldError(field, "应为非空数组")
+			}
+			for i, item := range stages {
+				stage, ok := item.(map[string]interface{})
+				if !ok {
+					return newFieldError(fmt.Sprintf("%s[%d]", field, i), "应为包含duration和target的对象")
+				}
+				if !isDuration(stage["duration"]) {
+					return newFieldError(fmt.Sprintf("%s[%d].duration", field, i), "应为时长字符串，例如\"30s\"")
+				}
+				if target, ok := stage["target"].(float64); !ok || target < 0 || target != math.Trunc(target) {
+					return newFieldError(fmt.Sprintf("%s[%d].target", field, i), "应为非负整数")
+				}
+			}
+		default:
+			return newFieldError(field, "不支持的选项，可用选项为vus、duration、iterations、stages")
+		}
+	}
+	return nil
+}
+
+func isPositiveInteger(value interface{}) bool {
+	n, ok := value.(float64)
+	return ok && n > 0 && n == math.Trunc(n)
+}
+
+func isDuration(value interface{}) bool {
+	s, ok := value.(string)
+	if !ok {
+		return false
+	}
+	d, err := time.ParseDuration(s)
+	return err == nil && d > 0
+}
+
+// k6StagesArg 把stages选项转换为k6 --stage参数的 duration:target 形式
+func k6StagesArg(stages interface{}) string {
+	items, _ := stages.([]interface{})
+	parts := make([]string, 0, len(items))
+	for _, item := range items {
+		stage, _ := item.(map[string]interface{})
+		parts = append(parts, fmt.Sprintf("%v:%s", stage["duration"], k6IntArg(stage["target"])))
+	}
+	return strings.Join(parts, ",")
+}
+
+// k6IntArg 格式化已校验为整数的选项。JSON数字解码为float64，%v在较大时会输出1e+06这种k6无法解析的形式
+func k6IntArg(value interface{}) string {
+	if n, ok := value.(float64); ok && n == math.Trunc(n) {
+		return strconv.FormatInt(int64(n), 10)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// toJob 转换为与轮询任务相同的Job
+func (r *ExecuteRequest) toJob(id string) *Job {
+	return &Job{
+		ID:                       id,
+		Type:                     r.Type,
+		ScriptID:                 r.ScriptID,
+		ScriptContent:            r.ScriptContent,
+		Command:                  r.Command,
+		Params:                   r.Parameters,
+		Options:                  r.Options,
+		Timeout:                  r.Timeout,
+		Priority:                 r.Priority,
+		Tags:                     r.Tags,
+		Outputs:                  r.Outputs,
+		CallbackURL:              r.CallbackURL,
+		CallbackLogs:             r.CallbackLogs,
+		ExecutionSegment:         r.ExecutionSegment,
+		ExecutionSegmentSequence: r.ExecutionSegmentSequence,
+		SegmentID:                r.SegmentID,
+		StartBarrier:             r.StartBarrier,
+		receivedAt:               time.Now(),
+	}
+}
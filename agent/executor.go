@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -20,7 +19,10 @@ import (
 
 // Executor K6执行器
 type Executor struct {
-	agent *Agent
+	agent      *Agent
+	sinks      []k6SampleSink
+	live       *k6LiveStats
+	outputPath string
 }
 
 // NewExecutor 创建新的执行器
@@ -33,6 +35,30 @@ func (e *Executor) SetAgent(agent *Agent) {
 	e.agent = agent
 }
 
+// SetLiveStats 设置任务的实时指标聚合，同时作为k6数据点的sink
+func (e *Executor) SetLiveStats(stats *k6LiveStats) {
+	e.live = stats
+	e.AddSink(stats)
+}
+
+// AddSink 添加k6数据点的消费者
+func (e *Executor) AddSink(sink k6SampleSink) {
+	e.sinks = append(e.sinks, sink)
+}
+
+// keepResults 启用对象存储时把NDJSON结果文件移入产物目录随产物上传，否则删除
+func (e *Executor) keepResults(task *Task) {
+	if e.agent != nil && e.agent.storage != nil && task.OutputDir != "" {
+		target := filepath.Join(task.OutputDir, "k6-results.ndjson")
+		if err := os.Rename(e.outputPath, target); err == nil {
+			return
+		} else if !os.IsNotExist(err) {
+			logrus.Warnf("保留任务 %s 的结果文件失败: %v", task.Status.ID, err)
+		}
+	}
+	os.Remove(e.outputPath)
+}
+
 // K6Result k6执行结果
 type K6Result struct {
 	Metrics map[string]interface{} `json:"metrics"`
@@ -43,20 +69,24 @@ type K6Result struct {
 // Execute 执行k6脚本
 func (e *Executor) Execute(task *Task, req ExecuteRequest) error {
 	logrus.Infof("开始执行k6任务 %s", task.Status.ID)
-	task.Status.Status = "running"
+	task.setStatus("running")
 
 	defer func() {
 		if r := recover(); r != nil {
 			logrus.Errorf("任务执行异常: %v", r)
-			task.Status.Status = "failed"
-			task.Status.Error = fmt.Sprintf("执行异常: %v", r)
 			now := time.Now()
-			task.Status.EndTime = &now
+			task.update(func(s *TaskStatus) {
+				s.Status = "failed"
+				s.Error = fmt.Sprintf("执行异常: %v", r)
+				s.EndTime = &now
+			})
 		}
 	}()
 
 	// 1. 准备脚本文件
+	_, span := task.startSpan("job.script_download")
 	scriptPath, err := e.prepareScript(task, req)
+	endSpan(span, err)
 	if err != nil {
 		e.handleTaskError(task, "脚本准备失败", err)
 		return err
@@ -64,23 +94,43 @@ func (e *Executor) Execute(task *Task, req ExecuteRequest) error {
 	defer os.Remove(scriptPath) // 清理临时文件
 
 	// 2. 构建k6命令
+	_, span = task.startSpan("job.build_command")
 	cmd, err := e.buildK6Command(task, scriptPath, req)
+	endSpan(span, err)
 	if err != nil {
 		e.handleTaskError(task, "命令构建失败", err)
 		return err
 	}
 
 	task.Cmd = cmd
+	defer e.keepResults(task) // 清理或保留结果文件
+
+	// 多Agent同步开始：脚本和命令就绪后等待统一的开始时间
+	if task.Barrier != nil && e.agent != nil {
+		_, span = task.startSpan("job.start_barrier")
+		err = e.agent.waitForStart(task)
+		endSpan(span, err)
+		if err != nil {
+			e.handleTaskError(task, "同步开始失败", err)
+			return err
+		}
+	}
+	// 超时从实际开始执行算起
+	task.startTimeout()
 
 	// 3. 执行命令
+	_, span = task.startSpan("job.run")
 	err = e.runK6Command(task, cmd)
+	endSpan(span, err)
 	if err != nil {
 		e.handleTaskError(task, "执行失败", err)
 		return err
 	}
 
 	// 4. 处理结果
+	_, span = task.startSpan("job.process_result")
 	e.processResult(task, req)
+	span.End()
 
 	logrus.Infof("任务 %s 执行完成", task.Status.ID)
 	return nil
@@ -108,9 +158,12 @@ func (e *Executor) prepareScript(task *Task, req ExecuteRequest) (string, error)
 		return "", fmt.Errorf("未提供脚本内容或脚本ID")
 	}
 
-	// 创建临时脚本文件
-	tempDir := os.TempDir()
-	scriptPath := filepath.Join(tempDir, fmt.Sprintf("k6-script-%s.js", task.Status.ID))
+	// 脚本写入任务工作目录，随任务一起清理
+	workspace := taskWorkspace(task.Status.ID)
+	if err := os.MkdirAll(workspace, 0755); err != nil {
+		return "", fmt.Errorf("创建任务工作目录失败: %v", err)
+	}
+	scriptPath := filepath.Join(workspace, fmt.Sprintf("k6-script-%s.js", task.Status.ID))
 
 	err := os.WriteFile(scriptPath, []byte(scriptContent), 0644)
 	if err != nil {
@@ -126,7 +179,12 @@ func (e *Executor) downloadScript(scriptID string) (string, error) {
 	backendURL := viper.GetString("backend.url")
 	url := fmt.Sprintf("%s/api/scripts/%s/content", backendURL, scriptID)
 
-	resp, err := http.Get(url)
+	client := http.DefaultClient
+	if e.agent != nil {
+		client = e.agent.httpClient
+	}
+
+	resp, err := client.Get(url)
 	if err != nil {
 		return "", err
 	}
@@ -160,14 +218,30 @@ func (e *Executor) buildK6Command(task *Task, scriptPath string, req ExecuteRequ
 	k6Binary := viper.GetString("k6.binary")
 	args := []string{"run"}
 
-	// 添加输出格式
-	args = append(args, "--out", "json=results.json")
+	// 添加输出格式，每个任务使用独立的结果文件
+	e.outputPath = filepath.Join(filepath.Dir(scriptPath), fmt.Sprintf("k6-results-%s.json", task.Status.ID))
+	args = append(args, "--out", "json="+e.outputPath)
+
+	// 独立的k6 REST API地址，用于暂停、恢复和调整VU数
+	if viper.GetBool("k6.rest_api.enabled") {
+		if address, err := allocK6Address(); err != nil {
+			e.addLevelLog(task, "warn", fmt.Sprintf("分配k6 REST API地址失败，任务不支持实时控制: %v", err))
+		} else {
+			task.mu.Lock()
+			task.K6Address = address
+			task.mu.Unlock()
+			args = append(args, "--address", address)
+		}
+	}
+
+	// 分布式任务只执行本Agent负责的执行段
+	args = append(args, k6SegmentArgs(req.ExecutionSegment, req.ExecutionSegmentSequence)...)
 
 	// 处理执行选项
 	if req.Options != nil {
 		// VUs (虚拟用户数)
 		if vus, ok := req.Options["vus"]; ok {
-			args = append(args, "--vus", fmt.Sprintf("%v", vus))
+			args = append(args, "--vus", k6IntArg(vus))
 		}
 
 		// Duration (持续时间)
@@ -177,28 +251,37 @@ func (e *Executor) buildK6Command(task *Task, scriptPath string, req ExecuteRequ
 
 		// Iterations (迭代次数)
 		if iterations, ok := req.Options["iterations"]; ok {
-			args = append(args, "--iterations", fmt.Sprintf("%v", iterations))
+			args = append(args, "--iterations", k6IntArg(iterations))
 		}
 
 		// Stages (阶段配置)
 		if stages, ok := req.Options["stages"]; ok {
-			stagesJSON, _ := json.Marshal(stages)
-			args = append(args, "--stage", string(stagesJSON))
+			args = append(args, "--stage", k6StagesArg(stages))
 		}
 	}
 
 	// 处理环境变量参数
 	if req.Parameters != nil {
 		for key, value := range req.Parameters {
+			if key == resourcesParamKey {
+				continue // 资源限制参数由Agent处理，不传给脚本
+			}
 			args = append(args, "-e", fmt.Sprintf("%s=%v", key, value))
 		}
 	}
 
+	// 汇总结果写入产物目录，脚本可通过__ENV.K6_AGENT_OUTPUT_DIR定位该目录
+	if task.OutputDir != "" {
+		args = append(args, "--summary-export", filepath.Join(task.OutputDir, "summary.json"))
+		args = append(args, "-e", outputDirEnv+"="+task.OutputDir)
+	}
+
 	// 添加脚本文件
 	args = append(args, scriptPath)
 
 	cmd := exec.CommandContext(task.Ctx, k6Binary, args...)
 	cmd.Dir = filepath.Dir(scriptPath)
+	task.useOutputDir(cmd, true) // handleSummary中的相对路径写入产物目录
 
 	e.addLog(task, fmt.Sprintf("k6命令: %s %s", k6Binary, strings.Join(args, " ")))
 	return cmd, nil
@@ -219,36 +302,69 @@ func (e *Executor) runK6Command(task *Task, cmd *exec.Cmd) error {
 		return err
 	}
 
-	// 启动命令
-	err = cmd.Start()
+	// 放入任务cgroup后启动命令
+	err = task.startCommand(cmd)
 	if err != nil {
 		return err
 	}
 
+	// 监控压测机资源，判断结果是否受压测机瓶颈影响
+	var monitor *generatorMonitor
+	if e.agent != nil {
+		monitor = e.agent.startGeneratorMonitor(task, cmd.Process.Pid, func(sample GeneratorSample) {
+			e.addLevelLog(task, "warn", fmt.Sprintf("警告: 压测机CPU使用率 %.1f%%，k6进程 %.1f%%，cgroup限流 %.1f%%，已超过阈值，结果可能失真",
+				sample.HostCPUPercent, sample.ProcessCPUPercent, sample.CPUThrottledPercent))
+		})
+	}
+
+	// 跟踪k6结果文件，实时分发数据点
+	tailer := newK6OutputTailer(e.outputPath, e.sinks)
+	tailer.start()
+
+	// 定期推送k6指标快照
+	stopMetrics := make(chan struct{})
+	if e.live != nil {
+		go e.publishMetrics(task, stopMetrics)
+	}
+
 	// 实时读取输出
 	go e.readOutput(task, stdout, "stdout")
 	go e.readOutput(task, stderr, "stderr")
 
 	// 等待命令完成
 	err = cmd.Wait()
+	tailer.finish()
+	close(stopMetrics)
+
+	var generator *GeneratorReport
+	if monitor != nil {
+		generator = monitor.finish()
+	}
 
 	now := time.Now()
-	task.Status.EndTime = &now
+	task.update(func(s *TaskStatus) {
+		if generator != nil {
+			s.Generator = generator
+		}
+		s.EndTime = &now
+	})
 
 	if err != nil {
 		if task.Ctx.Err() == nil { // 不是被取消的
-			task.Status.Status = "failed"
-			task.Status.Error = err.Error()
-			e.addLog(task, fmt.Sprintf("执行失败: %v", err))
+			task.update(func(s *TaskStatus) {
+				s.Status = "failed"
+				s.Error = err.Error()
+			})
+			e.addLevelLog(task, "error", fmt.Sprintf("执行失败: %v", err))
 		} else {
-			task.Status.Status = "stopped"
+			task.update(func(s *TaskStatus) { s.Status = "stopped" })
 			e.addLog(task, "执行已停止")
 		}
 		return err
 	}
 
-	task.Status.Status = "completed"
-	task.Status.Progress = 100
+	task.setProgress(100)
+	task.setStatus("completed")
 	e.addLog(task, "k6测试执行完成")
 	return nil
 }
@@ -258,8 +374,7 @@ func (e *Executor) readOutput(task *Task, reader io.Reader, source string) {
 	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 		line := scanner.Text()
-		logLine := fmt.Sprintf("[%s] %s", source, line)
-		e.addLog(task, logLine)
+		task.appendLog(outputLevel(source, line), source, line)
 
 		// 解析进度信息
 		e.parseProgress(task, line)
@@ -275,7 +390,7 @@ func (e *Executor) parseProgress(task *Task, line string) {
 		if len(parts) >= 2 {
 			// 这里可以添加更复杂的进度计算逻辑
 			if progress, err := strconv.Atoi("50"); err == nil {
-				task.Status.Progress = float64(progress)
+				task.setProgress(float64(progress))
 			}
 		}
 	}
@@ -285,84 +400,57 @@ func (e *Executor) parseProgress(task *Task, line string) {
 func (e *Executor) processResult(task *Task, req ExecuteRequest) {
 	e.addLog(task, "正在处理执行结果...")
 
-	// 读取结果文件
-	resultPath := filepath.Join(filepath.Dir(task.Cmd.Dir), "results.json")
-	if _, err := os.Stat(resultPath); err == nil {
-		resultData, err := os.ReadFile(resultPath)
+	// 结果文件为NDJSON，已在运行期间聚合，这里取整次运行的累计结果（不是最近10秒的滚动速率）
+	if e.live != nil {
+		summary := e.live.summary()
+		metricsJSON, err := json.Marshal(summary)
 		if err == nil {
-			// 解析JSON结果
-			var result map[string]interface{}
-			if err := json.Unmarshal(resultData, &result); err == nil {
-				task.Status.Result = result
-				e.addLog(task, "结果解析成功")
-			} else {
-				e.addLog(task, fmt.Sprintf("结果解析失败: %v", err))
+			result := map[string]interface{}{
+				"metrics":      summary,
+				"metrics_json": string(metricsJSON),
 			}
+			task.update(func(s *TaskStatus) { s.Result = result })
+			e.addLog(task, "结果解析成功")
+		} else {
+			e.addLevelLog(task, "warn", fmt.Sprintf("结果解析失败: %v", err))
 		}
-		os.Remove(resultPath) // 清理结果文件
-	}
-
-	// 回调后端
-	if req.CallbackURL != "" {
-		go e.sendCallback(task, req.CallbackURL)
-	}
-}
-
-// sendCallback 发送回调
-func (e *Executor) sendCallback(task *Task, callbackURL string) {
-	payload := map[string]interface{}{
-		"taskId":    task.Status.ID,
-		"status":    task.Status.Status,
-		"result":    task.Status.Result,
-		"error":     task.Status.Error,
-		"startTime": task.Status.StartTime,
-		"endTime":   task.Status.EndTime,
-		"logs":      task.Status.Logs,
-	}
-
-	data, err := json.Marshal(payload)
-	if err != nil {
-		logrus.Errorf("序列化回调数据失败: %v", err)
-		return
-	}
-
-	resp, err := http.Post(callbackURL, "application/json", bytes.NewBuffer(data))
-	if err != nil {
-		logrus.Errorf("发送回调失败: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		logrus.Errorf("回调响应错误: %d", resp.StatusCode)
-	} else {
-		logrus.Infof("回调发送成功: %s", callbackURL)
 	}
 }
 
 // addLog 添加日志
 func (e *Executor) addLog(task *Task, message string) {
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	logLine := fmt.Sprintf("[%s] %s", timestamp, message)
+	e.addLevelLog(task, "info", message)
+}
 
-	task.Status.Logs = append(task.Status.Logs, logLine)
+// addLevelLog 按指定级别添加日志
+func (e *Executor) addLevelLog(task *Task, level, message string) {
+	logrus.Info(task.appendLog(level, "agent", message))
+}
 
-	// 发送到WebSocket客户端
-	select {
-	case task.LogChan <- logLine:
-	default:
-		// 如果通道满了，跳过
+// publishMetrics 在k6运行期间定期发布指标快照，直到stop关闭
+func (e *Executor) publishMetrics(task *Task, stop <-chan struct{}) {
+	ticker := time.NewTicker(eventMetricsInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			task.Events.publish(eventMetrics, e.live.snapshot())
+		case <-stop:
+			task.Events.publish(eventMetrics, e.live.snapshot())
+			return
+		}
 	}
-
-	logrus.Info(logLine)
 }
 
 // handleTaskError 处理任务错误
 func (e *Executor) handleTaskError(task *Task, message string, err error) {
-	task.Status.Status = "failed"
-	task.Status.Error = fmt.Sprintf("%s: %v", message, err)
+	errMsg := fmt.Sprintf("%s: %v", message, err)
 	now := time.Now()
-	task.Status.EndTime = &now
-	e.addLog(task, task.Status.Error)
-	logrus.Errorf("任务 %s 失败: %s", task.Status.ID, task.Status.Error)
+	task.update(func(s *TaskStatus) {
+		s.Status = "failed"
+		s.Error = errMsg
+		s.EndTime = &now
+	})
+	e.addLevelLog(task, "error", errMsg)
+	logrus.Errorf("任务 %s 失败: %s", task.Status.ID, errMsg)
 }
\ No newline at end of file
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// HostResources 主机资源快照，字段名与后端Agent实体的resources保持一致
+type HostResources struct {
+	CPUCores        int       `json:"cpuCores"`
+	CPUUsage        float64   `json:"cpuUsage"` // 百分比，两次采样之间的平均值
+	LoadAvg1        float64   `json:"loadAvg1"`
+	LoadAvg5        float64   `json:"loadAvg5"`
+	LoadAvg15       float64   `json:"loadAvg15"`
+	TotalMemory     int64     `json:"totalMemory"`     // MB
+	AvailableMemory int64     `json:"availableMemory"` // MB
+	MemoryUsage     float64   `json:"memoryUsage"`     // 百分比
+	DiskTotal       int64     `json:"diskTotal"`       // 工作目录所在磁盘，MB
+	DiskFree        int64     `json:"diskFree"`        // MB
+	OpenFiles       int64     `json:"openFiles"`
+	MaxOpenFiles    int64     `json:"maxOpenFiles"`
+	IPs             []string  `json:"ips,omitempty"`
+	CollectedAt     time.Time `json:"collectedAt"`
+}
+
+// cpuTimes /proc/stat中的CPU累计时间
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+// hostSampler 采集主机资源，保存上一次的CPU时间用于计算使用率
+type hostSampler struct {
+	mu      sync.Mutex
+	prevCPU cpuTimes
+	dir     string
+	target  string
+}
+
+// newHostSampler 创建主机资源采集器，target用于选出访问后端所用的主IP
+func newHostSampler(workspace, backendURL string) *hostSampler {
+	target := ""
+	if u, err := url.Parse(backendURL); err == nil {
+		target = u.Host
+	}
+	return &hostSampler{dir: workspace, target: target}
+}
+
+// collect 采集一次主机资源快照
+func (s *hostSampler) collect() *HostResources {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := &HostResources{
+		CPUCores:    runtime.NumCPU(),
+		IPs:         getHostIPs(s.target),
+		CollectedAt: time.Now(),
+	}
+
+	// 首次采样时prevCPU为零值，得到的是开机以来的平均使用率
+	if cur, err := readCPUTimes(); err == nil {
+		res.CPUUsage = cpuPercent(s.prevCPU, cur)
+		s.prevCPU = cur
+	}
+
+	readPlatformResources(res, s.dir)
+
+	if res.TotalMemory > 0 {
+		res.MemoryUsage = float64(res.TotalMemory-res.AvailableMemory) / float64(res.TotalMemory) * 100
+	}
+	return res
+}
+
+// cpuPercent 根据两次CPU累计时间计算使用率
+func cpuPercent(prev, cur cpuTimes) float64 {
+	if cur.total <= prev.total {
+		return 0
+	}
+	total := cur.total - prev.total
+	idle := cur.idle - prev.idle
+	if idle > total {
+		return 0
+	}
+	return float64(total-idle) / float64(total) * 100
+}
+
+// getHostIPs 返回非回环地址，访问target时使用的出口地址排在最前
+func getHostIPs(target string) []string {
+	var ips []string
+	primary := outboundIP(target)
+	if primary != "" {
+		ips = append(ips, primary)
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ips
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			ip := ipNet.IP.String()
+			if !containsString(ips, ip) {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+// outboundIP 通过UDP“连接”目标地址获取本机出口IP，不会真正发送数据
+func outboundIP(target string) string {
+	if target == "" {
+		target = "8.8.8.8:80"
+	} else if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "80")
+	}
+
+	conn, err := net.DialTimeout("udp", target, time.Second)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || addr.IP.IsLoopback() || addr.IP.IsUnspecified() {
+		return ""
+	}
+	return addr.IP.String()
+}
+
+// workspaceDir Agent存放任务文件的工作目录
+func workspaceDir() string {
+	if dir := viper.GetString("resources.workspace_dir"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "k6-agent")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// readCPUTimes 读取/proc/stat中汇总的CPU时间
+func readCPUTimes() (cpuTimes, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return cpuTimes{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+
+		var times cpuTimes
+		for i, field := range fields[1:] {
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				continue
+			}
+			// guest和guest_nice已计入user和nice，不重复累加
+			if i >= 8 {
+				break
+			}
+			times.total += v
+			// idle和iowait视为空闲
+			if i == 3 || i == 4 {
+				times.idle += v
+			}
+		}
+		return times, nil
+	}
+	return cpuTimes{}, fmt.Errorf("/proc/stat中未找到cpu行")
+}
+
+// readPlatformResources 从/proc和文件系统读取内存、负载、磁盘和文件描述符信息
+func readPlatformResources(res *HostResources, dir string) {
+	if mem, err := readMeminfo(); err == nil {
+		res.TotalMemory = mem["MemTotal"] / 1024
+		res.AvailableMemory = mem["MemAvailable"] / 1024
+	}
+
+	if content, err := os.ReadFile("/proc/loadavg"); err == nil {
+		fields := strings.Fields(string(content))
+		if len(fields) >= 3 {
+			res.LoadAvg1, _ = strconv.ParseFloat(fields[0], 64)
+			res.LoadAvg5, _ = strconv.ParseFloat(fields[1], 64)
+			res.LoadAvg15, _ = strconv.ParseFloat(fields[2], 64)
+		}
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(existingParent(dir), &stat); err == nil {
+		res.DiskTotal = int64(stat.Blocks) * int64(stat.Bsize) / (1 << 20)
+		res.DiskFree = int64(stat.Bavail) * int64(stat.Bsize) / (1 << 20)
+	}
+
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		res.OpenFiles = int64(len(entries))
+	}
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err == nil {
+		res.MaxOpenFiles = int64(limit.Cur)
+	}
+}
+
+// readMeminfo 解析/proc/meminfo，数值单位为kB
+func readMeminfo() (map[string]int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		if v, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			values[key] = v
+		}
+	}
+	return values, scanner.Err()
+}
+
+// existingParent 返回路径中最近的已存在目录，工作目录尚未创建时统计其所在磁盘
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// clockTicks /proc/<pid>/stat中CPU时间的单位（USER_HZ），Linux上固定为100
+const clockTicks = 100
+
+// readMemoryUsage 读取内存总量和可用量（字节）
+func readMemoryUsage() (total, available int64, err error) {
+	mem, err := readMeminfo()
+	if err != nil {
+		return 0, 0, err
+	}
+	return mem["MemTotal"] * 1024, mem["MemAvailable"] * 1024, nil
+}
+
+// readNetDevTotals 汇总/proc/net/dev中除回环外所有网卡的收发字节数
+func readNetDevTotals() (rx, tx uint64, err error) {
+	f, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(name) == "lo" {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) < 9 {
+			continue
+		}
+		r, _ := strconv.ParseUint(fields[0], 10, 64)
+		t, _ := strconv.ParseUint(fields[8], 10, 64)
+		rx += r
+		tx += t
+	}
+	return rx, tx, scanner.Err()
+}
+
+// readProcessStats 读取进程累计CPU时间（秒）和常驻内存（字节）
+func readProcessStats(pid int) (cpuSeconds float64, rssBytes int64, err error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// 进程名可能包含空格，从最后一个右括号之后开始解析
+	stat := string(content)
+	idx := strings.LastIndex(stat, ")")
+	if idx < 0 {
+		return 0, 0, fmt.Errorf("无法解析进程 %d 的stat", pid)
+	}
+	fields := strings.Fields(stat[idx+1:])
+	// fields[0]为state，utime、stime、rss分别是stat的第14、15、24列
+	if len(fields) < 22 {
+		return 0, 0, fmt.Errorf("进程 %d 的stat字段不足", pid)
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	rssPages, _ := strconv.ParseInt(fields[21], 10, 64)
+
+	return float64(utime+stime) / clockTicks, rssPages * int64(os.Getpagesize()), nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// readCPUTimes 非Linux平台暂不支持CPU使用率采集
+func readCPUTimes() (cpuTimes, error) {
+	return cpuTimes{}, fmt.Errorf("当前平台不支持CPU使用率采集")
+}
+
+// readPlatformResources 非Linux平台仅上报CPU核数和IP
+func readPlatformResources(res *HostResources, dir string) {}
+
+func readMemoryUsage() (total, available int64, err error) {
+	return 0, 0, fmt.Errorf("当前平台不支持内存采集")
+}
+
+func readNetDevTotals() (rx, tx uint64, err error) {
+	return 0, 0, fmt.Errorf("当前平台不支持网络流量采集")
+}
+
+func readProcessStats(pid int) (cpuSeconds float64, rssBytes int64, err error) {
+	return 0, 0, fmt.Errorf("当前平台不支持进程统计")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCPUPercent(t *testing.T) {
+	prev := cpuTimes{idle: 800, total: 1000}
+	cur := cpuTimes{idle: 850, total: 1200}
+	assert.InDelta(t, 75.0, cpuPercent(prev, cur), 0.001)
+
+	// 计数器未增长时返回0
+	assert.Equal(t, float64(0), cpuPercent(cur, cur))
+}
+
+func TestHostSamplerCollect(t *testing.T) {
+	sampler := newHostSampler(t.TempDir(), "http://127.0.0.1:3001")
+	res := sampler.collect()
+
+	assert.Equal(t, runtime.NumCPU(), res.CPUCores)
+	assert.False(t, res.CollectedAt.IsZero())
+	for _, ip := range res.IPs {
+		parsed := net.ParseIP(ip)
+		assert.NotNil(t, parsed, ip)
+		assert.False(t, parsed.IsLoopback(), ip)
+	}
+
+	if runtime.GOOS == "linux" {
+		assert.Greater(t, res.TotalMemory, int64(0))
+		assert.LessOrEqual(t, res.AvailableMemory, res.TotalMemory)
+		assert.Greater(t, res.DiskTotal, int64(0))
+		assert.Greater(t, res.OpenFiles, int64(0))
+		assert.GreaterOrEqual(t, res.MaxOpenFiles, res.OpenFiles)
+
+		// 第二次采样基于上一次的CPU计数计算
+		second := sampler.collect()
+		assert.GreaterOrEqual(t, second.CPUUsage, float64(0))
+		assert.LessOrEqual(t, second.CPUUsage, float64(100))
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// InfluxDBOutput 任务级InfluxDB输出配置，兼容v1和v2写入接口
+type InfluxDBOutput struct {
+	URL     string `json:"url"`
+	Version int    `json:"version,omitempty"` // 1或2，默认1
+
+	// v1
+	Database        string `json:"database,omitempty"`
+	RetentionPolicy string `json:"retention_policy,omitempty"`
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+
+	// v2
+	Org    string `json:"org,omitempty"`
+	Bucket string `json:"bucket,omitempty"`
+	Token  string `json:"token,omitempty"`
+
+	BatchSize     int    `json:"batch_size,omitempty"`     // 每批最多点数，默认1000
+	FlushInterval string `json:"flush_interval,omitempty"` // 最长攒批时间，默认1s
+	MaxBuffered   int    `json:"max_buffered,omitempty"`   // 缓冲上限，超出后丢弃新数据点，默认100000
+	MaxRetries    int    `json:"max_retries,omitempty"`    // 单批最大重试次数，默认3
+}
+
+// JobOutputs 任务级的k6指标输出
+type JobOutputs struct {
+	InfluxDB *InfluxDBOutput `json:"influxdb,omitempty"`
+}
+
+// influxStats InfluxDB输出的统计
+type influxStats struct {
+	Written       int64 `json:"written"`
+	Dropped       int64 `json:"dropped"`
+	FailedBatches int64 `json:"failed_batches"`
+}
+
+// influxSink 把k6数据点转换为行协议并批量写入InfluxDB
+type influxSink struct {
+	writeURL   string
+	cfg        InfluxDBOutput
+	tags       map[string]string
+	client     *http.Client
+	interval   time.Duration
+	retryDelay time.Duration
+
+	buffer    chan string
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu    sync.Mutex
+	stats influxStats
+}
+
+// newInfluxSink 校验配置并启动后台写入，tags会附加到每个数据点上
+func newInfluxSink(cfg InfluxDBOutput, tags map[string]string) (*influxSink, error) {
+	writeURL, err := influxWriteURL(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1000
+	}
+	if cfg.MaxBuffered <= 0 {
+		cfg.MaxBuffered = 100000
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 3
+	}
+	interval := time.Second
+	if cfg.FlushInterval != "" {
+		if interval, err = time.ParseDuration(cfg.FlushInterval); err != nil || interval <= 0 {
+			return nil, fmt.Errorf("无效的flush_interval: %s", cfg.FlushInterval)
+		}
+	}
+
+	s := &influxSink{
+		writeURL:   writeURL,
+		cfg:        cfg,
+		tags:       tags,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		interval:   interval,
+		retryDelay: 500 * time.Millisecond,
+		buffer:     make(chan string, cfg.MaxBuffered),
+		done:       make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// influxWriteURL 根据版本拼出写入地址
+func influxWriteURL(cfg InfluxDBOutput) (string, error) {
+	base, err := url.Parse(strings.TrimRight(cfg.URL, "/"))
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return "", fmt.Errorf("无效的InfluxDB地址: %q", cfg.URL)
+	}
+
+	query := url.Values{}
+	query.Set("precision", "ns")
+	switch cfg.Version {
+	case 0, 1:
+		if cfg.Database == "" {
+			return "", fmt.Errorf("InfluxDB v1输出缺少database")
+		}
+		base.Path += "/write"
+		query.Set("db", cfg.Database)
+		if cfg.RetentionPolicy != "" {
+			query.Set("rp", cfg.RetentionPolicy)
+		}
+	case 2:
+		if cfg.Org == "" || cfg.Bucket == "" {
+			return "", fmt.Errorf("InfluxDB v2输出缺少org或bucket")
+		}
+		base.Path += "/api/v2/write"
+		query.Set("org", cfg.Org)
+		query.Set("bucket", cfg.Bucket)
+	default:
+		return "", fmt.Errorf("不支持的InfluxDB版本: %d", cfg.Version)
+	}
+	base.RawQuery = query.Encode()
+	return base.String(), nil
+}
+
+// addSample 转换为行协议放入缓冲，缓冲已满时丢弃
+func (s *influxSink) addSample(sample *k6Sample) {
+	line := influxLine(sample, s.tags)
+	select {
+	case s.buffer <- line:
+	default:
+		s.mu.Lock()
+		s.stats.Dropped++
+		s.mu.Unlock()
+	}
+}
+
+// close 写完缓冲中的数据后停止，可重复调用
+func (s *influxSink) close() {
+	s.closeOnce.Do(func() {
+		close(s.buffer)
+		<-s.done
+
+		stats := s.snapshot()
+		logrus.Infof("InfluxDB输出结束: 写入 %d 点, 丢弃 %d 点, 失败批次 %d", stats.Written, stats.Dropped, stats.FailedBatches)
+	})
+}
+
+func (s *influxSink) snapshot() influxStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// run 按批大小或时间间隔攒批写入
+func (s *influxSink) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	batch := make([]string, 0, s.cfg.BatchSize)
+	for {
+		select {
+		case line, ok := <-s.buffer:
+			if !ok {
+				s.flush(batch)
+				return
+			}
+			batch = append(batch, line)
+			if len(batch) >= s.cfg.BatchSize {
+				s.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush 写入一批数据，网络错误、429和5xx按指数退避重试，重试耗尽后丢弃该批
+func (s *influxSink) flush(batch []string) {
+	if len(batch) == 0 {
+		return
+	}
+	body := strings.Join(batch, "\n")
+
+	delay := s.retryDelay
+	for attempt := 0; ; attempt++ {
+		retryable, err := s.write(body)
+		if err == nil {
+			s.mu.Lock()
+			s.stats.Written += int64(len(batch))
+			s.mu.Unlock()
+			return
+		}
+		if !retryable || attempt >= s.cfg.MaxRetries {
+			logrus.Warnf("写入InfluxDB失败，丢弃 %d 个数据点: %v", len(batch), err)
+			s.mu.Lock()
+			s.stats.Dropped += int64(len(batch))
+			s.stats.FailedBatches++
+			s.mu.Unlock()
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// write 发送一次写入请求，返回错误是否可重试
+func (s *influxSink) write(body string) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.writeURL, bytes.NewBufferString(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.cfg.Version == 2 {
+		req.Header.Set("Authorization", "Token "+s.cfg.Token)
+	} else if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, fmt.Errorf("状态码: %d, 响应: %s", resp.StatusCode, string(respBody))
+}
+
+// influxLine 生成一行行协议：measurement为指标名，value字段，纳秒时间戳
+func influxLine(sample *k6Sample, extra map[string]string) string {
+	tags := make(map[string]string, len(sample.Tags)+len(extra))
+	for k, v := range sample.Tags {
+		tags[k] = v
+	}
+	// Agent附加的标签优先，保证agent_id和task_id不被脚本标签覆盖
+	for k, v := range extra {
+		tags[k] = v
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k != "" && v != "" { // 行协议不允许空标签值
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(influxEscape(sample.Metric, ", "))
+	for _, k := range keys {
+		b.WriteByte(',')
+		b.WriteString(influxEscape(k, ",= "))
+		b.WriteByte('=')
+		b.WriteString(influxEscape(tags[k], ",= "))
+	}
+	b.WriteString(" value=")
+	b.WriteString(strconv.FormatFloat(sample.Value, 'f', -1, 64))
+	if !sample.Time.IsZero() {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(sample.Time.UnixNano(), 10))
+	}
+	return b.String()
+}
+
+// influxEscape 按行协议规则转义特殊字符
+func influxEscape(s, special string) string {
+	if !strings.ContainsAny(s, special+"\\\n") {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\\' || strings.ContainsRune(special, r):
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// jobOutputTags 外部输出附加到每个数据点上的标签
+func (a *Agent) jobOutputTags(job *Job) map[string]string {
+	tags := make(map[string]string, len(job.Tags)+2)
+	for k, v := range job.Tags {
+		tags[k] = v
+	}
+	a.infoMu.RLock()
+	tags["agent_id"] = a.info.AgentID
+	a.infoMu.RUnlock()
+	tags["task_id"] = job.ID
+	if id := job.segmentID(); id != "" {
+		tags["segment"] = id
+	}
+	return tags
+}
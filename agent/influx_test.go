@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lineProtocolReceiver 模拟InfluxDB写入接口，记录收到的行
+type lineProtocolReceiver struct {
+	mu       sync.Mutex
+	lines    []string
+	requests []*http.Request
+	failures int // 前几次请求返回503
+}
+
+func (r *lineProtocolReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	r.lines = append(r.lines, strings.Split(string(body), "\n")...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestInfluxLine(t *testing.T) {
+	sample := &k6Sample{
+		Metric: "http_req_duration",
+		Time:   time.Unix(1700000000, 5),
+		Value:  12.5,
+		Tags:   map[string]string{"name": "GET /a b", "status": "200", "empty": "", "task_id": "spoofed"},
+	}
+	line := influxLine(sample, map[string]string{"agent_id": "agent-1", "task_id": "task,1"})
+	assert.Equal(t, `http_req_duration,agent_id=agent-1,name=GET\ /a\ b,status=200,task_id=task\,1 value=12.5 1700000000000000005`, line)
+}
+
+func TestInfluxWriteURL(t *testing.T) {
+	u, err := influxWriteURL(InfluxDBOutput{URL: "http://influx:8086/", Database: "k6", RetentionPolicy: "week"})
+	require.NoError(t, err)
+	assert.Equal(t, "http://influx:8086/write?db=k6&precision=ns&rp=week", u)
+
+	u, err = influxWriteURL(InfluxDBOutput{URL: "https://influx", Version: 2, Org: "perf", Bucket: "k6"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://influx/api/v2/write?bucket=k6&org=perf&precision=ns", u)
+
+	_, err = influxWriteURL(InfluxDBOutput{URL: "http://influx:8086"})
+	assert.Error(t, err, "v1缺少database")
+	_, err = influxWriteURL(InfluxDBOutput{URL: "influx:8086", Database: "k6"})
+	assert.Error(t, err, "缺少scheme")
+	_, err = influxWriteURL(InfluxDBOutput{URL: "http://influx", Version: 3})
+	assert.Error(t, err)
+}
+
+func TestInfluxSinkV1BatchesAndRetries(t *testing.T) {
+	receiver := &lineProtocolReceiver{failures: 1}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	sink, err := newInfluxSink(InfluxDBOutput{
+		URL: server.URL, Database: "k6", Username: "u", Password: "p",
+		BatchSize: 2, FlushInterval: "1h",
+	}, map[string]string{"task_id": "task-1"})
+	require.NoError(t, err)
+	sink.retryDelay = time.Millisecond
+
+	for i := 0; i < 5; i++ {
+		sink.addSample(&k6Sample{Metric: "vus", Value: float64(i), Time: time.Unix(1, 0)})
+	}
+	sink.close()
+	sink.close()
+
+	stats := sink.snapshot()
+	assert.Equal(t, int64(5), stats.Written)
+	assert.Equal(t, int64(0), stats.Dropped)
+	assert.Len(t, receiver.lines, 5)
+	assert.Equal(t, "vus,task_id=task-1 value=0 1000000000", receiver.lines[0])
+
+	req := receiver.requests[0]
+	assert.Equal(t, "/write", req.URL.Path)
+	assert.Equal(t, "k6", req.URL.Query().Get("db"))
+	user, pass, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "u", user)
+	assert.Equal(t, "p", pass)
+}
+
+func TestInfluxSinkV2TokenAndDropPolicy(t *testing.T) {
+	receiver := &lineProtocolReceiver{failures: 100}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	sink, err := newInfluxSink(InfluxDBOutput{
+		URL: server.URL, Version: 2, Org: "perf", Bucket: "k6", Token: "secret",
+		BatchSize: 100, MaxRetries: 1, MaxBuffered: 3, FlushInterval: "1h",
+	}, nil)
+	require.NoError(t, err)
+	sink.retryDelay = time.Millisecond
+
+	// 后台协程可能已取走部分数据，缓冲至多保留3个，其余直接丢弃
+	for i := 0; i < 20; i++ {
+		sink.addSample(&k6Sample{Metric: "iterations", Value: 1})
+	}
+	sink.close()
+
+	stats := sink.snapshot()
+	assert.Equal(t, int64(0), stats.Written)
+	assert.Equal(t, int64(20), stats.Dropped, "缓冲溢出和写入失败的数据点都计为丢弃")
+	assert.Equal(t, int64(1), stats.FailedBatches)
+
+	req := receiver.requests[0]
+	assert.Equal(t, "/api/v2/write", req.URL.Path)
+	assert.Equal(t, "Token secret", req.Header.Get("Authorization"))
+	assert.Len(t, receiver.requests, 2, "首次失败后重试1次")
+}
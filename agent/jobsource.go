@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/spf13/viper"
+)
+
+// JobSource 任务来源。取到的任务带有租约时，执行前Ack，运行期间ExtendLease，
+// 无法执行时Nack，结果回传后Complete；没有租约的任务同样检查能否执行，但不确认也不释放
+type JobSource interface {
+	// Name 来源名称，用于日志和指标
+	Name() string
+	// Fetch 取一个待执行的任务，没有任务时返回nil
+	Fetch(ctx context.Context) (*Job, error)
+	// Ack 确认开始执行，失败时任务不应执行
+	Ack(jobID string, lease *JobLease) error
+	// Nack 放弃任务并说明原因，任务可以分配给其他Agent
+	Nack(jobID string, lease *JobLease, reason, message string) error
+	// ExtendLease 任务运行期间延长租约，租约已失效时返回errLeaseLost
+	ExtendLease(jobID string, lease *JobLease) error
+	// Complete 任务结果已回传，租约结束
+	Complete(jobID string, lease *JobLease) error
+}
+
+// newJobSource 按job_source.type创建任务来源，默认轮询后端
+func newJobSource(a *Agent) (JobSource, error) {
+	switch t := viper.GetString("job_source.type"); t {
+	case "", "http":
+		return a.httpSource, nil
+	case "nats":
+		cfg, err := natsSourceConfigFromViper(a.info.Tags)
+		if err != nil {
+			return nil, err
+		}
+		return newNATSJobSource(cfg), nil
+	default:
+		return nil, fmt.Errorf("不支持的任务来源: %q", t)
+	}
+}
+
+// pollsBackend 是否通过轮询后端获取任务
+func (a *Agent) pollsBackend() bool {
+	return a.source == JobSource(a.httpSource)
+}
+
+// sourceOf 租约所属的任务来源，控制通道推送的任务使用后端HTTP接口
+func (a *Agent) sourceOf(lease *JobLease) JobSource {
+	if lease.source != nil {
+		return lease.source
+	}
+	return a.httpSource
+}
+
+// httpJobSource 轮询后端HTTP接口获取任务，租约通过ack、renew和release接口维护
+type httpJobSource struct {
+	agent *Agent
+}
+
+func (s *httpJobSource) Name() string {
+	return jobSourcePoll
+}
+
+func (s *httpJobSource) Fetch(ctx context.Context) (*Job, error) {
+	a := s.agent
+	if !a.registered {
+		return nil, nil // 未注册时不轮询
+	}
+
+	a.infoMu.RLock()
+	agentID := a.info.AgentID
+	a.infoMu.RUnlock()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/v1/agents/jobs/poll?agent_id=%s", a.serverURL, agentID), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("发送轮询请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// 接受200和201状态码作为成功响应
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("轮询失败，状态码: %d, 响应: %s", resp.StatusCode, string(body))
+	}
+
+	var pollResp JobPollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pollResp); err != nil {
+		return nil, fmt.Errorf("解析轮询响应失败: %v", err)
+	}
+	return pollResp.Job, nil
+}
+
+func (s *httpJobSource) Ack(jobID string, lease *JobLease) error {
+	return s.agent.leaseCall("ack", jobID, lease, "", "")
+}
+
+func (s *httpJobSource) Nack(jobID string, lease *JobLease, reason, message string) error {
+	return s.agent.leaseCall("release", jobID, lease, reason, message)
+}
+
+func (s *httpJobSource) ExtendLease(jobID string, lease *JobLease) error {
+	return s.agent.leaseCall("renew", jobID, lease, "", "")
+}
+
+// Complete 结果回传即结束租约，不需要额外请求
+func (s *httpJobSource) Complete(jobID string, lease *JobLease) error {
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// 每个k6任务通过--address开启独立的REST API，Agent代理暂停、恢复和调整VU数。
+// 不指定时所有k6进程都监听localhost:6565，并发任务会互相冲突。
+
+// k6控制动作，同时作为上报后端的事件名
+const (
+	controlPaused  = "paused"
+	controlResumed = "resumed"
+	controlScaled  = "scaled"
+)
+
+// k6APIClient 访问本机k6 REST API的客户端
+var k6APIClient = &http.Client{Timeout: 5 * time.Second}
+
+// k6Addresses 已分配给任务的k6 REST API地址。探测端口的监听关闭后到k6真正监听之前，
+// 系统可能把同一端口再分给并发启动的任务，因此在任务结束前不重复分配
+var k6Addresses = struct {
+	sync.Mutex
+	used map[string]bool
+}{used: make(map[string]bool)}
+
+// allocK6Address 为k6 REST API分配一个本机空闲端口，任务结束后由releaseK6Address归还
+func allocK6Address() (string, error) {
+	host := viper.GetString("k6.rest_api.host")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	k6Addresses.Lock()
+	defer k6Addresses.Unlock()
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return "", err
+		}
+		address := l.Addr().String()
+		l.Close()
+		if !k6Addresses.used[address] {
+			k6Addresses.used[address] = true
+			return address, nil
+		}
+	}
+	return "", fmt.Errorf("没有可用的端口")
+}
+
+// releaseK6Address 归还任务的k6 REST API地址
+func releaseK6Address(address string) {
+	if address == "" {
+		return
+	}
+	k6Addresses.Lock()
+	delete(k6Addresses.used, address)
+	k6Addresses.Unlock()
+}
+
+// k6StatusAttributes k6 REST API /v1/status的attributes
+type k6StatusAttributes struct {
+	Status  interface{} `json:"status"` // 不同k6版本为数字或字符串
+	Paused  bool        `json:"paused"`
+	VUs     int64       `json:"vus"`
+	VUsMax  int64       `json:"vus-max"`
+	Stopped bool        `json:"stopped"`
+	Running bool        `json:"running"`
+	Tainted bool        `json:"tainted"`
+}
+
+// K6Status 返回给调用方的k6运行状态
+type K6Status struct {
+	Status  interface{} `json:"status,omitempty"`
+	Paused  bool        `json:"paused"`
+	VUs     int64       `json:"vus"`
+	VUsMax  int64       `json:"vusMax"`
+	Stopped bool        `json:"stopped"`
+	Running bool        `json:"running"`
+	Tainted bool        `json:"tainted"` // 有阈值已经未通过
+}
+
+// JobEventRequest 任务事件上报请求
+type JobEventRequest struct {
+	JobID     string                 `json:"job_id"`
+	AgentID   string                 `json:"agent_id"`
+	Event     string                 `json:"event"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// k6API 请求k6 REST API的/v1/status，attrs为nil时只读取状态
+func k6API(ctx context.Context, address string, attrs map[string]interface{}) (*K6Status, error) {
+	method := http.MethodGet
+	var body io.Reader
+	if attrs != nil {
+		method = http.MethodPatch
+		data, _ := json.Marshal(map[string]interface{}{
+			"data": map[string]interface{}{"type": "status", "id": "default", "attributes": attrs},
+		})
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+address+"/v1/status", body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := k6APIClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// k6以JSON:API格式返回错误
+		var apiErr struct {
+			Errors []struct {
+				Title  string `json:"title"`
+				Detail string `json:"detail"`
+			} `json:"errors"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && len(apiErr.Errors) > 0 {
+			e := apiErr.Errors[0]
+			if e.Detail != "" {
+				return nil, fmt.Errorf("%s: %s", e.Title, e.Detail)
+			}
+			return nil, fmt.Errorf("%s", e.Title)
+		}
+		return nil, fmt.Errorf("状态码: %d, 响应: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	var envelope struct {
+		Data struct {
+			Attributes k6StatusAttributes `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("解析k6状态失败: %v", err)
+	}
+	a := envelope.Data.Attributes
+	return &K6Status{
+		Status:  a.Status,
+		Paused:  a.Paused,
+		VUs:     a.VUs,
+		VUsMax:  a.VUsMax,
+		Stopped: a.Stopped,
+		Running: a.Running,
+		Tainted: a.Tainted,
+	}, nil
+}
+
+// k6Address 在任务锁内读取k6 REST API地址
+func (t *Task) k6Address() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.K6Address
+}
+
+// controllableTask 查找可以实时控制的k6任务，不满足时写入错误响应
+func (a *Agent) controllableTask(c *gin.Context) (*Task, bool) {
+	task, ok := a.lookupTask(c)
+	if !ok {
+		return nil, false
+	}
+	if task.k6Address() == "" {
+		c.JSON(409, gin.H{"error": "任务不支持实时控制，只有开启k6 REST API的k6任务可以控制"})
+		return nil, false
+	}
+	if status := task.snapshot().Status; status != "running" {
+		c.JSON(409, gin.H{"error": "任务未在运行", "status": status})
+		return nil, false
+	}
+	return task, true
+}
+
+// controlK6 修改k6状态，成功后记录并上报控制事件
+func (a *Agent) controlK6(c *gin.Context, task *Task, event string, attrs map[string]interface{}) {
+	status, err := k6API(c.Request.Context(), task.k6Address(), attrs)
+	if err != nil {
+		c.JSON(502, gin.H{"error": "k6 REST API请求失败: " + err.Error()})
+		return
+	}
+	task.update(func(s *TaskStatus) { s.Paused = status.Paused })
+
+	data := map[string]interface{}{"paused": status.Paused, "vus": status.VUs, "vusMax": status.VUsMax}
+	message := map[string]string{
+		controlPaused:  "k6已暂停",
+		controlResumed: "k6已恢复",
+		controlScaled:  fmt.Sprintf("k6 VU数已调整为 %d", status.VUs),
+	}[event]
+	logrus.Info(task.appendLog("info", "agent", message))
+	task.Events.publish(eventControl, map[string]interface{}{"action": event, "paused": status.Paused, "vus": status.VUs, "vusMax": status.VUsMax})
+	// 上报不阻塞控制请求，事件带有时间戳，后端可据此排序
+	go a.reportJobEvent(task.Status.ID, event, data)
+
+	c.JSON(200, status)
+}
+
+// PauseTask 暂停k6，VU停止执行新的迭代
+func (a *Agent) PauseTask(c *gin.Context) {
+	if task, ok := a.controllableTask(c); ok {
+		a.controlK6(c, task, controlPaused, map[string]interface{}{"paused": true})
+	}
+}
+
+// ResumeTask 恢复暂停的k6
+func (a *Agent) ResumeTask(c *gin.Context) {
+	if task, ok := a.controllableTask(c); ok {
+		a.controlK6(c, task, controlResumed, map[string]interface{}{"paused": false})
+	}
+}
+
+// ScaleTask 调整k6的活跃VU数，不能超过vusMax
+func (a *Agent) ScaleTask(c *gin.Context) {
+	var req struct {
+		VUs *int64 `json:"vus"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.VUs == nil || *req.VUs < 0 {
+		c.JSON(400, gin.H{"error": "无效的请求参数: vus必须是非负整数", "field": "vus"})
+		return
+	}
+	if task, ok := a.controllableTask(c); ok {
+		a.controlK6(c, task, controlScaled, map[string]interface{}{"vus": *req.VUs})
+	}
+}
+
+// GetK6Status 读取k6的实时运行状态
+func (a *Agent) GetK6Status(c *gin.Context) {
+	task, ok := a.controllableTask(c)
+	if !ok {
+		return
+	}
+	status, err := k6API(c.Request.Context(), task.k6Address(), nil)
+	if err != nil {
+		c.JSON(502, gin.H{"error": "k6 REST API请求失败: " + err.Error()})
+		return
+	}
+	c.JSON(200, status)
+}
+
+// reportJobEvent 向后端上报任务事件
+func (a *Agent) reportJobEvent(jobID, event string, data map[string]interface{}) {
+	if a.standalone() {
+		return
+	}
+
+	a.infoMu.RLock()
+	req := JobEventRequest{JobID: jobID, AgentID: a.info.AgentID, Event: event, Data: data, Timestamp: time.Now()}
+	a.infoMu.RUnlock()
+
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		logrus.Errorf("序列化事件上报请求失败: %v", err)
+		return
+	}
+	resp, err := a.httpClient.Post(a.serverURL+"/api/v1/agents/jobs/events", "application/json", bytes.NewBuffer(reqBody))
+	if err != nil {
+		logrus.Errorf("发送事件上报请求失败: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		logrus.Errorf("事件上报失败，状态码: %d, 响应: %s", resp.StatusCode, string(body))
+	}
+}
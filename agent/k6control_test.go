@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeK6API 模拟k6 REST API的/v1/status
+type fakeK6API struct {
+	mu    sync.Mutex
+	attrs map[string]interface{}
+}
+
+func (f *fakeK6API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path != "/v1/status" {
+		w.WriteHeader(404)
+		return
+	}
+	if r.Method == http.MethodPatch {
+		var body struct {
+			Data struct {
+				Attributes map[string]interface{} `json:"attributes"`
+			} `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if vus, ok := body.Data.Attributes["vus"].(float64); ok && vus > f.attrs["vus-max"].(float64) {
+			w.WriteHeader(400)
+			io.WriteString(w, `{"errors":[{"status":"400","title":"can't scale","detail":"vus can't be higher than vus-max"}]}`)
+			return
+		}
+		for k, v := range body.Data.Attributes {
+			f.attrs[k] = v
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": map[string]interface{}{"type": "status", "id": "default", "attributes": f.attrs},
+	})
+}
+
+func TestK6LiveControl(t *testing.T) {
+	k6 := httptest.NewServer(&fakeK6API{attrs: map[string]interface{}{"paused": false, "vus": 2.0, "vus-max": 10.0, "running": true}})
+	defer k6.Close()
+
+	events := make(chan JobEventRequest, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/agents/jobs/events" {
+			var req JobEventRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			events <- req
+		}
+	}))
+	defer backend.Close()
+
+	agent := setupTestAgent()
+	agent.serverURL = backend.URL
+	task := newTestTask(t, agent, &Job{ID: "control-task", Type: "k6"})
+	task.K6Address = strings.TrimPrefix(k6.URL, "http://")
+	task.setStatus("running")
+	idle := newTestTask(t, agent, &Job{ID: "idle-task", Type: "shell"})
+	idle.setStatus("running")
+
+	router := gin.New()
+	router.POST("/tasks/:taskId/pause", agent.PauseTask)
+	router.POST("/tasks/:taskId/resume", agent.ResumeTask)
+	router.POST("/tasks/:taskId/scale", agent.ScaleTask)
+	router.GET("/tasks/:taskId/k6-status", agent.GetK6Status)
+	do := func(method, path, body string) (int, K6Status, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		var status K6Status
+		json.Unmarshal(w.Body.Bytes(), &status)
+		return w.Code, status, w.Body.String()
+	}
+
+	code, status, _ := do("POST", "/tasks/control-task/pause", "")
+	require.Equal(t, 200, code)
+	assert.True(t, status.Paused)
+	assert.True(t, task.Status.Paused)
+	event := <-events
+	assert.Equal(t, "control-task", event.JobID)
+	assert.Equal(t, controlPaused, event.Event)
+
+	code, status, _ = do("POST", "/tasks/control-task/scale", `{"vus": 8}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, int64(8), status.VUs)
+	event = <-events
+	assert.Equal(t, controlScaled, event.Event)
+	assert.Equal(t, 8.0, event.Data["vus"])
+
+	// k6拒绝的请求返回502并带上k6的错误信息
+	code, _, body := do("POST", "/tasks/control-task/scale", `{"vus": 20}`)
+	assert.Equal(t, 502, code)
+	assert.Contains(t, body, "vus can't be higher than vus-max")
+	code, _, _ = do("POST", "/tasks/control-task/scale", `{"vus": -1}`)
+	assert.Equal(t, 400, code)
+
+	code, status, _ = do("POST", "/tasks/control-task/resume", "")
+	require.Equal(t, 200, code)
+	assert.False(t, status.Paused)
+	assert.Equal(t, controlResumed, (<-events).Event)
+
+	code, status, _ = do("GET", "/tasks/control-task/k6-status", "")
+	require.Equal(t, 200, code)
+	assert.Equal(t, K6Status{VUs: 8, VUsMax: 10, Running: true}, status)
+	assert.Contains(t, strings.Join(task.logLines(), "\n"), "k6 VU数已调整为 8")
+
+	// 不能控制的任务
+	code, _, _ = do("POST", "/tasks/idle-task/pause", "")
+	assert.Equal(t, 409, code)
+	code, _, _ = do("GET", "/tasks/missing/k6-status", "")
+	assert.Equal(t, 404, code)
+	task.setStatus("completed")
+	code, _, _ = do("POST", "/tasks/control-task/pause", "")
+	assert.Equal(t, 409, code)
+	assert.Empty(t, events)
+}
+
+func TestK6CommandGetsPrivateAddress(t *testing.T) {
+	viper.Set("k6.rest_api.enabled", true)
+	defer viper.Set("k6.rest_api.enabled", false)
+
+	agent := setupTestAgent()
+	first := newTestTask(t, agent, &Job{ID: "addr-1", Type: "k6"})
+	second := newTestTask(t, agent, &Job{ID: "addr-2", Type: "k6"})
+	dir := t.TempDir()
+	for _, task := range []*Task{first, second} {
+		cmd, err := NewExecutor().buildK6Command(task, dir+"/script.js", ExecuteRequest{})
+		require.NoError(t, err)
+		assert.Contains(t, strings.Join(cmd.Args, " "), "--address "+task.K6Address)
+		assert.True(t, strings.HasPrefix(task.K6Address, "127.0.0.1:"))
+	}
+	assert.NotEqual(t, first.K6Address, second.K6Address)
+
+	// 任务结束前地址保持占用，不会分给其他任务
+	k6Addresses.Lock()
+	assert.True(t, k6Addresses.used[first.K6Address])
+	k6Addresses.Unlock()
+	for _, task := range []*Task{first, second} {
+		releaseK6Address(task.K6Address)
+	}
+	k6Addresses.Lock()
+	assert.False(t, k6Addresses.used[first.K6Address])
+	assert.False(t, k6Addresses.used[second.K6Address])
+	k6Addresses.Unlock()
+}
+
+func TestK6AddressReadDuringBuild(t *testing.T) {
+	viper.Set("k6.rest_api.enabled", true)
+	defer viper.Set("k6.rest_api.enabled", false)
+
+	// 控制接口与任务goroutine分配地址并发进行，-race下不应有数据竞争
+	agent := setupTestAgent()
+	task := newTestTask(t, agent, &Job{ID: "addr-race", Type: "k6"})
+	task.setStatus("running")
+	router := gin.New()
+	router.GET("/tasks/:taskId/k6-status", agent.GetK6Status)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := NewExecutor().buildK6Command(task, t.TempDir()+"/script.js", ExecuteRequest{})
+		assert.NoError(t, err)
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/tasks/addr-race/k6-status", nil))
+	}
+	assert.NotEmpty(t, task.k6Address())
+	releaseK6Address(task.k6Address())
+}
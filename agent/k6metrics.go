@@ -0,0 +1,381 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// k6RateWindow 计算滚动速率的时间窗口（秒）
+const k6RateWindow = 10
+
+// k6LatencyBuckets http_req_duration直方图的桶边界（秒）
+var k6LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// rateSlot 滚动窗口中一秒内的计数
+type rateSlot struct {
+	second     int64
+	requests   float64
+	failed     float64
+	checks     float64
+	checksPass float64
+}
+
+// k6LiveStats 单个任务运行中的k6滚动聚合
+type k6LiveStats struct {
+	labels []string
+
+	mu           sync.Mutex
+	requests     float64
+	failed       float64
+	checks       float64
+	checksPass   float64
+	iterations   float64
+	dataSent     float64
+	dataReceived float64
+	vus          float64
+	vusMax       float64
+	latencyCount uint64
+	latencySum   float64
+	latencyHist  []uint64
+	window       [k6RateWindow]rateSlot
+	firstSample  time.Time // 第一个和最后一个数据点的时间，用于计算整次运行的速率
+	lastSample   time.Time
+	finishedAt   time.Time
+	now          func() time.Time
+}
+
+func newK6LiveStats(labels []string) *k6LiveStats {
+	return &k6LiveStats{
+		labels:      labels,
+		latencyHist: make([]uint64, len(k6LatencyBuckets)),
+		now:         time.Now,
+	}
+}
+
+// slot 返回当前秒对应的窗口槽位，过期槽位先清零
+func (s *k6LiveStats) slot() *rateSlot {
+	sec := s.now().Unix()
+	slot := &s.window[sec%k6RateWindow]
+	if slot.second != sec {
+		*slot = rateSlot{second: sec}
+	}
+	return slot
+}
+
+// addSample 累加一个k6数据点
+func (s *k6LiveStats) addSample(sample *k6Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	at := sample.Time
+	if at.IsZero() {
+		at = s.now()
+	}
+	if s.firstSample.IsZero() || at.Before(s.firstSample) {
+		s.firstSample = at
+	}
+	if at.After(s.lastSample) {
+		s.lastSample = at
+	}
+
+	switch sample.Metric {
+	case "http_reqs":
+		s.requests += sample.Value
+		s.slot().requests += sample.Value
+	case "http_req_failed":
+		// rate类型，1表示失败
+		if sample.Value != 0 {
+			s.failed++
+			s.slot().failed++
+		}
+	case "http_req_duration":
+		seconds := sample.Value / 1000
+		s.latencyCount++
+		s.latencySum += seconds
+		for i, bound := range k6LatencyBuckets {
+			if seconds <= bound {
+				s.latencyHist[i]++
+			}
+		}
+	case "checks":
+		slot := s.slot()
+		s.checks++
+		slot.checks++
+		if sample.Value != 0 {
+			s.checksPass++
+			slot.checksPass++
+		}
+	case "iterations":
+		s.iterations += sample.Value
+	case "data_sent":
+		s.dataSent += sample.Value
+	case "data_received":
+		s.dataReceived += sample.Value
+	case "vus":
+		s.vus = sample.Value
+	case "vus_max":
+		s.vusMax = sample.Value
+	}
+}
+
+// k6LiveSnapshot 滚动聚合的快照
+type k6LiveSnapshot struct {
+	Requests      float64 `json:"http_reqs"`
+	Failed        float64 `json:"http_req_failed"`
+	RequestRate   float64 `json:"request_rate"`
+	ErrorRate     float64 `json:"error_rate"`
+	CheckPassRate float64 `json:"check_pass_rate"`
+	Iterations    float64 `json:"iterations"`
+	DataSent      float64 `json:"data_sent"`
+	DataReceived  float64 `json:"data_received"`
+	VUs           float64 `json:"vus"`
+	VUsMax        float64 `json:"vus_max"`
+	AvgLatencyMs  float64 `json:"http_req_duration_avg_ms"`
+
+	latencyCount uint64
+	latencySum   float64
+	latencyHist  map[float64]uint64
+}
+
+// snapshot 计算当前的滚动速率和累计值，速率只反映最近k6RateWindow秒，用于实时展示和Prometheus
+func (s *k6LiveStats) snapshot() k6LiveSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := s.totalsLocked()
+
+	// 只统计最近k6RateWindow秒内（不含当前未满的一秒）的槽位
+	now := s.now().Unix()
+	var requests, failed, checks, checksPass float64
+	for _, slot := range s.window {
+		if slot.second < now && slot.second >= now-k6RateWindow {
+			requests += slot.requests
+			failed += slot.failed
+			checks += slot.checks
+			checksPass += slot.checksPass
+		}
+	}
+	snap.RequestRate = requests / k6RateWindow
+	if requests > 0 {
+		snap.ErrorRate = failed / requests
+	}
+	if checks > 0 {
+		snap.CheckPassRate = checksPass / checks
+	}
+	return snap
+}
+
+// summary 整次运行的累计值，速率按第一个到最后一个数据点的时长计算，作为任务的最终结果
+func (s *k6LiveStats) summary() k6LiveSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := s.totalsLocked()
+	if elapsed := s.lastSample.Sub(s.firstSample).Seconds(); elapsed > 0 {
+		snap.RequestRate = s.requests / elapsed
+	}
+	if s.requests > 0 {
+		snap.ErrorRate = s.failed / s.requests
+	}
+	if s.checks > 0 {
+		snap.CheckPassRate = s.checksPass / s.checks
+	}
+	return snap
+}
+
+// totalsLocked 累计值部分，调用方持有s.mu
+func (s *k6LiveStats) totalsLocked() k6LiveSnapshot {
+	snap := k6LiveSnapshot{
+		Requests:     s.requests,
+		Failed:       s.failed,
+		Iterations:   s.iterations,
+		DataSent:     s.dataSent,
+		DataReceived: s.dataReceived,
+		VUs:          s.vus,
+		VUsMax:       s.vusMax,
+		latencyCount: s.latencyCount,
+		latencySum:   s.latencySum,
+		latencyHist:  make(map[float64]uint64, len(k6LatencyBuckets)),
+	}
+	for i, bound := range k6LatencyBuckets {
+		snap.latencyHist[bound] = s.latencyHist[i]
+	}
+	if s.latencyCount > 0 {
+		snap.AvgLatencyMs = s.latencySum / float64(s.latencyCount) * 1000
+	}
+	return snap
+}
+
+// k6MetricsCollector 把运行中任务的k6聚合导出为Prometheus指标
+type k6MetricsCollector struct {
+	tagKeys   []string
+	retention time.Duration
+
+	mu    sync.Mutex
+	tasks map[string]*k6LiveStats
+
+	requests      *prometheus.Desc
+	failed        *prometheus.Desc
+	requestRate   *prometheus.Desc
+	errorRate     *prometheus.Desc
+	checkPassRate *prometheus.Desc
+	iterations    *prometheus.Desc
+	dataSent      *prometheus.Desc
+	dataReceived  *prometheus.Desc
+	vus           *prometheus.Desc
+	vusMax        *prometheus.Desc
+	latency       *prometheus.Desc
+}
+
+// newK6MetricsCollector 创建k6实时指标收集器，tagKeys中的任务标签会成为tag_<key>标签
+func newK6MetricsCollector(tagKeys []string, retention time.Duration) *k6MetricsCollector {
+	labels := []string{"task_id", "script_id"}
+	for _, key := range tagKeys {
+		labels = append(labels, "tag_"+sanitizeLabelName(key))
+	}
+
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "k6", name), help, labels, nil)
+	}
+
+	return &k6MetricsCollector{
+		tagKeys:       tagKeys,
+		retention:     retention,
+		tasks:         make(map[string]*k6LiveStats),
+		requests:      desc("http_reqs_total", "k6发出的HTTP请求总数"),
+		failed:        desc("http_req_failed_total", "k6失败的HTTP请求总数"),
+		requestRate:   desc("request_rate", "最近10秒的每秒请求数"),
+		errorRate:     desc("error_rate", "最近10秒的请求失败比例"),
+		checkPassRate: desc("check_pass_rate", "最近10秒的check通过比例"),
+		iterations:    desc("iterations_total", "k6完成的迭代总数"),
+		dataSent:      desc("data_sent_bytes_total", "k6发送的字节数"),
+		dataReceived:  desc("data_received_bytes_total", "k6接收的字节数"),
+		vus:           desc("vus", "当前活跃的VU数"),
+		vusMax:        desc("vus_max", "预分配的最大VU数"),
+		latency:       desc("http_req_duration_seconds", "k6 HTTP请求耗时分布"),
+	}
+}
+
+// track 开始跟踪一个任务，返回作为k6数据sink的聚合对象
+func (c *k6MetricsCollector) track(job *Job) *k6LiveStats {
+	labels := []string{job.ID, job.ScriptID}
+	for _, key := range c.tagKeys {
+		labels = append(labels, job.Tags[key])
+	}
+	stats := newK6LiveStats(labels)
+
+	c.mu.Lock()
+	c.pruneLocked()
+	c.tasks[job.ID] = stats
+	c.mu.Unlock()
+	return stats
+}
+
+// release 任务结束后保留一段时间供最后一次抓取，随后移除。
+// 移除不依赖抓取，未开启指标接口或没有抓取方时也不会累积
+func (c *k6MetricsCollector) release(taskID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats, ok := c.tasks[taskID]
+	if !ok {
+		return
+	}
+	stats.mu.Lock()
+	stats.finishedAt = stats.now()
+	stats.mu.Unlock()
+
+	time.AfterFunc(c.retention, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// 同ID的任务可能已重新跟踪
+		if c.tasks[taskID] == stats {
+			delete(c.tasks, taskID)
+		}
+	})
+}
+
+// pruneLocked 清理已过保留期的任务，调用方持有c.mu
+func (c *k6MetricsCollector) pruneLocked() {
+	for id, stats := range c.tasks {
+		stats.mu.Lock()
+		expired := !stats.finishedAt.IsZero() && stats.now().Sub(stats.finishedAt) > c.retention
+		stats.mu.Unlock()
+		if expired {
+			delete(c.tasks, id)
+		}
+	}
+}
+
+// Describe 实现prometheus.Collector
+func (c *k6MetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		c.requests, c.failed, c.requestRate, c.errorRate, c.checkPassRate,
+		c.iterations, c.dataSent, c.dataReceived, c.vus, c.vusMax, c.latency,
+	} {
+		ch <- d
+	}
+}
+
+// Collect 实现prometheus.Collector，同时清理已过保留期的任务
+func (c *k6MetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	c.pruneLocked()
+	tasks := make([]*k6LiveStats, 0, len(c.tasks))
+	for _, stats := range c.tasks {
+		tasks = append(tasks, stats)
+	}
+	c.mu.Unlock()
+
+	for _, stats := range tasks {
+		snap := stats.snapshot()
+		l := stats.labels
+		ch <- prometheus.MustNewConstMetric(c.requests, prometheus.CounterValue, snap.Requests, l...)
+		ch <- prometheus.MustNewConstMetric(c.failed, prometheus.CounterValue, snap.Failed, l...)
+		ch <- prometheus.MustNewConstMetric(c.requestRate, prometheus.GaugeValue, snap.RequestRate, l...)
+		ch <- prometheus.MustNewConstMetric(c.errorRate, prometheus.GaugeValue, snap.ErrorRate, l...)
+		ch <- prometheus.MustNewConstMetric(c.checkPassRate, prometheus.GaugeValue, snap.CheckPassRate, l...)
+		ch <- prometheus.MustNewConstMetric(c.iterations, prometheus.CounterValue, snap.Iterations, l...)
+		ch <- prometheus.MustNewConstMetric(c.dataSent, prometheus.CounterValue, snap.DataSent, l...)
+		ch <- prometheus.MustNewConstMetric(c.dataReceived, prometheus.CounterValue, snap.DataReceived, l...)
+		ch <- prometheus.MustNewConstMetric(c.vus, prometheus.GaugeValue, snap.VUs, l...)
+		ch <- prometheus.MustNewConstMetric(c.vusMax, prometheus.GaugeValue, snap.VUsMax, l...)
+		ch <- prometheus.MustNewConstHistogram(c.latency, snap.latencyCount, snap.latencySum, snap.latencyHist, l...)
+	}
+}
+
+// k6MetricTagKeys 读取需要作为Prometheus标签导出的任务标签键
+func k6MetricTagKeys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, key := range viper.GetStringSlice("monitoring.k6_metric_tag_labels") {
+		// 归一化后重名的标签只保留一个
+		if name := sanitizeLabelName(key); !seen[name] {
+			seen[name] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sanitizeLabelName 把任意字符串转换为合法的Prometheus标签名
+func sanitizeLabelName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9' && i > 0:
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
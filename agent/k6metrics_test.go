@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestK6LiveStatsRollingRates(t *testing.T) {
+	current := time.Unix(1700000000, 0)
+	stats := newK6LiveStats(nil)
+	stats.now = func() time.Time { return current }
+
+	for i := 0; i < 20; i++ {
+		stats.addSample(&k6Sample{Metric: "http_reqs", Value: 1})
+		stats.addSample(&k6Sample{Metric: "http_req_failed", Value: float64(i % 4 / 3)})
+		stats.addSample(&k6Sample{Metric: "http_req_duration", Value: 80})
+		stats.addSample(&k6Sample{Metric: "checks", Value: float64(i % 2)})
+	}
+	stats.addSample(&k6Sample{Metric: "vus", Value: 25})
+
+	// 当前这一秒尚未结束，不计入速率
+	snap := stats.snapshot()
+	assert.Equal(t, float64(20), snap.Requests)
+	assert.Equal(t, float64(0), snap.RequestRate)
+
+	current = current.Add(time.Second)
+	snap = stats.snapshot()
+	assert.Equal(t, 2.0, snap.RequestRate)
+	assert.Equal(t, 0.25, snap.ErrorRate)
+	assert.Equal(t, 0.5, snap.CheckPassRate)
+	assert.Equal(t, float64(25), snap.VUs)
+	assert.InDelta(t, 80, snap.AvgLatencyMs, 0.001)
+	assert.Equal(t, uint64(20), snap.latencyHist[0.1])
+	assert.Equal(t, uint64(0), snap.latencyHist[0.05])
+
+	// 超出窗口后速率归零，累计值保留
+	current = current.Add(20 * time.Second)
+	snap = stats.snapshot()
+	assert.Equal(t, float64(0), snap.RequestRate)
+	assert.Equal(t, float64(20), snap.Requests)
+}
+
+func TestK6LiveStatsSummary(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	stats := newK6LiveStats(nil)
+	stats.now = func() time.Time { return start.Add(time.Hour) }
+
+	// 前10秒全部失败，后10秒全部成功；最终结果按整次运行计算
+	for i := 0; i < 20; i++ {
+		at := start.Add(time.Duration(i) * time.Second)
+		stats.addSample(&k6Sample{Metric: "http_reqs", Time: at, Value: 5})
+		for j := 0; j < 5; j++ {
+			stats.addSample(&k6Sample{Metric: "http_req_failed", Time: at, Value: float64(1 - i/10)})
+		}
+		stats.addSample(&k6Sample{Metric: "checks", Time: at, Value: float64(i / 10)})
+	}
+
+	summary := stats.summary()
+	assert.Equal(t, float64(100), summary.Requests)
+	assert.InDelta(t, 100.0/19, summary.RequestRate, 0.001)
+	assert.Equal(t, 0.5, summary.ErrorRate)
+	assert.Equal(t, 0.5, summary.CheckPassRate)
+
+	// 滚动窗口早已过期，实时快照的速率为0
+	snap := stats.snapshot()
+	assert.Equal(t, float64(0), snap.RequestRate)
+	assert.Equal(t, float64(100), snap.Requests)
+}
+
+func TestK6MetricsCollector(t *testing.T) {
+	collector := newK6MetricsCollector([]string{"env", "team-name"}, time.Minute)
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(collector))
+
+	stats := collector.track(&Job{ID: "task-1", ScriptID: "script-9", Tags: map[string]string{"env": "staging"}})
+	stats.addSample(&k6Sample{Metric: "http_reqs", Value: 3})
+	stats.addSample(&k6Sample{Metric: "http_req_duration", Value: 250})
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	labels := map[string]string{}
+	for _, family := range families {
+		if family.GetName() == "k6_agent_k6_http_reqs_total" {
+			for _, pair := range family.GetMetric()[0].GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			assert.Equal(t, float64(3), family.GetMetric()[0].GetCounter().GetValue())
+		}
+	}
+	assert.Equal(t, map[string]string{"task_id": "task-1", "script_id": "script-9", "tag_env": "staging", "tag_team_name": ""}, labels)
+
+	// 结束后在保留期内仍导出，过期后移除
+	collector.release("task-1")
+	assert.Equal(t, 11, testutil.CollectAndCount(collector))
+	stats.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	assert.Equal(t, 0, testutil.CollectAndCount(collector))
+
+	// 没有抓取时保留期过后也会移除
+	idle := newK6MetricsCollector(nil, 10*time.Millisecond)
+	idle.track(&Job{ID: "task-2"})
+	idle.release("task-2")
+	require.Eventually(t, func() bool {
+		idle.mu.Lock()
+		defer idle.mu.Unlock()
+		return len(idle.tasks) == 0
+	}, time.Second, 5*time.Millisecond)
+}
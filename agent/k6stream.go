@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// k6Sample k6 JSON输出中的一个数据点
+type k6Sample struct {
+	Metric string
+	Type   string // counter, gauge, rate, trend，来自此前的Metric声明
+	Time   time.Time
+	Value  float64
+	Tags   map[string]string
+}
+
+// k6OutputLine k6 --out json 输出的单行结构
+type k6OutputLine struct {
+	Type   string `json:"type"`
+	Metric string `json:"metric"`
+	Data   struct {
+		Name  string            `json:"name"`
+		Type  string            `json:"type"`
+		Time  time.Time         `json:"time"`
+		Value float64           `json:"value"`
+		Tags  map[string]string `json:"tags"`
+	} `json:"data"`
+}
+
+// k6SampleSink 消费k6数据点的组件，例如实时指标、外部输出
+type k6SampleSink interface {
+	addSample(sample *k6Sample)
+}
+
+// k6SinkCloser 带缓冲的sink在k6退出、数据读完后需要刷新并释放资源
+type k6SinkCloser interface {
+	close()
+}
+
+// k6OutputTailer 跟踪k6写入中的NDJSON结果文件，并把数据点分发给各个sink
+type k6OutputTailer struct {
+	path  string
+	sinks []k6SampleSink
+	types map[string]string
+
+	pollInterval time.Duration
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// newK6OutputTailer 创建结果文件跟踪器
+func newK6OutputTailer(path string, sinks []k6SampleSink) *k6OutputTailer {
+	return &k6OutputTailer{
+		path:         path,
+		sinks:        sinks,
+		types:        make(map[string]string),
+		pollInterval: 200 * time.Millisecond,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// start 开始后台跟踪
+func (t *k6OutputTailer) start() {
+	go t.run()
+}
+
+// finish 通知k6已退出，读完剩余内容并关闭各sink后返回
+func (t *k6OutputTailer) finish() {
+	close(t.stop)
+	<-t.done
+
+	for _, sink := range t.sinks {
+		if closer, ok := sink.(k6SinkCloser); ok {
+			closer.close()
+		}
+	}
+}
+
+func (t *k6OutputTailer) run() {
+	defer close(t.done)
+
+	// k6启动后才会创建结果文件
+	var file *os.File
+	for file == nil {
+		f, err := os.Open(t.path)
+		if err == nil {
+			file = f
+			break
+		}
+		select {
+		case <-t.stop:
+			// 进程已退出，最后再尝试一次
+			if f, err := os.Open(t.path); err == nil {
+				file = f
+				break
+			}
+			return
+		case <-time.After(t.pollInterval):
+		}
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	var partial strings.Builder
+	stopping := false
+
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			partial.WriteString(line)
+		}
+		if err == nil {
+			t.handleLine(partial.String())
+			partial.Reset()
+			continue
+		}
+		if err != io.EOF {
+			logrus.Warnf("读取k6结果文件失败: %v", err)
+			return
+		}
+
+		// 已到文件末尾：k6已退出则处理最后的不完整行后结束
+		if stopping {
+			if partial.Len() > 0 {
+				t.handleLine(partial.String())
+			}
+			return
+		}
+		select {
+		case <-t.stop:
+			stopping = true
+		case <-time.After(t.pollInterval):
+		}
+	}
+}
+
+// handleLine 解析一行输出，Metric行记录指标类型，Point行分发给sink
+func (t *k6OutputTailer) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	var out k6OutputLine
+	if err := json.Unmarshal([]byte(line), &out); err != nil {
+		logrus.Debugf("跳过无法解析的k6输出行: %v", err)
+		return
+	}
+
+	switch out.Type {
+	case "Metric":
+		t.types[out.Metric] = out.Data.Type
+	case "Point":
+		sample := &k6Sample{
+			Metric: out.Metric,
+			Type:   t.types[out.Metric],
+			Time:   out.Data.Time,
+			Value:  out.Data.Value,
+			Tags:   out.Data.Tags,
+		}
+		for _, sink := range t.sinks {
+			sink.addSample(sample)
+		}
+	}
+}
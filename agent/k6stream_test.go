@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink 记录收到的数据点
+type recordingSink struct {
+	mu      sync.Mutex
+	samples []*k6Sample
+}
+
+func (r *recordingSink) addSample(sample *k6Sample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples = append(r.samples, sample)
+}
+
+func (r *recordingSink) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.samples)
+}
+
+const (
+	k6MetricLine = `{"type":"Metric","data":{"name":"http_req_duration","type":"trend","contains":"time"},"metric":"http_req_duration"}` + "\n"
+	k6PointLine  = `{"type":"Point","data":{"time":"2024-01-01T00:00:00Z","value":120.5,"tags":{"method":"GET","status":"200"}},"metric":"http_req_duration"}` + "\n"
+)
+
+func TestK6OutputTailerFollowsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.json")
+	sink := &recordingSink{}
+	tailer := newK6OutputTailer(path, []k6SampleSink{sink})
+	tailer.pollInterval = 5 * time.Millisecond
+	tailer.start()
+
+	// 文件在跟踪开始后才创建，且最后一行分两次写入
+	time.Sleep(20 * time.Millisecond)
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	f.WriteString(k6MetricLine + k6PointLine)
+	assert.Eventually(t, func() bool { return sink.count() == 1 }, time.Second, 5*time.Millisecond)
+
+	f.WriteString(k6PointLine[:40])
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, sink.count(), "不完整的行不应被解析")
+	f.WriteString(k6PointLine[40:] + "not json\n" + k6PointLine[:len(k6PointLine)-1])
+	f.Close()
+
+	tailer.finish()
+	require.Equal(t, 3, sink.count(), "结束时应处理末尾没有换行的最后一行")
+	sample := sink.samples[0]
+	assert.Equal(t, "http_req_duration", sample.Metric)
+	assert.Equal(t, "trend", sample.Type)
+	assert.Equal(t, 120.5, sample.Value)
+	assert.Equal(t, "GET", sample.Tags["method"])
+}
+
+func TestK6OutputTailerMissingFile(t *testing.T) {
+	tailer := newK6OutputTailer(filepath.Join(t.TempDir(), "missing.json"), nil)
+	tailer.pollInterval = 5 * time.Millisecond
+	tailer.start()
+	tailer.finish()
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// 任务租约：后端下发任务时附带租约，Agent确认(ack)后才开始执行，运行期间定期续约(renew)，
+// 无法执行时释放(release)并说明原因。Agent崩溃后租约过期，后端即可把任务重新分配给其他Agent。
+// 租约失效（后端已收回或长时间未能续约）时停止任务，避免同一任务在两个Agent上执行。
+
+// 释放租约的原因
+const (
+	releaseCapacity          = "capacity"           // 并发任务数已满
+	releasePolicy            = "policy"             // 本Agent不允许执行该类型的任务
+	releaseMissingCapability = "missing_capability" // 不支持的任务类型或缺少执行程序
+)
+
+// errLeaseLost 后端已不再认可该租约
+var errLeaseLost = errors.New("租约已失效")
+
+// JobLease 后端随任务下发的租约
+type JobLease struct {
+	ID        string     `json:"id"`
+	TTL       string     `json:"ttl,omitempty"`        // 租约时长，例如"60s"，默认lease.default_ttl
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // 后端时钟下的过期时间
+
+	source JobSource   // 租约所属的任务来源，为nil表示后端HTTP接口
+	handle interface{} // 来源的投递句柄，例如NATS消息
+}
+
+// LeaseRequest 确认、续约和释放租约的请求
+type LeaseRequest struct {
+	JobID     string    `json:"job_id"`
+	AgentID   string    `json:"agent_id"`
+	LeaseID   string    `json:"lease_id"`
+	Reason    string    `json:"reason,omitempty"`  // 仅释放时
+	Message   string    `json:"message,omitempty"` // 仅释放时
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// LeaseStatus 任务租约的当前情况
+type LeaseStatus struct {
+	ID          string     `json:"id"`
+	TTL         string     `json:"ttl"`
+	AckedAt     *time.Time `json:"ackedAt,omitempty"`
+	RenewedAt   *time.Time `json:"renewedAt,omitempty"`
+	Renewals    int        `json:"renewals"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"` // 本地时钟下的保守估计
+	Lost        bool       `json:"lost,omitempty"`
+	LostReason  string     `json:"lostReason,omitempty"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"` // 结果回传后不再续约
+}
+
+// leaseConfig 租约配置
+type leaseConfig struct {
+	DefaultTTL    time.Duration
+	RenewInterval time.Duration // 为0时按TTL的三分之一续约
+}
+
+func leaseConfigFromViper() leaseConfig {
+	cfg := leaseConfig{
+		DefaultTTL:    viper.GetDuration("lease.default_ttl"),
+		RenewInterval: viper.GetDuration("lease.renew_interval"),
+	}
+	if cfg.DefaultTTL <= 0 {
+		cfg.DefaultTTL = time.Minute
+	}
+	return cfg
+}
+
+// ttl 租约时长，无效时使用默认值
+func (l *JobLease) ttl(cfg leaseConfig) time.Duration {
+	if d, err := time.ParseDuration(l.TTL); err == nil && d > 0 {
+		return d
+	}
+	return cfg.DefaultTTL
+}
+
+// taskLease 运行中任务的租约
+type taskLease struct {
+	ttl      time.Duration
+	interval time.Duration
+
+	mu     sync.Mutex
+	lease  *JobLease // 任务重复下发时换成新的租约
+	status *LeaseStatus
+}
+
+func newTaskLease(lease *JobLease, cfg leaseConfig) *taskLease {
+	ttl := lease.ttl(cfg)
+	interval := cfg.RenewInterval
+	if interval <= 0 || interval >= ttl {
+		interval = ttl / 3
+	}
+	return &taskLease{
+		lease:    lease,
+		ttl:      ttl,
+		interval: interval,
+		status:   &LeaseStatus{ID: lease.ID, TTL: ttl.String()},
+	}
+}
+
+// current 当前持有的租约
+func (l *taskLease) current() *JobLease {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lease
+}
+
+// replace 换成重复下发的任务带来的新租约，租约时长和续约间隔保持不变
+func (l *taskLease) replace(lease *JobLease) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lease = lease
+	l.status.ID = lease.ID
+}
+
+// extend 确认或续约成功，sent为请求发出的时间
+func (l *taskLease) extend(sent time.Time, renewal bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	// 从请求发出时算起，不会晚于后端记录的过期时间
+	expires := sent.Add(l.ttl)
+	l.status.ExpiresAt = &expires
+	if renewal {
+		l.status.RenewedAt = &now
+		l.status.Renewals++
+	} else {
+		l.status.AckedAt = &now
+	}
+}
+
+// expired 本地估计的租约是否已过期
+func (l *taskLease) expired() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.status.ExpiresAt != nil && time.Now().After(*l.status.ExpiresAt)
+}
+
+func (l *taskLease) markLost(reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.status.Lost = true
+	l.status.LostReason = reason
+}
+
+func (l *taskLease) lost() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.status.Lost
+}
+
+// snapshot 租约状态的副本
+func (l *taskLease) snapshot() LeaseStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return *l.status
+}
+
+func (l *taskLease) complete() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.status.CompletedAt = &now
+}
+
+// admitJob 检查能否执行任务，不能执行时返回释放原因
+func (a *Agent) admitJob(job *Job) (reason, message string) {
+	binary := ""
+	switch job.Type {
+	case "k6":
+		binary = viper.GetString("k6.binary")
+	case "shell":
+		binary = "/bin/sh"
+		if runtime.GOOS == "windows" {
+			binary = "powershell"
+		}
+	case "python":
+		binary = "python"
+	case "docker":
+		binary = "docker"
+	default:
+		return releaseMissingCapability, fmt.Sprintf("不支持的任务类型: %s", job.Type)
+	}
+
+	if allowed := viper.GetStringSlice("agent.allowed_job_types"); len(allowed) > 0 {
+		permitted := false
+		for _, t := range allowed {
+			permitted = permitted || t == job.Type
+		}
+		if !permitted {
+			return releasePolicy, fmt.Sprintf("本Agent不允许执行 %s 任务", job.Type)
+		}
+	}
+
+	if _, err := exec.LookPath(binary); err != nil {
+		return releaseMissingCapability, fmt.Sprintf("找不到 %s 任务的执行程序 %q", job.Type, binary)
+	}
+
+	if limit := viper.GetInt("k6.max_concurrent_tasks"); limit > 0 {
+		if active, ok := a.takeSlot(job.ID, limit); !ok {
+			return releaseCapacity, fmt.Sprintf("并发任务数已满 (%d/%d)", active, limit)
+		}
+	}
+	return "", ""
+}
+
+// takeSlot 为已占用ID的任务占用一个并发名额。未结束的任务和已占用名额的其他任务一起计数，
+// 与占用在同一次加锁内完成，同时确认的任务不会超过上限
+func (a *Agent) takeSlot(id string, limit int) (active int, ok bool) {
+	a.tasksMu.Lock()
+	defer a.tasksMu.Unlock()
+	for _, task := range a.tasks {
+		if task.snapshot().EndTime == nil {
+			active++
+		}
+	}
+	for other, slot := range a.claiming {
+		if slot && other != id {
+			active++
+		}
+	}
+	if active >= limit {
+		return active, false
+	}
+	if a.claiming == nil {
+		a.claiming = make(map[string]bool)
+	}
+	a.claiming[id] = true
+	return active, true
+}
+
+// claimJob 执行后端下发的任务前检查能否执行并确认租约，返回错误时任务不应执行，调用方释放占用的ID。
+// 没有租约的任务同样检查任务类型和并发数，只是不确认也不释放租约
+func (a *Agent) claimJob(job *Job) error {
+	reason, message := a.admitJob(job)
+	if job.Lease == nil {
+		if reason != "" {
+			return fmt.Errorf("%s: %s", reason, message)
+		}
+		return nil
+	}
+
+	if reason != "" {
+		logrus.Warnf("无法执行任务 %s，释放租约: %s", job.ID, message)
+		if err := a.sourceOf(job.Lease).Nack(job.ID, job.Lease, reason, message); err != nil {
+			logrus.Errorf("释放任务 %s 的租约失败: %v", job.ID, err)
+		} else {
+			a.metrics.leases.WithLabelValues("released").Inc()
+		}
+		return fmt.Errorf("%s: %s", reason, message)
+	}
+
+	// 无法确认时不执行，租约过期后由后端重新分配
+	sent := time.Now()
+	if err := a.sourceOf(job.Lease).Ack(job.ID, job.Lease); err != nil {
+		a.metrics.leases.WithLabelValues("ack_failed").Inc()
+		return fmt.Errorf("确认租约失败: %v", err)
+	}
+	a.metrics.leases.WithLabelValues("acked").Inc()
+	job.leaseAckedAt = sent
+	return nil
+}
+
+// keepLease 任务运行期间持续续约，返回的函数在结果回传后调用以停止续约
+func (a *Agent) keepLease(task *Task, job *Job) func() {
+	if task.Lease == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(task.Lease.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			sent := time.Now()
+			lease := task.Lease.current()
+			err := a.sourceOf(lease).ExtendLease(job.ID, lease)
+			if err == nil {
+				a.metrics.leases.WithLabelValues("renewed").Inc()
+				task.Lease.extend(sent, true)
+				continue
+			}
+			a.metrics.leases.WithLabelValues("renew_failed").Inc()
+			logrus.Warnf("任务 %s 续约失败: %v", job.ID, err)
+
+			// 后端已收回租约，或者一直没能续约直到过期，任务可能已分配给其他Agent
+			if errors.Is(err, errLeaseLost) || task.Lease.expired() {
+				a.loseLease(task, err)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		task.Lease.complete()
+		if !task.Lease.lost() {
+			a.completeLease(job.ID, task.Lease.current())
+		}
+	}
+}
+
+// completeLease 通知任务来源租约结束
+func (a *Agent) completeLease(jobID string, lease *JobLease) {
+	if lease == nil {
+		return
+	}
+	if err := a.sourceOf(lease).Complete(jobID, lease); err != nil {
+		logrus.Errorf("结束任务 %s 的租约失败: %v", jobID, err)
+	}
+}
+
+// loseLease 租约失效后停止任务
+func (a *Agent) loseLease(task *Task, cause error) {
+	reason := "续约超时"
+	if errors.Is(cause, errLeaseLost) {
+		reason = "后端已收回租约"
+	}
+	task.Lease.markLost(reason)
+	a.metrics.leases.WithLabelValues("lost").Inc()
+	logrus.Error(task.appendLog("error", "agent", fmt.Sprintf("任务租约失效(%s)，停止执行", reason)))
+	a.stopTask(task.Status.ID)
+}
+
+// leaseCall 调用后端的租约接口，404、409和410表示租约已失效
+func (a *Agent) leaseCall(action, jobID string, lease *JobLease, reason, message string) error {
+	a.infoMu.RLock()
+	req := LeaseRequest{
+		JobID:     jobID,
+		AgentID:   a.info.AgentID,
+		LeaseID:   lease.ID,
+		Reason:    reason,
+		Message:   message,
+		Timestamp: time.Now(),
+	}
+	a.infoMu.RUnlock()
+
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := a.httpClient.Post(a.serverURL+"/api/v1/agents/jobs/"+action, "application/json", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound, http.StatusConflict, http.StatusGone:
+		return fmt.Errorf("%w，状态码: %d, 响应: %s", errLeaseLost, resp.StatusCode, string(body))
+	default:
+		return fmt.Errorf("状态码: %d, 响应: %s", resp.StatusCode, string(body))
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLeaseBackend 模拟后端的轮询和租约接口
+type fakeLeaseBackend struct {
+	mu       sync.Mutex
+	next     *Job
+	calls    map[string][]LeaseRequest // 按ack、renew、release记录
+	results  []JobResultRequest
+	statuses []JobStatusRequest
+	rejectAt map[string]int // 各接口从第几次调用开始返回410
+}
+
+func (f *fakeLeaseBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/api/v1/agents/jobs/poll":
+		json.NewEncoder(w).Encode(JobPollResponse{Job: f.next})
+		f.next = nil
+	case "/api/v1/agents/jobs/status":
+		var req JobStatusRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.statuses = append(f.statuses, req)
+	case "/api/v1/agents/jobs/result":
+		var req JobResultRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.results = append(f.results, req)
+	case "/api/v1/agents/jobs/ack", "/api/v1/agents/jobs/renew", "/api/v1/agents/jobs/release":
+		action := r.URL.Path[len("/api/v1/agents/jobs/"):]
+		var req LeaseRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.calls[action] = append(f.calls[action], req)
+		if n, ok := f.rejectAt[action]; ok && len(f.calls[action]) >= n {
+			w.WriteHeader(http.StatusGone)
+		}
+	}
+}
+
+func (f *fakeLeaseBackend) count(action string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.calls[action])
+}
+
+func newLeaseTestAgent(t *testing.T) (*Agent, *fakeLeaseBackend) {
+	fake := &fakeLeaseBackend{calls: map[string][]LeaseRequest{}, rejectAt: map[string]int{}}
+	backend := httptest.NewServer(fake)
+	t.Cleanup(backend.Close)
+	agent := setupTestAgent()
+	agent.serverURL = backend.URL
+	agent.registered = true
+	return agent, fake
+}
+
+func (f *fakeLeaseBackend) push(job *Job) {
+	f.mu.Lock()
+	f.next = job
+	f.mu.Unlock()
+}
+
+func TestJobLease(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("依赖/bin/sh")
+	}
+	viper.Set("resources.workspace_dir", t.TempDir())
+	defer viper.Set("resources.workspace_dir", "")
+
+	agent, fake := newLeaseTestAgent(t)
+	fake.push(&Job{ID: "leased", Type: "shell", Command: "sleep 0.3", Lease: &JobLease{ID: "lease-1", TTL: "90ms"}})
+	require.NoError(t, agent.pollJob())
+	assert.Equal(t, 1, fake.count("ack"))
+
+	// 运行期间续约，结果带上租约ID
+	require.Eventually(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.results) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	agent.tasksMu.RLock()
+	task := agent.tasks["leased"]
+	agent.tasksMu.RUnlock()
+	require.Eventually(t, func() bool { return task.Lease.snapshot().CompletedAt != nil }, time.Second, 10*time.Millisecond)
+	lease := task.Lease.snapshot()
+	assert.NotNil(t, lease.AckedAt)
+	assert.False(t, lease.Lost)
+	assert.GreaterOrEqual(t, lease.Renewals, 2)
+
+	fake.mu.Lock()
+	assert.Equal(t, "completed", fake.results[0].Status)
+	assert.Equal(t, "lease-1", fake.results[0].LeaseID)
+	assert.Equal(t, "lease-1", fake.calls["renew"][0].LeaseID)
+	assert.Equal(t, agent.info.AgentID, fake.calls["renew"][0].AgentID)
+	// 后端收回租约后停止任务
+	fake.rejectAt["renew"] = len(fake.calls["renew"]) + 1
+	fake.mu.Unlock()
+	fake.push(&Job{ID: "revoked", Type: "shell", Command: "sleep 5", Lease: &JobLease{ID: "lease-2", TTL: "90ms"}})
+	start := time.Now()
+	require.NoError(t, agent.pollJob())
+	require.Eventually(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.results) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Less(t, time.Since(start), 3*time.Second)
+	fake.mu.Lock()
+	assert.Equal(t, "lease-2", fake.results[1].LeaseID)
+	assert.Contains(t, fake.results[1].Error, "租约失效")
+	fake.mu.Unlock()
+	agent.tasksMu.RLock()
+	task = agent.tasks["revoked"]
+	agent.tasksMu.RUnlock()
+	assert.True(t, task.Lease.lost())
+}
+
+func TestJobLeaseRejected(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("依赖/bin/sh")
+	}
+	viper.Set("resources.workspace_dir", t.TempDir())
+	defer viper.Set("resources.workspace_dir", "")
+
+	agent, fake := newLeaseTestAgent(t)
+	claim := func(id, jobType string) error {
+		return agent.claimJob(&Job{ID: id, Type: jobType, Command: "true", Lease: &JobLease{ID: "lease-" + id}})
+	}
+	lastRelease := func() LeaseRequest {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return fake.calls["release"][len(fake.calls["release"])-1]
+	}
+
+	assert.Error(t, claim("unknown", "perl"))
+	assert.Equal(t, releaseMissingCapability, lastRelease().Reason)
+	assert.Equal(t, "lease-unknown", lastRelease().LeaseID)
+
+	viper.Set("agent.allowed_job_types", []string{"k6"})
+	assert.Error(t, claim("forbidden", "shell"))
+	viper.Set("agent.allowed_job_types", []string{})
+	assert.Equal(t, releasePolicy, lastRelease().Reason)
+
+	viper.Set("k6.max_concurrent_tasks", 1)
+	defer viper.Set("k6.max_concurrent_tasks", 0)
+	busy := newTestTask(t, agent, &Job{ID: "busy", Type: "shell"})
+	busy.setStatus("running")
+	assert.Error(t, claim("full", "shell"))
+	assert.Equal(t, releaseCapacity, lastRelease().Reason)
+	assert.Contains(t, lastRelease().Message, "1/1")
+	assert.Equal(t, 0, fake.count("ack"))
+	viper.Set("k6.max_concurrent_tasks", 0)
+
+	// 没有租约的任务同样检查类型和并发数，但不确认也不释放租约
+	assert.Error(t, agent.claimJob(&Job{ID: "plain", Type: "perl"}))
+	viper.Set("agent.allowed_job_types", []string{"k6"})
+	assert.Error(t, agent.claimJob(&Job{ID: "plain-forbidden", Type: "shell", Command: "true"}))
+	viper.Set("agent.allowed_job_types", []string{})
+	viper.Set("k6.max_concurrent_tasks", 1)
+	err := agent.claimJob(&Job{ID: "plain-full", Type: "shell", Command: "true"})
+	viper.Set("k6.max_concurrent_tasks", 0)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), releaseCapacity)
+	require.NoError(t, agent.claimJob(&Job{ID: "plain-ok", Type: "shell", Command: "true"}))
+	agent.releaseJob("plain-ok")
+	assert.Equal(t, 3, fake.count("release"))
+	assert.Equal(t, 0, fake.count("ack"))
+
+	// 确认被拒绝时不执行
+	fake.mu.Lock()
+	fake.rejectAt["ack"] = 1
+	fake.mu.Unlock()
+	fake.push(&Job{ID: "taken", Type: "shell", Command: "true", Lease: &JobLease{ID: "lease-taken"}})
+	require.NoError(t, agent.pollJob())
+	assert.Equal(t, 1, fake.count("ack"))
+	agent.tasksMu.RLock()
+	_, exists := agent.tasks["taken"]
+	agent.tasksMu.RUnlock()
+	assert.False(t, exists)
+}
@@ -32,8 +32,11 @@ func main() {
 	// 启动HTTP服务器
 	server := setupHTTPServer(agent)
 
+	// 启动指标服务器
+	metricsServer := setupMetricsServer(agent)
+
 	// 优雅关闭
-	gracefulShutdown(server, agent)
+	gracefulShutdown(server, metricsServer, agent)
 }
 
 func initConfig() {
@@ -49,12 +52,100 @@ func initConfig() {
 	viper.SetDefault("agent.heartbeat_interval", 30)
 	viper.SetDefault("agent.poll_interval", 5)
 	viper.SetDefault("agent.tags", map[string]string{})
+	viper.SetDefault("agent.start_barrier_timeout", "5m")
+	viper.SetDefault("agent.clock_sync_samples", 8)
+	viper.SetDefault("agent.allowed_job_types", []string{})
+	viper.SetDefault("agent.dedup_window", "24h")
 	
 	// K6配置
 	viper.SetDefault("k6.binary", "k6")
+	viper.SetDefault("k6.rest_api.enabled", true)
+	viper.SetDefault("k6.rest_api.host", "127.0.0.1")
+	viper.SetDefault("k6.latency_sketches.enabled", true)
+	viper.SetDefault("k6.latency_sketches.relative_accuracy", 0.01)
+	viper.SetDefault("k6.latency_sketches.metrics", []string{})
 	
 	// 日志配置
 	viper.SetDefault("log.level", "info")
+	viper.SetDefault("log.task_max_file_size", "10MB")
+	viper.SetDefault("log.task_max_files", 5)
+	viper.SetDefault("log.task_tail_lines", 500)
+	
+	// 资源限制配置
+	viper.SetDefault("resources.enable_cgroup", false)
+	viper.SetDefault("resources.cgroup_root", "")
+	viper.SetDefault("resources.cleanup_interval", "1h")
+	viper.SetDefault("resources.task_retention_count", 1000)
+	viper.SetDefault("resources.task_retention_age", "24h")
+	
+	// 监控配置
+	viper.SetDefault("monitoring.enable_metrics", true)
+	viper.SetDefault("monitoring.metrics_port", 9090)
+	viper.SetDefault("monitoring.generator_sample_interval", "5s")
+	viper.SetDefault("monitoring.k6_metrics_retention", "1m")
+	
+	// 实时事件配置
+	viper.SetDefault("events.history_size", 1000)
+	viper.SetDefault("events.client_buffer", 256)
+	viper.SetDefault("events.ping_interval", "30s")
+	viper.SetDefault("events.metrics_interval", "2s")
+	
+	// OpenTelemetry配置
+	viper.SetDefault("telemetry.otlp.enabled", false)
+	viper.SetDefault("telemetry.otlp.endpoint", "http://localhost:4318")
+	viper.SetDefault("telemetry.otlp.export_k6_metrics", true)
+	viper.SetDefault("telemetry.otlp.metric_interval", "10s")
+	viper.SetDefault("telemetry.otlp.k6_attributes", []string{"method", "status", "scenario", "expected_response"})
+
+	// 任务回调配置
+	viper.SetDefault("callback.secret", "")
+	viper.SetDefault("callback.timeout", "10s")
+	viper.SetDefault("callback.max_attempts", 5)
+	viper.SetDefault("callback.backoff", "1s")
+	viper.SetDefault("callback.max_backoff", "30s")
+
+	// 任务通知配置
+	viper.SetDefault("notifications.webhooks", []interface{}{})
+
+	// 控制通道配置
+	viper.SetDefault("channel.enabled", false)
+	viper.SetDefault("channel.path", "/api/v1/agents/channel")
+	viper.SetDefault("channel.ping_interval", "30s")
+	viper.SetDefault("channel.reconnect_backoff", "1s")
+	viper.SetDefault("channel.max_backoff", "1m")
+
+	// 任务租约配置
+	viper.SetDefault("lease.default_ttl", "60s")
+	viper.SetDefault("lease.renew_interval", "0")
+
+	// 任务来源配置
+	viper.SetDefault("job_source.type", "http")
+	viper.SetDefault("job_source.nats.url", "nats://127.0.0.1:4222")
+	viper.SetDefault("job_source.nats.stream", "K6_JOBS")
+	viper.SetDefault("job_source.nats.subject_prefix", "k6.jobs")
+	viper.SetDefault("job_source.nats.subject_tags", []string{})
+	viper.SetDefault("job_source.nats.durable_prefix", "k6-agent")
+	viper.SetDefault("job_source.nats.ack_wait", "60s")
+	viper.SetDefault("job_source.nats.fetch_timeout", "1s")
+	viper.SetDefault("job_source.nats.nak_delay", "5s")
+	viper.SetDefault("job_source.nats.create_stream", true)
+
+	// 协调者模式配置
+	viper.SetDefault("coordinator.enabled", false)
+	viper.SetDefault("coordinator.peers", []interface{}{})
+	viper.SetDefault("coordinator.poll_interval", "2s")
+	viper.SetDefault("coordinator.max_poll_failures", 5)
+	viper.SetDefault("coordinator.start_delay", "1s")
+	viper.SetDefault("coordinator.run_retention", "24h")
+
+	// 产物对象存储配置
+	viper.SetDefault("storage.s3.enabled", false)
+	viper.SetDefault("storage.s3.region", "us-east-1")
+	viper.SetDefault("storage.s3.prefix", "k6-agent")
+	viper.SetDefault("storage.s3.path_style", true)
+	viper.SetDefault("storage.s3.url_expiry", "0")
+	viper.SetDefault("storage.s3.part_size", "16MB")
+	viper.SetDefault("storage.s3.multipart_threshold", "64MB")
 
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
@@ -102,6 +193,36 @@ func setupHTTPServer(agent *Agent) *http.Server {
 
 	// WebSocket连接用于实时日志
 	r.GET("/ws/:taskId", agent.HandleWebSocket)
+	
+	// 任务列表
+	r.GET("/tasks", agent.ListTasks)
+	
+	// 向等待同步开始的任务发送开始信号
+	r.POST("/tasks/:taskId/start", agent.StartTask)
+	
+	// 合并多个任务的延迟草图
+	r.POST("/sketches/merge", agent.MergeSketches)
+	
+	// 协调者模式：把任务拆分到多个对等Agent
+	r.POST("/coordinator/runs", agent.CreateRun)
+	r.GET("/coordinator/runs/:runId", agent.GetRun)
+	r.POST("/coordinator/runs/:runId/stop", agent.StopRun)
+	
+	// 通过k6 REST API实时控制运行中的任务
+	r.POST("/tasks/:taskId/pause", agent.PauseTask)
+	r.POST("/tasks/:taskId/resume", agent.ResumeTask)
+	r.POST("/tasks/:taskId/scale", agent.ScaleTask)
+	r.GET("/tasks/:taskId/k6-status", agent.GetK6Status)
+	
+	// 任务日志分页读取
+	r.GET("/tasks/:taskId/logs", agent.GetTaskLogs)
+	
+	// 任务产物
+	r.GET("/tasks/:taskId/artifacts", agent.ListArtifacts)
+	r.GET("/tasks/:taskId/artifacts/*path", agent.DownloadArtifact)
+	
+	// 实时事件（SSE）
+	r.GET("/tasks/:taskId/events", agent.HandleTaskEvents)
 
 	host := viper.GetString("server.host")
 	port := viper.GetInt("server.port")
@@ -122,7 +243,7 @@ func setupHTTPServer(agent *Agent) *http.Server {
 	return server
 }
 
-func gracefulShutdown(server *http.Server, agent *Agent) {
+func gracefulShutdown(server, metricsServer *http.Server, agent *Agent) {
 	// 等待中断信号
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -141,5 +262,11 @@ func gracefulShutdown(server *http.Server, agent *Agent) {
 		logrus.Errorf("服务器强制关闭: %v", err)
 	}
 
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			logrus.Errorf("指标服务器强制关闭: %v", err)
+		}
+	}
+
 	logrus.Info("服务器已关闭")
 }
\ No newline at end of file
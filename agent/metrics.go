@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const metricsNamespace = "k6_agent"
+
+// agentMetrics Agent自身的Prometheus指标，每个Agent实例使用独立的Registry
+type agentMetrics struct {
+	registry *prometheus.Registry
+
+	jobsReceived           *prometheus.CounterVec
+	jobsRunning            *prometheus.GaugeVec
+	jobsQueued             *prometheus.GaugeVec
+	jobsFinished           *prometheus.CounterVec
+	jobDuration            *prometheus.HistogramVec
+	backendLatency         *prometheus.HistogramVec
+	backendErrors          *prometheus.CounterVec
+	wsClients              prometheus.Gauge
+	eventSubscribersLagged prometheus.Counter
+	notifications          *prometheus.CounterVec
+	channelConnected       prometheus.Gauge
+	channelMessages        *prometheus.CounterVec
+	leases                 *prometheus.CounterVec
+	jobsDuplicate          *prometheus.CounterVec
+	k6                     *k6MetricsCollector
+
+	heartbeatMu   sync.RWMutex
+	lastHeartbeat time.Time
+}
+
+// newAgentMetrics 创建并注册Agent指标
+func newAgentMetrics() *agentMetrics {
+	retention, err := time.ParseDuration(viper.GetString("monitoring.k6_metrics_retention"))
+	if err != nil || retention <= 0 {
+		retention = time.Minute
+	}
+
+	m := &agentMetrics{
+		registry: prometheus.NewRegistry(),
+		k6:       newK6MetricsCollector(k6MetricTagKeys(), retention),
+		jobsReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "jobs_received_total",
+			Help:      "接收到的任务总数",
+		}, []string{"type"}),
+		jobsRunning: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "jobs_running",
+			Help:      "正在运行的任务数",
+		}, []string{"type"}),
+		jobsQueued: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "jobs_queued",
+			Help:      "已接收但尚未开始运行的任务数",
+		}, []string{"type"}),
+		jobsFinished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "jobs_finished_total",
+			Help:      "按最终状态统计的已结束任务数",
+		}, []string{"type", "status"}),
+		jobDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "job_duration_seconds",
+			Help:      "任务执行耗时",
+			Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200},
+		}, []string{"type", "status"}),
+		backendLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "backend_request_duration_seconds",
+			Help:      "调用后端接口的耗时",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"endpoint"}),
+		backendErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "backend_request_errors_total",
+			Help:      "调用后端接口失败的次数（网络错误或非2xx响应）",
+		}, []string{"endpoint"}),
+		wsClients: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "websocket_clients",
+			Help:      "当前连接的WebSocket客户端数",
+		}),
+		eventSubscribersLagged: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "event_subscribers_lagged_total",
+			Help:      "因缓冲区已满被断开的实时事件订阅者数",
+		}),
+		notifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "notifications_total",
+			Help:      "按webhook和结果统计的任务通知数",
+		}, []string{"webhook", "result"}),
+		channelConnected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "control_channel_connected",
+			Help:      "与后端的控制通道是否已连接",
+		}),
+		channelMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "control_channel_messages_total",
+			Help:      "按类型和结果统计的控制通道消息数",
+		}, []string{"type", "result"}),
+		leases: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "job_leases_total",
+			Help:      "按事件统计的任务租约操作数",
+		}, []string{"event"}),
+		jobsDuplicate: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "jobs_duplicate_total",
+			Help:      "按来源统计的重复下发而未执行的任务数",
+		}, []string{"source"}),
+	}
+
+	heartbeatAge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "heartbeat_age_seconds",
+		Help:      "距上次成功心跳的秒数，从未成功时为-1",
+	}, m.heartbeatAge)
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.jobsReceived,
+		m.jobsRunning,
+		m.jobsQueued,
+		m.jobsFinished,
+		m.jobDuration,
+		m.backendLatency,
+		m.backendErrors,
+		m.wsClients,
+		m.eventSubscribersLagged,
+		m.notifications,
+		m.channelConnected,
+		m.channelMessages,
+		m.leases,
+		m.jobsDuplicate,
+		heartbeatAge,
+		m.k6,
+	)
+	return m
+}
+
+// markHeartbeat 记录一次成功心跳
+func (m *agentMetrics) markHeartbeat() {
+	m.heartbeatMu.Lock()
+	m.lastHeartbeat = time.Now()
+	m.heartbeatMu.Unlock()
+}
+
+func (m *agentMetrics) heartbeatAge() float64 {
+	m.heartbeatMu.RLock()
+	defer m.heartbeatMu.RUnlock()
+	if m.lastHeartbeat.IsZero() {
+		return -1
+	}
+	return time.Since(m.lastHeartbeat).Seconds()
+}
+
+// jobQueued 记录接收到的任务
+func (m *agentMetrics) jobQueued(jobType string) {
+	m.jobsReceived.WithLabelValues(jobType).Inc()
+	m.jobsQueued.WithLabelValues(jobType).Inc()
+}
+
+// jobStarted 任务由排队转为运行
+func (m *agentMetrics) jobStarted(jobType string) {
+	m.jobsQueued.WithLabelValues(jobType).Dec()
+	m.jobsRunning.WithLabelValues(jobType).Inc()
+}
+
+// jobFinished 记录任务结束状态和耗时
+func (m *agentMetrics) jobFinished(jobType, status string, duration time.Duration) {
+	m.jobsRunning.WithLabelValues(jobType).Dec()
+	m.jobsFinished.WithLabelValues(jobType, status).Inc()
+	m.jobDuration.WithLabelValues(jobType, status).Observe(duration.Seconds())
+}
+
+// instrumentedTransport 统计后端调用耗时和错误的RoundTripper
+type instrumentedTransport struct {
+	next    http.RoundTripper
+	metrics *agentMetrics
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := backendEndpoint(req.URL.Path)
+	start := time.Now()
+
+	resp, err := t.next.RoundTrip(req)
+
+	t.metrics.backendLatency.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	if err != nil || resp.StatusCode >= 300 {
+		t.metrics.backendErrors.WithLabelValues(endpoint).Inc()
+	}
+	return resp, err
+}
+
+// backendEndpoint 将请求路径归一化为指标标签，去掉路径中的ID避免标签基数过高
+func backendEndpoint(path string) string {
+	if strings.HasPrefix(path, "/api/scripts/") {
+		return "/api/scripts/:id/content"
+	}
+	return path
+}
+
+// setupMetricsServer 在独立端口上提供/metrics，未启用时返回nil
+func setupMetricsServer(agent *Agent) *http.Server {
+	if !viper.GetBool("monitoring.enable_metrics") {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(agent.metrics.registry, promhttp.HandlerOpts{}))
+
+	addr := fmt.Sprintf("%s:%d", viper.GetString("server.host"), viper.GetInt("monitoring.metrics_port"))
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	go func() {
+		logrus.Infof("指标服务启动在 %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("指标服务启动失败: %v", err)
+		}
+	}()
+
+	return server
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentMetricsJobLifecycle(t *testing.T) {
+	m := newAgentMetrics()
+
+	m.jobQueued("k6")
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.jobsQueued.WithLabelValues("k6")))
+
+	m.jobStarted("k6")
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.jobsQueued.WithLabelValues("k6")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.jobsRunning.WithLabelValues("k6")))
+
+	m.jobFinished("k6", "failed", 3*time.Second)
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.jobsRunning.WithLabelValues("k6")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.jobsFinished.WithLabelValues("k6", "failed")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.jobsReceived.WithLabelValues("k6")))
+
+	assert.Equal(t, float64(-1), m.heartbeatAge())
+	m.markHeartbeat()
+	assert.GreaterOrEqual(t, m.heartbeatAge(), float64(0))
+}
+
+func TestInstrumentedTransport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/agents/heartbeat" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	m := newAgentMetrics()
+	client := &http.Client{Transport: &instrumentedTransport{next: http.DefaultTransport, metrics: m}}
+
+	resp, err := client.Get(backend.URL + "/api/scripts/abc-123/content")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	resp, err = client.Post(backend.URL+"/api/v1/agents/heartbeat", "application/json", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.backendErrors.WithLabelValues("/api/scripts/:id/content")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.backendErrors.WithLabelValues("/api/v1/agents/heartbeat")))
+
+	// 通过/metrics抓取，确认指标以Prometheus格式输出
+	w := httptest.NewRecorder()
+	promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	assert.True(t, strings.Contains(body, `k6_agent_backend_request_duration_seconds_count{endpoint="/api/scripts/:id/content"} 1`))
+	assert.True(t, strings.Contains(body, "k6_agent_heartbeat_age_seconds -1"))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// NATS JetStream任务来源：任务以JSON发布到由Agent标签派生的主题，
+// 例如<prefix>.any（任意Agent）和<prefix>.region.us-west（带region=us-west标签的Agent）。
+// 每个主题对应一个共享的durable消费者，标签相同的Agent在同一主题上按队列分摊任务。
+// 消息的AckWait即租约时长：执行前InProgress，运行期间定期InProgress，放弃时Nak，结果回传后才Ack，
+// Agent崩溃时消息在AckWait后重新投递给其他Agent。
+
+// natsSourceConfig NATS任务来源配置
+type natsSourceConfig struct {
+	URL           string
+	Stream        string
+	Prefix        string   // 任务主题前缀，stream覆盖<prefix>.>
+	Subjects      []string // 由标签派生的消费主题
+	DurablePrefix string
+	AckWait       time.Duration
+	FetchTimeout  time.Duration
+	NakDelay      time.Duration // 容量不足时延迟重新投递
+	CreateStream  bool
+}
+
+func natsSourceConfigFromViper(tags map[string]string) (natsSourceConfig, error) {
+	cfg := natsSourceConfig{
+		URL:           viper.GetString("job_source.nats.url"),
+		Stream:        viper.GetString("job_source.nats.stream"),
+		DurablePrefix: viper.GetString("job_source.nats.durable_prefix"),
+		AckWait:       viper.GetDuration("job_source.nats.ack_wait"),
+		FetchTimeout:  viper.GetDuration("job_source.nats.fetch_timeout"),
+		NakDelay:      viper.GetDuration("job_source.nats.nak_delay"),
+		CreateStream:  viper.GetBool("job_source.nats.create_stream"),
+	}
+	if cfg.URL == "" {
+		cfg.URL = nats.DefaultURL
+	}
+	if cfg.Stream == "" {
+		cfg.Stream = "K6_JOBS"
+	}
+	if cfg.DurablePrefix == "" {
+		cfg.DurablePrefix = "k6-agent"
+	}
+	if cfg.AckWait <= 0 {
+		cfg.AckWait = time.Minute
+	}
+	if cfg.FetchTimeout <= 0 {
+		cfg.FetchTimeout = time.Second
+	}
+	if cfg.NakDelay <= 0 {
+		cfg.NakDelay = 5 * time.Second
+	}
+
+	cfg.Prefix = strings.Trim(viper.GetString("job_source.nats.subject_prefix"), ".")
+	if cfg.Prefix == "" {
+		cfg.Prefix = "k6.jobs"
+	}
+	keys := viper.GetStringSlice("job_source.nats.subject_tags")
+	if len(keys) == 0 {
+		for k := range tags {
+			keys = append(keys, k)
+		}
+	}
+	subjects, err := natsJobSubjects(cfg.Prefix, tags, keys)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Subjects = subjects
+	return cfg, nil
+}
+
+// natsJobSubjects 由标签派生消费主题：<prefix>.any，以及每个标签的<prefix>.<key>.<value>
+func natsJobSubjects(prefix string, tags map[string]string, keys []string) ([]string, error) {
+	subjects := []string{prefix + ".any"}
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		v, ok := tags[k]
+		if !ok {
+			return nil, fmt.Errorf("job_source.nats.subject_tags中的标签 %q 不在agent.tags中", k)
+		}
+		subject := fmt.Sprintf("%s.%s.%s", prefix, natsToken(k), natsToken(v))
+		if !containsString(subjects, subject) {
+			subjects = append(subjects, subject)
+		}
+	}
+	return subjects, nil
+}
+
+// natsToken 把标签替换为合法的主题片段
+func natsToken(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '.' || r == '*' || r == '>' || r <= ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// natsJobSource 从JetStream拉取任务
+type natsJobSource struct {
+	cfg natsSourceConfig
+
+	mu   sync.Mutex
+	conn *nats.Conn
+	subs []*nats.Subscription
+	next int // 轮流从各主题拉取，避免某个主题的任务一直排在后面
+}
+
+func newNATSJobSource(cfg natsSourceConfig) *natsJobSource {
+	return &natsJobSource{cfg: cfg}
+}
+
+func (s *natsJobSource) Name() string {
+	return jobSourceNATS
+}
+
+// connect 首次使用时连接并创建消费者，连接断开后由nats客户端自动重连
+func (s *natsJobSource) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+	conn, err := nats.Connect(s.cfg.URL, nats.Name("k6-agent"), nats.MaxReconnects(-1))
+	if err != nil {
+		return fmt.Errorf("连接NATS失败: %v", err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if s.cfg.CreateStream {
+		if _, err := js.StreamInfo(s.cfg.Stream); errors.Is(err, nats.ErrStreamNotFound) {
+			_, err = js.AddStream(&nats.StreamConfig{
+				Name:      s.cfg.Stream,
+				Subjects:  []string{s.cfg.Prefix + ".>"},
+				Retention: nats.WorkQueuePolicy,
+			})
+			if err != nil {
+				conn.Close()
+				return fmt.Errorf("创建stream %s 失败: %v", s.cfg.Stream, err)
+			}
+		}
+	}
+
+	var subs []*nats.Subscription
+	for _, subject := range s.cfg.Subjects {
+		durable := s.cfg.DurablePrefix + "_" + strings.ReplaceAll(subject, ".", "_")
+		sub, err := js.PullSubscribe(subject, durable,
+			nats.BindStream(s.cfg.Stream),
+			nats.AckExplicit(),
+			nats.AckWait(s.cfg.AckWait),
+		)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("订阅 %s 失败: %v", subject, err)
+		}
+		subs = append(subs, sub)
+	}
+	s.conn, s.subs = conn, subs
+	logrus.Infof("已连接NATS %s，消费主题: %s", s.cfg.URL, strings.Join(s.cfg.Subjects, ", "))
+	return nil
+}
+
+func (s *natsJobSource) Fetch(ctx context.Context) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+
+	// 在拉取超时内轮流询问各主题
+	wait := s.cfg.FetchTimeout / time.Duration(len(s.subs))
+	for i := 0; i < len(s.subs); i++ {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		sub := s.subs[s.next]
+		s.next = (s.next + 1) % len(s.subs)
+		msgs, err := sub.Fetch(1, nats.MaxWait(wait))
+		if errors.Is(err, nats.ErrTimeout) || len(msgs) == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("从 %s 拉取任务失败: %v", sub.Subject, err)
+		}
+
+		msg := msgs[0]
+		var job Job
+		if err := json.Unmarshal(msg.Data, &job); err != nil || job.ID == "" {
+			// 无法解析的消息不会被任何Agent处理，直接终止投递
+			logrus.Errorf("丢弃无效的任务消息 (主题 %s): %v", msg.Subject, err)
+			msg.Term()
+			continue
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return nil, err
+		}
+		job.Lease = &JobLease{
+			ID:     fmt.Sprintf("%s:%d", meta.Stream, meta.Sequence.Stream),
+			TTL:    s.cfg.AckWait.String(),
+			source: s,
+			handle: msg,
+		}
+		return &job, nil
+	}
+	return nil, nil
+}
+
+// message 租约对应的NATS消息
+func (s *natsJobSource) message(lease *JobLease) (*nats.Msg, error) {
+	msg, ok := lease.handle.(*nats.Msg)
+	if !ok {
+		return nil, fmt.Errorf("租约 %s 不是NATS消息", lease.ID)
+	}
+	return msg, nil
+}
+
+func (s *natsJobSource) Ack(jobID string, lease *JobLease) error {
+	return s.ExtendLease(jobID, lease)
+}
+
+// Nack 容量不足时延迟重新投递，其余原因立即重新投递给其他Agent
+func (s *natsJobSource) Nack(jobID string, lease *JobLease, reason, message string) error {
+	msg, err := s.message(lease)
+	if err != nil {
+		return err
+	}
+	if reason == releaseCapacity {
+		return msg.NakWithDelay(s.cfg.NakDelay)
+	}
+	return msg.Nak()
+}
+
+// ExtendLease 重置消息的AckWait
+func (s *natsJobSource) ExtendLease(jobID string, lease *JobLease) error {
+	msg, err := s.message(lease)
+	if err != nil {
+		return err
+	}
+	return msg.InProgress()
+}
+
+// Complete 结果回传后才确认消息，之前Agent崩溃的话消息会重新投递
+func (s *natsJobSource) Complete(jobID string, lease *JobLease) error {
+	msg, err := s.message(lease)
+	if err != nil {
+		return err
+	}
+	return msg.AckSync()
+}
+
+// Close 断开NATS连接，未确认的消息在AckWait后重新投递
+func (s *natsJobSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.subs = nil, nil
+	}
+	return nil
+}
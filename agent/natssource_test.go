@@ -0,0 +1,130 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNATSJobSubjects(t *testing.T) {
+	tags := map[string]string{"region": "us-west", "type": "high.perf"}
+	subjects, err := natsJobSubjects("k6.jobs", tags, []string{"type", "region"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k6.jobs.any", "k6.jobs.region.us-west", "k6.jobs.type.high_perf"}, subjects)
+
+	_, err = natsJobSubjects("k6.jobs", tags, []string{"team"})
+	assert.Error(t, err)
+}
+
+// runNATSServer 启动开启JetStream的内嵌NATS服务
+func runNATSServer(t *testing.T) string {
+	srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	require.NoError(t, err)
+	go srv.Start()
+	require.True(t, srv.ReadyForConnections(5*time.Second))
+	t.Cleanup(srv.Shutdown)
+	return srv.ClientURL()
+}
+
+func TestNATSJobSource(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("依赖/bin/sh")
+	}
+	viper.Set("resources.workspace_dir", t.TempDir())
+	defer viper.Set("resources.workspace_dir", "")
+
+	url := runNATSServer(t)
+	for key, value := range map[string]interface{}{
+		"job_source.nats.url":           url,
+		"job_source.nats.ack_wait":      "300ms",
+		"job_source.nats.fetch_timeout": "100ms",
+		"job_source.nats.nak_delay":     "50ms",
+		"job_source.nats.create_stream": true,
+	} {
+		viper.Set(key, value)
+		defer viper.Set(key, nil)
+	}
+
+	agent := setupTestAgent()
+	agent.serverURL = ""
+	agent.info.Tags = map[string]string{"region": "us-west"}
+	cfg, err := natsSourceConfigFromViper(agent.info.Tags)
+	require.NoError(t, err)
+	source := newNATSJobSource(cfg)
+	defer source.Close()
+	agent.source = source
+
+	// 第一次拉取时创建stream和消费者
+	job, err := source.Fetch(agent.ctx)
+	require.NoError(t, err)
+	assert.Nil(t, job)
+
+	nc, err := nats.Connect(url)
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	publish := func(subject, data string) {
+		_, err := js.Publish(subject, []byte(data))
+		require.NoError(t, err)
+	}
+	consumer := func(subject string) *nats.ConsumerInfo {
+		info, err := js.ConsumerInfo(cfg.Stream, "k6-agent_"+subject)
+		require.NoError(t, err)
+		return info
+	}
+
+	// 运行时间超过AckWait，靠续约保持租约，结果回传后才确认
+	publish("k6.jobs.region.us-west", `{"id": "nats-job", "type": "shell", "command": "sleep 0.7"}`)
+	publish("k6.jobs.region.eu", `{"id": "other-region", "type": "shell", "command": "true"}`)
+	require.NoError(t, agent.pollJob())
+	agent.tasksMu.RLock()
+	task := agent.tasks["nats-job"]
+	agent.tasksMu.RUnlock()
+	require.NotNil(t, task)
+	assert.Equal(t, "K6_JOBS:1", task.Lease.current().ID)
+	require.Eventually(t, func() bool { return task.Lease.snapshot().CompletedAt != nil }, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, "completed", task.Status.Status)
+	assert.GreaterOrEqual(t, task.Lease.snapshot().Renewals, 2)
+	info := consumer("k6_jobs_region_us-west")
+	assert.Equal(t, 0, info.NumAckPending)
+	assert.Equal(t, 0, info.NumRedelivered)
+
+	// 容量不足时Nak，稍后重新投递
+	viper.Set("k6.max_concurrent_tasks", 1)
+	defer viper.Set("k6.max_concurrent_tasks", 0)
+	busy := newTestTask(t, agent, &Job{ID: "busy", Type: "shell"})
+	busy.setStatus("running")
+	publish("k6.jobs.any", `{"id": "queued", "type": "shell", "command": "true"}`)
+	require.NoError(t, agent.pollJob())
+	agent.tasksMu.RLock()
+	_, started := agent.tasks["queued"]
+	agent.tasksMu.RUnlock()
+	assert.False(t, started)
+
+	now := time.Now()
+	busy.Status.EndTime = &now
+	require.Eventually(t, func() bool {
+		require.NoError(t, agent.pollJob())
+		agent.tasksMu.RLock()
+		defer agent.tasksMu.RUnlock()
+		return agent.tasks["queued"] != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, uint64(2), consumer("k6_jobs_any").Delivered.Consumer)
+
+	// 无效消息直接终止投递
+	publish("k6.jobs.any", `not json`)
+	require.NoError(t, agent.pollJob())
+	require.Eventually(t, func() bool { return consumer("k6_jobs_any").NumAckPending == 0 }, 2*time.Second, 20*time.Millisecond)
+
+	// 其他区域的任务留在stream中
+	stream, err := js.StreamInfo(cfg.Stream)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stream.State.Msgs)
+}
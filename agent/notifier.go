@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// 任务生命周期中可以触发通知的事件
+const (
+	notifyStarted           = "started"
+	notifyFinished          = "finished" // 任务结束，不论结果
+	notifyFailed            = "failed"   // 失败或被OOM终止
+	notifyThresholdBreached = "threshold_breached"
+	notifyTimeout           = "timeout"
+)
+
+var notifyEvents = []string{notifyStarted, notifyFinished, notifyFailed, notifyThresholdBreached, notifyTimeout}
+
+// defaultWebhookTemplate 未配置模板时发送完整的通知内容
+const defaultWebhookTemplate = `{{json .}}`
+
+// k6ThresholdsFailedExitCode k6在阈值未通过时的退出码
+const k6ThresholdsFailedExitCode = 99
+
+// notifierStopTimeout Agent停止时等待未完成通知的最长时间
+const notifierStopTimeout = 10 * time.Second
+
+// webhookConfig notifications.webhooks中的一项
+type webhookConfig struct {
+	Name        string            `mapstructure:"name"`
+	URL         string            `mapstructure:"url"`
+	Method      string            `mapstructure:"method"`
+	Headers     map[string]string `mapstructure:"headers"`
+	ContentType string            `mapstructure:"content_type"`
+	Events      []string          `mapstructure:"events"`
+	Template    string            `mapstructure:"template"` // Go模板，渲染结果作为请求体
+	Filters     struct {
+		Tags     map[string]string `mapstructure:"tags"`     // 任务标签全部匹配时才通知
+		Statuses []string          `mapstructure:"statuses"` // 任务状态在列表中时才通知
+	} `mapstructure:"filters"`
+	MaxAttempts int    `mapstructure:"max_attempts"`
+	Backoff     string `mapstructure:"backoff"`
+	Timeout     string `mapstructure:"timeout"`
+}
+
+// Notification 渲染模板使用的数据
+type Notification struct {
+	Event     string      `json:"event"`
+	AgentID   string      `json:"agentId"`
+	Hostname  string      `json:"hostname"`
+	Task      TaskSummary `json:"task"`
+	Duration  string      `json:"duration,omitempty"` // 已运行时长，例如1m30s
+	Metrics   interface{} `json:"metrics,omitempty"`
+	ReportURL string      `json:"reportUrl,omitempty"`
+	Time      time.Time   `json:"time"`
+}
+
+// webhook 解析后的通知目标
+type webhook struct {
+	cfg         webhookConfig
+	events      map[string]bool
+	tmpl        *template.Template
+	maxAttempts int
+	backoff     time.Duration
+	client      *http.Client
+	deadline    time.Duration // 一次通知包括重试在内的最长时间
+}
+
+// notifier 按配置把任务事件推送到各个webhook
+type notifier struct {
+	webhooks []*webhook
+	onResult func(name, result string)
+	wg       sync.WaitGroup
+}
+
+var webhookFuncs = template.FuncMap{
+	// json 把值编码为JSON，在JSON模板中插入字符串时用于转义
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"upper": strings.ToUpper,
+	"join": func(sep string, m map[string]string) string {
+		pairs := make([]string, 0, len(m))
+		for k, v := range m {
+			pairs = append(pairs, k+"="+v)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, sep)
+	},
+}
+
+// newWebhook 校验配置并解析模板
+func newWebhook(cfg webhookConfig) (*webhook, error) {
+	if cfg.Name == "" {
+		cfg.Name = cfg.URL
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("webhook %s 缺少url", cfg.Name)
+	}
+	if cfg.Method == "" {
+		cfg.Method = http.MethodPost
+	}
+	if cfg.ContentType == "" {
+		cfg.ContentType = "application/json"
+	}
+	if cfg.Template == "" {
+		cfg.Template = defaultWebhookTemplate
+	}
+
+	events := make(map[string]bool)
+	for _, event := range cfg.Events {
+		if !containsString(notifyEvents, event) {
+			return nil, fmt.Errorf("webhook %s 的事件 %q 无效，可选: %s", cfg.Name, event, strings.Join(notifyEvents, ", "))
+		}
+		events[event] = true
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("webhook %s 没有订阅任何事件", cfg.Name)
+	}
+
+	tmpl, err := template.New(cfg.Name).Funcs(webhookFuncs).Option("missingkey=zero").Parse(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("webhook %s 的模板无效: %v", cfg.Name, err)
+	}
+
+	hook := &webhook{cfg: cfg, events: events, tmpl: tmpl, maxAttempts: cfg.MaxAttempts, backoff: time.Second}
+	if hook.maxAttempts <= 0 {
+		hook.maxAttempts = 3
+	}
+	if d, err := time.ParseDuration(cfg.Backoff); err == nil && d > 0 {
+		hook.backoff = d
+	}
+	timeout := 10 * time.Second
+	if d, err := time.ParseDuration(cfg.Timeout); err == nil && d > 0 {
+		timeout = d
+	}
+	hook.client = &http.Client{Timeout: timeout}
+	// 每次请求的超时加上各次退避等待
+	hook.deadline = time.Duration(hook.maxAttempts)*timeout + hook.backoff*time.Duration(1<<uint(hook.maxAttempts-1)-1)
+	return hook, nil
+}
+
+// newNotifierFromViper 读取notifications.webhooks，无效的webhook被跳过
+func newNotifierFromViper() *notifier {
+	var configs []webhookConfig
+	if err := viper.UnmarshalKey("notifications.webhooks", &configs); err != nil {
+		logrus.Warnf("通知配置无效: %v", err)
+		return &notifier{}
+	}
+	n := &notifier{}
+	for _, cfg := range configs {
+		hook, err := newWebhook(cfg)
+		if err != nil {
+			logrus.Warnf("忽略通知配置: %v", err)
+			continue
+		}
+		n.webhooks = append(n.webhooks, hook)
+	}
+	return n
+}
+
+// matches 判断webhook是否需要处理该事件
+func (w *webhook) matches(event string, status *TaskStatus) bool {
+	if !w.events[event] {
+		return false
+	}
+	// 状态过滤只作用于任务结束后的事件
+	if event != notifyStarted && len(w.cfg.Filters.Statuses) > 0 && !containsString(w.cfg.Filters.Statuses, status.Status) {
+		return false
+	}
+	for k, v := range w.cfg.Filters.Tags {
+		if status.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// notify 异步发送事件到所有匹配的webhook，不阻塞任务执行。
+// 每次发送使用独立的超时，Agent停止时已发出的通知仍会完成，由Stop等待
+func (n *notifier) notify(event string, status *TaskStatus, data Notification) {
+	if n == nil {
+		return
+	}
+	for _, hook := range n.webhooks {
+		if !hook.matches(event, status) {
+			continue
+		}
+		var body bytes.Buffer
+		if err := hook.tmpl.Execute(&body, data); err != nil {
+			logrus.Warnf("渲染webhook %s 失败: %v", hook.cfg.Name, err)
+			n.record(hook.cfg.Name, "template_error")
+			continue
+		}
+
+		n.wg.Add(1)
+		go func(hook *webhook, body []byte) {
+			defer n.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), hook.deadline)
+			defer cancel()
+			if err := hook.send(ctx, body); err != nil {
+				logrus.Warnf("任务 %s 的 %s 通知发送到 %s 失败: %v", data.Task.ID, event, hook.cfg.Name, err)
+				n.record(hook.cfg.Name, "failed")
+				return
+			}
+			n.record(hook.cfg.Name, "sent")
+		}(hook, body.Bytes())
+	}
+}
+
+func (n *notifier) record(name, result string) {
+	if n.onResult != nil {
+		n.onResult(name, result)
+	}
+}
+
+// wait 等待已发出的通知完成，超过timeout仍未完成时返回false
+func (n *notifier) wait(timeout time.Duration) bool {
+	if n == nil {
+		return true
+	}
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// send 发送请求，5xx、429和网络错误时退避重试
+func (w *webhook) send(ctx context.Context, body []byte) error {
+	backoff := w.backoff
+	var lastErr error
+	for attempt := 1; attempt <= w.maxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		req, err := http.NewRequestWithContext(ctx, w.cfg.Method, w.cfg.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", w.cfg.ContentType)
+		for k, v := range w.cfg.Headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := w.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("状态码: %d", resp.StatusCode)
+		if !retryableStatus(resp.StatusCode) {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+// notifyTask 以任务当前状态构造通知数据并发送
+func (a *Agent) notifyTask(task *Task, event string) {
+	if a.notifier == nil || len(a.notifier.webhooks) == 0 {
+		return
+	}
+
+	status := task.snapshot()
+	a.infoMu.RLock()
+	data := Notification{
+		Event:    event,
+		AgentID:  a.info.AgentID,
+		Hostname: a.info.Hostname,
+		Task:     taskSummary(&status),
+		Time:     time.Now(),
+	}
+	a.infoMu.RUnlock()
+
+	end := data.Time
+	if status.EndTime != nil {
+		end = *status.EndTime
+	}
+	data.Duration = end.Sub(status.StartTime).Round(time.Second).String()
+	if status.Result != nil {
+		data.Metrics = status.Result["metrics"]
+	}
+	data.ReportURL = status.Artifacts.reportURL()
+
+	a.notifier.notify(event, &status, data)
+}
+
+// notifyTaskFinished 任务结束时发送finished以及按结果细分的事件
+func (a *Agent) notifyTaskFinished(task *Task) {
+	a.notifyTask(task, notifyFinished)
+	status := task.snapshot()
+	if status.Status == "failed" || status.Status == "oom_killed" {
+		a.notifyTask(task, notifyFailed)
+	}
+	if status.ThresholdsBreached {
+		a.notifyTask(task, notifyThresholdBreached)
+	}
+	if status.TimedOut {
+		a.notifyTask(task, notifyTimeout)
+	}
+}
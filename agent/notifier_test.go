@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver 记录收到的通知，前failures次返回500
+type webhookReceiver struct {
+	mu       sync.Mutex
+	bodies   []string
+	requests int
+	failures int
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if r.requests <= r.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	r.bodies = append(r.bodies, string(body))
+}
+
+func (r *webhookReceiver) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.bodies...)
+}
+
+func TestWebhookTemplateFiltersAndRetry(t *testing.T) {
+	receiver := &webhookReceiver{failures: 1}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	cfg := webhookConfig{
+		Name:     "slack",
+		URL:      server.URL,
+		Events:   []string{notifyFailed},
+		Template: `{"text": {{json (printf "任务 %s 失败: %s [%s]" .Task.ID .Task.Error (join "," .Task.Tags))}}}`,
+		Backoff:  "1ms",
+	}
+	cfg.Filters.Tags = map[string]string{"team": "perf"}
+	cfg.Filters.Statuses = []string{"failed"}
+	hook, err := newWebhook(cfg)
+	require.NoError(t, err)
+
+	results := map[string]int{}
+	var mu sync.Mutex
+	n := &notifier{webhooks: []*webhook{hook}, onResult: func(name, result string) {
+		mu.Lock()
+		results[name+"/"+result]++
+		mu.Unlock()
+	}}
+
+	notify := func(event string, status *TaskStatus) {
+		n.notify(event, status, Notification{Event: event, Task: taskSummary(status)})
+	}
+	matching := &TaskStatus{ID: "task-1", Status: "failed", Error: `exit "1"`, Tags: map[string]string{"team": "perf", "env": "ci"}}
+	notify(notifyFailed, matching)
+	notify(notifyFinished, matching)                                                                          // 未订阅的事件
+	notify(notifyFailed, &TaskStatus{ID: "task-2", Status: "failed", Tags: map[string]string{"team": "web"}}) // 标签不匹配
+	notify(notifyFailed, &TaskStatus{ID: "task-3", Status: "oom_killed", Tags: matching.Tags})                // 状态不匹配
+	require.True(t, n.wait(5*time.Second))
+
+	// 第一次500后重试成功，模板中的字符串被正确转义
+	bodies := receiver.received()
+	require.Len(t, bodies, 1)
+	var payload map[string]string
+	require.NoError(t, json.Unmarshal([]byte(bodies[0]), &payload))
+	assert.Equal(t, `任务 task-1 失败: exit "1" [env=ci,team=perf]`, payload["text"])
+	assert.Equal(t, map[string]int{"slack/sent": 1}, results)
+}
+
+func TestNewWebhookValidation(t *testing.T) {
+	_, err := newWebhook(webhookConfig{URL: "http://x", Events: []string{"done"}})
+	assert.Error(t, err)
+	_, err = newWebhook(webhookConfig{URL: "http://x", Events: []string{notifyStarted}, Template: "{{.Task.ID"})
+	assert.Error(t, err)
+	_, err = newWebhook(webhookConfig{URL: "http://x"})
+	assert.Error(t, err)
+}
+
+func TestTaskLifecycleNotifications(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("依赖/bin/sh")
+	}
+	dir := t.TempDir()
+	viper.Set("resources.workspace_dir", dir)
+	defer viper.Set("resources.workspace_dir", "")
+
+	// 模拟阈值未通过的k6
+	fakeK6 := filepath.Join(dir, "k6")
+	require.NoError(t, os.WriteFile(fakeK6, []byte("#!/bin/sh\necho 'thresholds on metrics have been crossed'\nexit 99\n"), 0755))
+	viper.Set("k6.binary", fakeK6)
+	defer viper.Set("k6.binary", "k6")
+
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	viper.Set("notifications.webhooks", []map[string]interface{}{{
+		"name":     "generic",
+		"url":      server.URL,
+		"events":   notifyEvents,
+		"template": `{{.Event}} {{.Task.ID}} {{.Task.Status}}`,
+	}})
+	defer viper.Set("notifications.webhooks", nil)
+
+	agent := setupTestAgent()
+	events := func(job *Job) []string {
+		receiver.mu.Lock()
+		receiver.bodies = nil
+		receiver.mu.Unlock()
+		agent.runTask(newTestTask(t, agent, job), job)
+		require.True(t, agent.notifier.wait(5*time.Second))
+		return receiver.received()
+	}
+
+	received := events(&Job{ID: "k6-task", Type: "k6", ScriptContent: "export default function() {}"})
+	assert.ElementsMatch(t, []string{
+		"started k6-task pending",
+		"finished k6-task failed",
+		"failed k6-task failed",
+		"threshold_breached k6-task failed",
+	}, received)
+
+	start := time.Now()
+	received = events(&Job{ID: "slow-task", Type: "shell", Command: "sleep 5", Timeout: "100ms"})
+	assert.Less(t, time.Since(start), 4*time.Second)
+	assert.ElementsMatch(t, []string{
+		"started slow-task pending",
+		"finished slow-task failed",
+		"failed slow-task failed",
+		"timeout slow-task failed",
+	}, received)
+
+	agent.tasksMu.RLock()
+	defer agent.tasksMu.RUnlock()
+	assert.True(t, agent.tasks["k6-task"].Status.ThresholdsBreached)
+	assert.True(t, agent.tasks["slow-task"].Status.TimedOut)
+	assert.Contains(t, agent.tasks["slow-task"].Status.Error, "超时")
+}
+
+func TestStopWaitsForNotifications(t *testing.T) {
+	viper.Set("resources.workspace_dir", t.TempDir())
+	defer viper.Set("resources.workspace_dir", "")
+
+	// 第一次失败，退避后重试时Agent已经在停止
+	receiver := &webhookReceiver{failures: 1}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	viper.Set("notifications.webhooks", []map[string]interface{}{{
+		"name":     "generic",
+		"url":      server.URL,
+		"events":   []string{notifyStarted},
+		"template": `{{.Event}} {{.Task.ID}}`,
+		"backoff":  "100ms",
+	}})
+	defer viper.Set("notifications.webhooks", nil)
+
+	agent := setupTestAgent()
+	task := newTestTask(t, agent, &Job{ID: "task-1", Type: "shell"})
+	agent.notifyTask(task, notifyStarted)
+	agent.Stop()
+
+	assert.Equal(t, []string{"started task-1"}, receiver.received())
+}
+
+func TestNotifierWaitTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	hook, err := newWebhook(webhookConfig{URL: server.URL, Events: []string{notifyStarted}, Timeout: "5s"})
+	require.NoError(t, err)
+	n := &notifier{webhooks: []*webhook{hook}}
+	status := &TaskStatus{ID: "task-1"}
+	n.notify(notifyStarted, status, Notification{Event: notifyStarted, Task: taskSummary(status)})
+
+	start := time.Now()
+	assert.False(t, n.wait(50*time.Millisecond))
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3MinPartSize     = 5 << 20 // S3要求除最后一段外每段不小于5MB
+	s3MaxParts        = 10000
+)
+
+// s3RetryDelay 分段上传重试的基础间隔
+var s3RetryDelay = time.Second
+
+// s3Config S3兼容对象存储配置
+type s3Config struct {
+	Enabled            bool
+	Endpoint           string // 例如 http://minio:9000 或 https://s3.us-east-1.amazonaws.com
+	Region             string
+	Bucket             string
+	Prefix             string // 对象键前缀，对象键为 <prefix>/<taskID>/<产物路径>
+	AccessKey          string
+	SecretKey          string
+	SessionToken       string
+	PathStyle          bool          // 使用 endpoint/bucket/key 形式，MinIO需要开启
+	PublicURL          string        // 对外访问的基础地址，例如CDN，为空时使用endpoint
+	URLExpiry          time.Duration // 大于0时产物链接使用预签名URL
+	PartSize           int64
+	MultipartThreshold int64 // 超过该大小的文件使用分段上传
+}
+
+// s3ConfigFromViper 读取storage.s3.*配置
+func s3ConfigFromViper() s3Config {
+	cfg := s3Config{
+		Enabled:      viper.GetBool("storage.s3.enabled"),
+		Endpoint:     strings.TrimSuffix(viper.GetString("storage.s3.endpoint"), "/"),
+		Region:       viper.GetString("storage.s3.region"),
+		Bucket:       viper.GetString("storage.s3.bucket"),
+		Prefix:       strings.Trim(viper.GetString("storage.s3.prefix"), "/"),
+		AccessKey:    viper.GetString("storage.s3.access_key"),
+		SecretKey:    viper.GetString("storage.s3.secret_key"),
+		SessionToken: viper.GetString("storage.s3.session_token"),
+		PathStyle:    viper.GetBool("storage.s3.path_style"),
+		PublicURL:    strings.TrimSuffix(viper.GetString("storage.s3.public_url"), "/"),
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if expiry, err := time.ParseDuration(viper.GetString("storage.s3.url_expiry")); err == nil && expiry > 0 {
+		cfg.URLExpiry = expiry
+	}
+	cfg.PartSize, _ = parseByteSize(viper.GetString("storage.s3.part_size"))
+	cfg.MultipartThreshold, _ = parseByteSize(viper.GetString("storage.s3.multipart_threshold"))
+	return cfg
+}
+
+// s3Client 最小化的S3客户端，只实现上传产物所需的接口
+type s3Client struct {
+	cfg      s3Config
+	endpoint *url.URL
+	http     *http.Client
+	now      func() time.Time
+}
+
+// newS3Client 校验配置并创建客户端
+func newS3Client(cfg s3Config, httpClient *http.Client) (*s3Client, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("endpoint和bucket不能为空")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("access_key和secret_key不能为空")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("无效的endpoint: %s", cfg.Endpoint)
+	}
+	if cfg.PartSize < s3MinPartSize {
+		cfg.PartSize = 16 << 20
+	}
+	if cfg.MultipartThreshold <= 0 {
+		cfg.MultipartThreshold = 64 << 20
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 5 * time.Minute}
+	}
+	return &s3Client{cfg: cfg, endpoint: endpoint, http: httpClient, now: time.Now}, nil
+}
+
+// objectKey 任务产物的对象键
+func (s *s3Client) objectKey(taskID, rel string) string {
+	return path.Join(s.cfg.Prefix, taskID, rel)
+}
+
+// objectURL 对象的请求地址，路径按S3规则编码
+func (s *s3Client) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	escaped := s3EscapePath(key)
+	if s.cfg.PathStyle {
+		base := strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/"
+		u.Path = base + key
+		u.RawPath = base + escaped
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = "/" + key
+		u.RawPath = "/" + escaped
+	}
+	return &u
+}
+
+// publicURL 写入产物清单和结果回传的链接
+func (s *s3Client) publicURL(key string) string {
+	if s.cfg.URLExpiry > 0 {
+		return s.presign(http.MethodGet, key, s.cfg.URLExpiry)
+	}
+	if s.cfg.PublicURL != "" {
+		return s.cfg.PublicURL + "/" + s3EscapePath(key)
+	}
+	return s.objectURL(key).String()
+}
+
+// upload 上传本地文件，大文件使用分段上传，返回对外链接
+func (s *s3Client) upload(key, file string, size int64, contentType string) (string, error) {
+	var err error
+	if size > s.cfg.MultipartThreshold {
+		err = s.putMultipart(key, file, size, contentType)
+	} else {
+		err = s.putObject(key, file, contentType)
+	}
+	if err != nil {
+		return "", err
+	}
+	return s.publicURL(key), nil
+}
+
+// putObject 单次上传整个文件。先流式计算文件摘要用于签名，再从头读取文件作为请求体，
+// 不把文件整个读入内存
+func (s *s3Client) putObject(key, file, contentType string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	req, err := s.newStreamRequest(http.MethodPut, key, nil, header, io.NopCloser(f), hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	_, err = s.send(req)
+	return err
+}
+
+// s3Part 分段上传完成时提交的分段信息
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart 分段上传，任一分段失败时中止上传，避免残留未完成的分段
+func (s *s3Client) putMultipart(key, file string, size int64, contentType string) error {
+	partSize := s.cfg.PartSize
+	if size/partSize >= s3MaxParts {
+		partSize = size/(s3MaxParts-1) + 1
+	}
+
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return fmt.Errorf("创建分段上传失败: %v", err)
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &initiated); err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("无效的分段上传响应: %s", string(resp))
+	}
+	uploadID := initiated.UploadID
+
+	parts, err := s.uploadParts(key, uploadID, file, partSize)
+	if err == nil {
+		err = s.completeMultipart(key, uploadID, parts)
+	}
+	if err != nil {
+		if _, abortErr := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil); abortErr != nil {
+			logrus.Warnf("中止分段上传 %s 失败: %v", key, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *s3Client) uploadParts(key, uploadID, file string, partSize int64) ([]s3Part, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var parts []s3Part
+	buf := make([]byte, partSize)
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(f, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		etag, err := s.uploadPart(key, query, buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("上传第 %d 段失败: %v", number, err)
+		}
+		parts = append(parts, s3Part{PartNumber: number, ETag: etag})
+		if n < len(buf) {
+			break
+		}
+	}
+	return parts, nil
+}
+
+// uploadPart 上传单个分段，网络错误和5xx时重试
+func (s *s3Client) uploadPart(key string, query url.Values, body []byte) (string, error) {
+	var lastErr error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * s3RetryDelay)
+		}
+		req, err := s.newRequest(http.MethodPut, key, query, nil, body)
+		if err != nil {
+			return "", err
+		}
+		resp, err := s.http.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			lastErr = fmt.Errorf("状态码: %d, 响应: %s", resp.StatusCode, string(respBody))
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("状态码: %d, 响应: %s", resp.StatusCode, string(respBody))
+		}
+		return resp.Header.Get("ETag"), nil
+	}
+	return "", lastErr
+}
+
+func (s *s3Client) completeMultipart(key, uploadID string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, header, body)
+	if err != nil {
+		return fmt.Errorf("完成分段上传失败: %v", err)
+	}
+	// S3可能在200响应中返回错误
+	if bytes.Contains(resp, []byte("<Error>")) {
+		return fmt.Errorf("完成分段上传失败: %s", string(resp))
+	}
+	return nil
+}
+
+// do 发送签名请求，非2xx时返回包含响应内容的错误
+func (s *s3Client) do(method, key string, query url.Values, header http.Header, body []byte) ([]byte, error) {
+	req, err := s.newRequest(method, key, query, header, body)
+	if err != nil {
+		return nil, err
+	}
+	return s.send(req)
+}
+
+// send 发送已签名的请求，非2xx时返回包含响应内容的错误
+func (s *s3Client) send(req *http.Request) ([]byte, error) {
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("状态码: %d, 响应: %s", resp.StatusCode, string(respBody))
+	}
+	return respBody, nil
+}
+
+func (s *s3Client) newRequest(method, key string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	sum := sha256.Sum256(body)
+	return s.newStreamRequest(method, key, query, header, bytes.NewReader(body), hex.EncodeToString(sum[:]))
+}
+
+// newStreamRequest 以已计算好的摘要签名请求，body按需读取；
+// 长度无法从body得知时由调用方设置ContentLength，S3不接受分块传输
+func (s *s3Client) newStreamRequest(method, key string, query url.Values, header http.Header, body io.Reader, payloadHash string) (*http.Request, error) {
+	u := s.objectURL(key)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, payloadHash, s.now())
+	return req, nil
+}
+
+// sign 按AWS Signature Version 4为请求添加Authorization头
+func (s *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.cfg.SessionToken)
+	}
+
+	// 签名host、内容相关头和全部x-amz-*头
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" || name == "content-md5" || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := s.scope(amzDate)
+	signature := s.signature(amzDate, scope, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+// presign 生成预签名URL，持有者无需凭证即可在有效期内访问对象
+func (s *s3Client) presign(method, key string, expiry time.Duration) string {
+	u := s.objectURL(key)
+	amzDate := s.now().UTC().Format("20060102T150405Z")
+	scope := s.scope(amzDate)
+
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3Algorithm},
+		"X-Amz-Credential":    {s.cfg.AccessKey + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(expiry.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if s.cfg.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		s3CanonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+	query.Set("X-Amz-Signature", s.signature(amzDate, scope, canonicalRequest))
+	u.RawQuery = s3CanonicalQuery(query)
+	return u.String()
+}
+
+func (s *s3Client) scope(amzDate string) string {
+	return amzDate[:8] + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+func (s *s3Client) signature(amzDate, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, hex.EncodeToString(hash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), amzDate[:8])
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape 按SigV4规则编码，只保留未保留字符
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3EscapePath 逐段编码对象键，保留/
+func s3EscapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery 按键排序并编码查询参数
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uploadArtifacts 将任务产物上传到对象存储，并把对象链接写入产物清单
+func (a *Agent) uploadArtifacts(task *Task) {
+	current := task.snapshot().Artifacts
+	if a.storage == nil || current == nil || len(current.Files) == 0 {
+		return
+	}
+	// 在副本上写入链接，完成后替换，读取清单的接口不会看到写了一半的记录
+	manifest := &ArtifactManifest{Files: append([]Artifact(nil), current.Files...), TotalSize: current.TotalSize}
+	defer task.update(func(s *TaskStatus) { s.Artifacts = manifest })
+
+	uploaded := 0
+	for i := range manifest.Files {
+		artifact := &manifest.Files[i]
+		key := a.storage.objectKey(task.Status.ID, artifact.Path)
+		file := filepath.Join(task.OutputDir, filepath.FromSlash(artifact.Path))
+		link, err := a.storage.upload(key, file, artifact.Size, artifact.ContentType)
+		if err != nil {
+			artifact.UploadError = err.Error()
+			logrus.Warnf("上传任务 %s 的产物 %s 失败: %v", task.Status.ID, artifact.Path, err)
+			continue
+		}
+		artifact.URL = link
+		uploaded++
+	}
+	logrus.Infof("任务 %s 已上传 %d/%d 个产物到对象存储", task.Status.ID, uploaded, len(manifest.Files))
+}
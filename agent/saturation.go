@@ -0,0 +1,225 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// maxGeneratorSamples 单个任务保留的最大采样点数，超出后按间隔抽稀
+const maxGeneratorSamples = 720
+
+// throttleSaturationPercent 任务cgroup被限流的调度周期占比达到该值时视为饱和，
+// 说明k6需要的CPU超过了分配的上限
+const throttleSaturationPercent = 20
+
+// GeneratorSample 压测机在某一时刻的资源采样
+type GeneratorSample struct {
+	Timestamp         time.Time `json:"timestamp"`
+	HostCPUPercent    float64   `json:"host_cpu_percent"`
+	HostMemoryPercent float64   `json:"host_memory_percent"`
+	NetRxBytesPerSec  float64   `json:"net_rx_bytes_per_sec"`
+	NetTxBytesPerSec  float64   `json:"net_tx_bytes_per_sec"`
+	ProcessCPUPercent float64   `json:"process_cpu_percent"` // k6进程占整机CPU的百分比
+	ProcessRSSBytes   int64     `json:"process_rss_bytes"`
+	// 任务cgroup被限流的调度周期占比，未启用cgroup时为0
+	CPUThrottledPercent float64 `json:"cpu_throttled_percent"`
+}
+
+// GeneratorReport 一次任务运行期间压测机的饱和度报告
+type GeneratorReport struct {
+	Saturated        bool              `json:"saturated"`
+	CPUThreshold     float64           `json:"cpu_threshold"`
+	PeakHostCPU      float64           `json:"peak_host_cpu_percent"`
+	PeakProcessCPU   float64           `json:"peak_process_cpu_percent"`
+	PeakThrottled    float64           `json:"peak_cpu_throttled_percent"`
+	SaturatedSamples int               `json:"saturated_samples"`
+	Samples          []GeneratorSample `json:"samples"`
+}
+
+// generatorMonitor 在任务运行期间周期采样主机和k6进程资源。
+// 主机CPU达到阈值或任务cgroup持续被限流时判定饱和；k6进程CPU受cgroup限制，只采样不判定
+type generatorMonitor struct {
+	taskID      string
+	pid         int
+	cgroup      *taskCgroup // 为nil表示任务不在cgroup中
+	interval    time.Duration
+	threshold   float64
+	onSaturated func(sample GeneratorSample)
+
+	mu     sync.Mutex
+	report GeneratorReport
+	stride int // 抽稀后每隔stride个采样保留一个
+	skip   int
+
+	prevCPU  cpuTimes
+	prevRx   uint64
+	prevTx   uint64
+	prevProc float64
+	prevTime time.Time
+
+	prevPeriods   int64
+	prevThrottled int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newGeneratorMonitor 创建饱和度监控，threshold为0时只采样不判定
+func newGeneratorMonitor(taskID string, pid int, interval time.Duration, threshold float64) *generatorMonitor {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	return &generatorMonitor{
+		taskID:    taskID,
+		pid:       pid,
+		interval:  interval,
+		threshold: threshold,
+		report:    GeneratorReport{CPUThreshold: threshold},
+		stride:    1,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// start 记录基线并开始后台采样
+func (m *generatorMonitor) start() {
+	m.prevCPU, _ = readCPUTimes()
+	m.prevRx, m.prevTx, _ = readNetDevTotals()
+	m.prevProc, _, _ = readProcessStats(m.pid)
+	m.prevPeriods, m.prevThrottled, _ = m.cgroup.cpuThrottling()
+	m.prevTime = time.Now()
+
+	go m.run()
+}
+
+func (m *generatorMonitor) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.record(m.sample())
+		}
+	}
+}
+
+// sample 采集一次资源数据，速率类指标基于与上一次采样的差值
+func (m *generatorMonitor) sample() GeneratorSample {
+	now := time.Now()
+	elapsed := now.Sub(m.prevTime).Seconds()
+	m.prevTime = now
+
+	sample := GeneratorSample{Timestamp: now}
+
+	if cur, err := readCPUTimes(); err == nil {
+		sample.HostCPUPercent = cpuPercent(m.prevCPU, cur)
+		m.prevCPU = cur
+	}
+
+	if total, available, err := readMemoryUsage(); err == nil && total > 0 {
+		sample.HostMemoryPercent = float64(total-available) / float64(total) * 100
+	}
+
+	if rx, tx, err := readNetDevTotals(); err == nil && elapsed > 0 {
+		if rx >= m.prevRx && tx >= m.prevTx {
+			sample.NetRxBytesPerSec = float64(rx-m.prevRx) / elapsed
+			sample.NetTxBytesPerSec = float64(tx-m.prevTx) / elapsed
+		}
+		m.prevRx, m.prevTx = rx, tx
+	}
+
+	if cpuSeconds, rss, err := readProcessStats(m.pid); err == nil && elapsed > 0 {
+		sample.ProcessCPUPercent = (cpuSeconds - m.prevProc) / elapsed / float64(runtime.NumCPU()) * 100
+		sample.ProcessRSSBytes = rss
+		m.prevProc = cpuSeconds
+	}
+
+	if periods, throttled, ok := m.cgroup.cpuThrottling(); ok {
+		if periods > m.prevPeriods && throttled >= m.prevThrottled {
+			sample.CPUThrottledPercent = float64(throttled-m.prevThrottled) / float64(periods-m.prevPeriods) * 100
+		}
+		m.prevPeriods, m.prevThrottled = periods, throttled
+	}
+
+	return sample
+}
+
+// record 保存采样并判定是否饱和
+func (m *generatorMonitor) record(sample GeneratorSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sample.HostCPUPercent > m.report.PeakHostCPU {
+		m.report.PeakHostCPU = sample.HostCPUPercent
+	}
+	if sample.ProcessCPUPercent > m.report.PeakProcessCPU {
+		m.report.PeakProcessCPU = sample.ProcessCPUPercent
+	}
+	if sample.CPUThrottledPercent > m.report.PeakThrottled {
+		m.report.PeakThrottled = sample.CPUThrottledPercent
+	}
+
+	hostSaturated := m.threshold > 0 && sample.HostCPUPercent >= m.threshold
+	if hostSaturated || sample.CPUThrottledPercent >= throttleSaturationPercent {
+		m.report.SaturatedSamples++
+		if !m.report.Saturated {
+			m.report.Saturated = true
+			logrus.Warnf("任务 %s 压测机CPU达到 %.1f%%（阈值 %.1f%%），cgroup限流 %.1f%%，结果可能失真",
+				m.taskID, sample.HostCPUPercent, m.threshold, sample.CPUThrottledPercent)
+			if m.onSaturated != nil {
+				m.onSaturated(sample)
+			}
+		}
+	}
+
+	// 峰值和饱和次数基于全部采样，时间序列按stride抽稀
+	m.skip++
+	if m.skip < m.stride {
+		return
+	}
+	m.skip = 0
+	m.report.Samples = append(m.report.Samples, sample)
+	if len(m.report.Samples) >= maxGeneratorSamples {
+		kept := m.report.Samples[:0]
+		for i := 0; i < len(m.report.Samples); i += 2 {
+			kept = append(kept, m.report.Samples[i])
+		}
+		m.report.Samples = kept
+		m.stride *= 2
+	}
+}
+
+// finish 停止采样并返回报告，结束前补采一次，保证短任务也有数据
+func (m *generatorMonitor) finish() *GeneratorReport {
+	close(m.stop)
+	<-m.done
+	m.record(m.sample())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	report := m.report
+	return &report
+}
+
+// startGeneratorMonitor 为运行中的k6进程启动饱和度监控，阈值使用任务生效的CPU限制
+func (a *Agent) startGeneratorMonitor(task *Task, pid int, onSaturated func(sample GeneratorSample)) *generatorMonitor {
+	interval, err := time.ParseDuration(viper.GetString("monitoring.generator_sample_interval"))
+	if err != nil {
+		interval = 5 * time.Second
+	}
+
+	m := newGeneratorMonitor(task.Status.ID, pid, interval, task.Limits.MaxCPUPercent)
+	m.cgroup = task.Cgroup
+	m.onSaturated = onSaturated
+	m.start()
+	return m
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneratorMonitorSaturation(t *testing.T) {
+	m := newGeneratorMonitor("task-sat", 0, time.Second, 80)
+	var alerts int
+	m.onSaturated = func(sample GeneratorSample) { alerts++ }
+
+	m.record(GeneratorSample{HostCPUPercent: 40, ProcessCPUPercent: 30})
+	assert.False(t, m.report.Saturated)
+
+	m.record(GeneratorSample{HostCPUPercent: 95, ProcessCPUPercent: 70})
+	// k6进程CPU受cgroup限制，达到阈值不代表压测机饱和
+	m.record(GeneratorSample{HostCPUPercent: 60, ProcessCPUPercent: 85})
+	// cgroup持续限流说明k6需要更多CPU
+	m.record(GeneratorSample{HostCPUPercent: 60, ProcessCPUPercent: 80, CPUThrottledPercent: 40})
+	assert.True(t, m.report.Saturated)
+	assert.Equal(t, 2, m.report.SaturatedSamples)
+	assert.Equal(t, float64(95), m.report.PeakHostCPU)
+	assert.Equal(t, float64(85), m.report.PeakProcessCPU)
+	assert.Equal(t, float64(40), m.report.PeakThrottled)
+	assert.Equal(t, 1, alerts, "只在首次超过阈值时告警")
+	assert.Len(t, m.report.Samples, 4)
+}
+
+func TestGeneratorMonitorDownsample(t *testing.T) {
+	m := newGeneratorMonitor("task-ds", 0, time.Second, 0)
+	for i := 0; i < maxGeneratorSamples*2; i++ {
+		m.record(GeneratorSample{HostCPUPercent: 99})
+	}
+
+	assert.False(t, m.report.Saturated, "阈值为0时不判定饱和")
+	assert.Less(t, len(m.report.Samples), maxGeneratorSamples)
+	assert.Greater(t, len(m.report.Samples), maxGeneratorSamples/4)
+}
+
+func TestGeneratorMonitorSamplesProcess(t *testing.T) {
+	m := newGeneratorMonitor("task-self", os.Getpid(), 10*time.Millisecond, 0)
+	m.start()
+	time.Sleep(50 * time.Millisecond)
+	report := m.finish()
+
+	assert.NotEmpty(t, report.Samples)
+	if runtime.GOOS == "linux" {
+		last := report.Samples[len(report.Samples)-1]
+		assert.Greater(t, last.ProcessRSSBytes, int64(0))
+		assert.Greater(t, last.HostMemoryPercent, float64(0))
+	}
+}
+
+func TestGeneratorMonitorUsesTaskLimits(t *testing.T) {
+	agent := setupTestAgent()
+	agent.defaultLimits.MaxCPUPercent = 80
+	task := newTestTask(t, agent, &Job{ID: "task-limits", Type: "k6"})
+	job := &Job{ID: "task-limits", Params: map[string]interface{}{"resources": map[string]interface{}{"max_cpu_percent": 50}}}
+	require.NoError(t, agent.setupTaskCgroup(task, job))
+
+	m := agent.startGeneratorMonitor(task, os.Getpid(), nil)
+	m.finish()
+	assert.Equal(t, float64(50), m.threshold)
+}
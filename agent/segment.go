@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// 分布式k6任务：同一个逻辑任务按执行段拆分到多个Agent，每个Agent只产生自己那一段的负载。
+// 执行段的写法与k6一致，位置可以是分数(1/4)、小数(0.25)或百分比(25%)。
+
+// parseSegmentValue 解析执行段中的一个位置，必须在[0,1]之间
+func parseSegmentValue(s string) (*big.Rat, error) {
+	s = strings.TrimSpace(s)
+	percent := strings.HasSuffix(s, "%")
+	if percent {
+		s = strings.TrimSuffix(s, "%")
+	}
+	v, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("无法解析%q", s)
+	}
+	if percent {
+		v.Quo(v, big.NewRat(100, 1))
+	}
+	if v.Sign() < 0 || v.Cmp(big.NewRat(1, 1)) > 0 {
+		return nil, fmt.Errorf("%s超出0到1的范围", v.RatString())
+	}
+	return v, nil
+}
+
+// parseExecutionSegment 解析"from:to"，只有一个值时表示"0:to"
+func parseExecutionSegment(s string) (from, to *big.Rat, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 2 {
+		return nil, nil, fmt.Errorf("执行段%q格式应为from:to", s)
+	}
+	from = new(big.Rat)
+	if len(parts) == 2 {
+		if from, err = parseSegmentValue(parts[0]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if to, err = parseSegmentValue(parts[len(parts)-1]); err != nil {
+		return nil, nil, err
+	}
+	if from.Cmp(to) >= 0 {
+		return nil, nil, fmt.Errorf("执行段%q的起点必须小于终点", s)
+	}
+	return from, to, nil
+}
+
+// parseSegmentSequence 解析逗号分隔的执行段序列，位置必须严格递增
+func parseSegmentSequence(s string) ([]*big.Rat, error) {
+	var sequence []*big.Rat
+	for _, part := range strings.Split(s, ",") {
+		v, err := parseSegmentValue(part)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(sequence); n > 0 && sequence[n-1].Cmp(v) >= 0 {
+			return nil, fmt.Errorf("执行段序列%q必须严格递增", s)
+		}
+		sequence = append(sequence, v)
+	}
+	if len(sequence) < 2 {
+		return nil, fmt.Errorf("执行段序列%q至少需要两个位置", s)
+	}
+	return sequence, nil
+}
+
+// checkExecutionSegment 校验执行段及序列，出错时返回出错的部分("segment"或"sequence")
+func checkExecutionSegment(segment, sequence string) (string, error) {
+	if segment == "" {
+		if sequence != "" {
+			return "segment", fmt.Errorf("设置执行段序列时必须同时设置执行段")
+		}
+		return "", nil
+	}
+	from, to, err := parseExecutionSegment(segment)
+	if err != nil {
+		return "segment", err
+	}
+	if sequence == "" {
+		return "", nil
+	}
+	values, err := parseSegmentSequence(sequence)
+	if err != nil {
+		return "sequence", err
+	}
+	// k6要求执行段是序列中相邻的两个位置
+	for i := 0; i+1 < len(values); i++ {
+		if values[i].Cmp(from) == 0 && values[i+1].Cmp(to) == 0 {
+			return "", nil
+		}
+	}
+	return "segment", fmt.Errorf("执行段%q不是序列%q中相邻的两个位置", segment, sequence)
+}
+
+// segmentID 分段结果的标识，未指定时使用执行段本身
+func (j *Job) segmentID() string {
+	if j.SegmentID != "" || j.ExecutionSegment == "" {
+		return j.SegmentID
+	}
+	return j.ExecutionSegment
+}
+
+// k6SegmentArgs 执行段对应的k6命令行参数
+func k6SegmentArgs(segment, sequence string) []string {
+	var args []string
+	if segment != "" {
+		args = append(args, "--execution-segment", segment)
+	}
+	if sequence != "" {
+		args = append(args, "--execution-segment-sequence", sequence)
+	}
+	return args
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckExecutionSegment(t *testing.T) {
+	cases := []struct {
+		segment, sequence string
+		part              string // 期望出错的部分，为空表示有效
+	}{
+		{"1/4:2/4", "0,1/4,2/4,3/4,1", ""},
+		{"25%:50%", "0,0.25,0.5,1", ""},
+		{"0:1/3", "", ""},
+		{"1/2", "", ""}, // 等同于0:1/2
+		{"", "", ""},
+		{"", "0,1/2,1", "segment"},
+		{"2/4:1/4", "", "segment"},
+		{"0:5/4", "", "segment"},
+		{"a:b", "", "segment"},
+		{"1/4:3/4", "0,1/4,2/4,3/4,1", "segment"}, // 不是相邻位置
+		{"0:1/2", "0,1/2,1/4,1", "sequence"},
+		{"0:1", "1", "sequence"},
+	}
+	for _, tc := range cases {
+		part, err := checkExecutionSegment(tc.segment, tc.sequence)
+		if tc.part == "" {
+			assert.NoError(t, err, "%s | %s", tc.segment, tc.sequence)
+		} else {
+			assert.Error(t, err, "%s | %s", tc.segment, tc.sequence)
+			assert.Equal(t, tc.part, part, "%s | %s", tc.segment, tc.sequence)
+		}
+	}
+}
+
+func TestSegmentedK6Job(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("依赖/bin/sh")
+	}
+	dir := t.TempDir()
+	viper.Set("resources.workspace_dir", dir)
+	defer viper.Set("resources.workspace_dir", "")
+
+	// 记录命令行参数的k6
+	fakeK6 := filepath.Join(dir, "k6")
+	require.NoError(t, os.WriteFile(fakeK6, []byte("#!/bin/sh\necho \"$@\" > \"$K6_AGENT_OUTPUT_DIR/args.txt\"\n"), 0755))
+	viper.Set("k6.binary", fakeK6)
+	defer viper.Set("k6.binary", "k6")
+
+	results := make(chan JobResultRequest, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/agents/jobs/result" {
+			var req JobResultRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			results <- req
+		}
+	}))
+	defer backend.Close()
+
+	agent := setupTestAgent()
+	agent.serverURL = backend.URL
+	job := &Job{
+		ID:                       "seg-task",
+		Type:                     "k6",
+		ScriptContent:            "export default function() {}",
+		ExecutionSegment:         "1/4:2/4",
+		ExecutionSegmentSequence: "0,1/4,2/4,3/4,1",
+		SegmentID:                "part-2",
+	}
+	task := newTestTask(t, agent, job)
+	agent.runTask(task, job)
+
+	assert.Equal(t, "completed", task.Status.Status, task.Status.Error)
+	args, err := os.ReadFile(filepath.Join(taskOutputDir(job.ID), "args.txt"))
+	require.NoError(t, err)
+	assert.Contains(t, string(args), "--execution-segment 1/4:2/4 --execution-segment-sequence 0,1/4,2/4,3/4,1")
+
+	result := <-results
+	assert.Equal(t, "part-2", result.SegmentID)
+	assert.Equal(t, "1/4:2/4", result.ExecutionSegment)
+	assert.Equal(t, "part-2", agent.jobOutputTags(job)["segment"])
+
+	// 无效的执行段在启动k6前失败
+	bad := &Job{ID: "bad-seg", Type: "k6", ScriptContent: "x", ExecutionSegment: "1/4:3/4", ExecutionSegmentSequence: "0,1/4,2/4,3/4,1"}
+	badTask := newTestTask(t, agent, bad)
+	agent.runTask(badTask, bad)
+	assert.Equal(t, "failed", badTask.Status.Status)
+	assert.Contains(t, badTask.Status.Error, "执行段配置无效")
+	<-results
+}
@@ -0,0 +1,230 @@
+// Package sketch 可合并的延迟分布草图。
+//
+// 多个Agent各自上报p95后再取平均得到的并不是整体的p95。草图按对数间隔分桶记录每个值，
+// 桶边界只取决于相对精度，因此相同精度的草图可以逐桶相加合并，合并后的分位数与把所有
+// 原始数据放在一起计算的结果误差不超过相对精度（与HDR直方图、DDSketch的思路相同）。
+package sketch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DefaultRelativeAccuracy 默认相对精度，1%表示分位数的误差不超过真实值的1%
+const DefaultRelativeAccuracy = 0.01
+
+// minIndexable 小于等于该值的数据计入零桶
+const minIndexable = 1e-9
+
+// Sketch 对数分桶的延迟草图，非并发安全
+type Sketch struct {
+	accuracy float64
+	gamma    float64
+	logGamma float64
+
+	counts map[int]uint64 // 桶i覆盖(gamma^(i-1), gamma^i]
+	zero   uint64
+	count  uint64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+// New 创建指定相对精度的草图，精度必须在(0,1)之间
+func New(relativeAccuracy float64) (*Sketch, error) {
+	if !(relativeAccuracy > 0 && relativeAccuracy < 1) {
+		return nil, fmt.Errorf("相对精度必须在0到1之间: %v", relativeAccuracy)
+	}
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	return &Sketch{
+		accuracy: relativeAccuracy,
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		counts:   make(map[int]uint64),
+		min:      math.Inf(1),
+		max:      math.Inf(-1),
+	}, nil
+}
+
+// RelativeAccuracy 草图的相对精度
+func (s *Sketch) RelativeAccuracy() float64 { return s.accuracy }
+
+// Count 记录的数据个数
+func (s *Sketch) Count() uint64 { return s.count }
+
+// Sum 记录的数据之和
+func (s *Sketch) Sum() float64 { return s.sum }
+
+// Min 最小值，没有数据时为0
+func (s *Sketch) Min() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.min
+}
+
+// Max 最大值，没有数据时为0
+func (s *Sketch) Max() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.max
+}
+
+// Mean 平均值，没有数据时为0
+func (s *Sketch) Mean() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.sum / float64(s.count)
+}
+
+// Add 记录一个值，负数和NaN计入零桶
+func (s *Sketch) Add(v float64) {
+	if math.IsNaN(v) {
+		v = 0
+	}
+	if v > minIndexable {
+		s.counts[s.index(v)]++
+	} else {
+		s.zero++
+	}
+	s.count++
+	s.sum += v
+	s.min = math.Min(s.min, v)
+	s.max = math.Max(s.max, v)
+}
+
+func (s *Sketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value 桶i的代表值，与桶内任意值的相对误差不超过相对精度
+func (s *Sketch) value(i int) float64 {
+	return 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+}
+
+// Merge 把other的数据合并进来，两者的相对精度必须相同
+func (s *Sketch) Merge(other *Sketch) error {
+	if other == nil || other.count == 0 {
+		return nil
+	}
+	if other.accuracy != s.accuracy {
+		return fmt.Errorf("相对精度不一致，无法合并: %v 和 %v", s.accuracy, other.accuracy)
+	}
+	for i, n := range other.counts {
+		s.counts[i] += n
+	}
+	s.zero += other.zero
+	s.count += other.count
+	s.sum += other.sum
+	s.min = math.Min(s.min, other.min)
+	s.max = math.Max(s.max, other.max)
+	return nil
+}
+
+// Quantile 估计分位数，q在[0,1]之间，没有数据时为0
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return s.min
+	}
+	if q >= 1 {
+		return s.max
+	}
+
+	rank := q * float64(s.count-1)
+	cumulative := float64(s.zero)
+	if cumulative > rank {
+		return s.clamp(0)
+	}
+	keys := s.sortedKeys()
+	for _, i := range keys {
+		cumulative += float64(s.counts[i])
+		if cumulative > rank {
+			return s.clamp(s.value(i))
+		}
+	}
+	return s.max
+}
+
+func (s *Sketch) clamp(v float64) float64 {
+	return math.Max(s.min, math.Min(s.max, v))
+}
+
+func (s *Sketch) sortedKeys() []int {
+	keys := make([]int, 0, len(s.counts))
+	for i := range s.counts {
+		keys = append(keys, i)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// encoded 草图的JSON格式：counts为从offset开始的连续桶计数
+type encoded struct {
+	RelativeAccuracy float64  `json:"relative_accuracy"`
+	Count            uint64   `json:"count"`
+	Sum              float64  `json:"sum"`
+	Min              float64  `json:"min"`
+	Max              float64  `json:"max"`
+	ZeroCount        uint64   `json:"zero_count,omitempty"`
+	Offset           int      `json:"offset"`
+	Counts           []uint64 `json:"counts"`
+}
+
+// MarshalJSON 实现json.Marshaler
+func (s *Sketch) MarshalJSON() ([]byte, error) {
+	e := encoded{
+		RelativeAccuracy: s.accuracy,
+		Count:            s.count,
+		Sum:              s.sum,
+		Min:              s.Min(),
+		Max:              s.Max(),
+		ZeroCount:        s.zero,
+		Counts:           []uint64{},
+	}
+	if keys := s.sortedKeys(); len(keys) > 0 {
+		e.Offset = keys[0]
+		e.Counts = make([]uint64, keys[len(keys)-1]-keys[0]+1)
+		for _, i := range keys {
+			e.Counts[i-e.Offset] = s.counts[i]
+		}
+	}
+	return json.Marshal(e)
+}
+
+// UnmarshalJSON 实现json.Unmarshaler，并校验计数是否一致
+func (s *Sketch) UnmarshalJSON(data []byte) error {
+	var e encoded
+	if err := json.Unmarshal(data, &e); err != nil {
+		return err
+	}
+	decoded, err := New(e.RelativeAccuracy)
+	if err != nil {
+		return err
+	}
+	total := e.ZeroCount
+	for j, n := range e.Counts {
+		if n > 0 {
+			decoded.counts[e.Offset+j] = n
+			total += n
+		}
+	}
+	if total != e.Count {
+		return fmt.Errorf("草图计数不一致: count为%d，各桶之和为%d", e.Count, total)
+	}
+	decoded.zero = e.ZeroCount
+	decoded.count = e.Count
+	decoded.sum = e.Sum
+	if e.Count > 0 {
+		decoded.min = e.Min
+		decoded.max = e.Max
+	}
+	*s = *decoded
+	return nil
+}
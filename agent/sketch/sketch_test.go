@@ -0,0 +1,85 @@
+package sketch
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func TestMergedQuantilesMatchGlobalData(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var all []float64
+	parts := make([]*Sketch, 3)
+	for p := range parts {
+		parts[p], _ = New(DefaultRelativeAccuracy)
+		// 各Agent的延迟分布不同，第三台明显更慢
+		scale := []float64{20, 50, 400}[p]
+		for i := 0; i < 20000; i++ {
+			v := scale * math.Exp(rng.NormFloat64()*0.5)
+			parts[p].Add(v)
+			all = append(all, v)
+		}
+	}
+	sort.Float64s(all)
+
+	merged, _ := New(DefaultRelativeAccuracy)
+	for _, part := range parts {
+		require.NoError(t, merged.Merge(part))
+	}
+	assert.Equal(t, uint64(len(all)), merged.Count())
+	assert.Equal(t, all[0], merged.Min())
+	assert.Equal(t, all[len(all)-1], merged.Max())
+
+	for _, q := range []float64{0.5, 0.9, 0.95, 0.99, 0.999} {
+		exact := exactQuantile(all, q)
+		assert.InEpsilon(t, exact, merged.Quantile(q), DefaultRelativeAccuracy*1.01, "p%v", q*100)
+	}
+
+	// 各段p99取平均与真实的p99相差很远
+	var avg float64
+	for _, part := range parts {
+		avg += part.Quantile(0.99) / 3
+	}
+	assert.Greater(t, math.Abs(avg-exactQuantile(all, 0.99))/exactQuantile(all, 0.99), 0.2)
+}
+
+func TestSketchJSONRoundTrip(t *testing.T) {
+	s, _ := New(0.02)
+	for _, v := range []float64{0, 0.5, 1, 12.3, 250, 250, 9000} {
+		s.Add(v)
+	}
+	data, err := json.Marshal(s)
+	require.NoError(t, err)
+
+	var decoded Sketch
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, s.Count(), decoded.Count())
+	assert.Equal(t, s.Sum(), decoded.Sum())
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 1} {
+		assert.Equal(t, s.Quantile(q), decoded.Quantile(q))
+	}
+
+	// 计数被篡改
+	assert.Error(t, json.Unmarshal([]byte(`{"relative_accuracy":0.01,"count":5,"offset":0,"counts":[1,1]}`), &decoded))
+	assert.Error(t, json.Unmarshal([]byte(`{"relative_accuracy":2,"count":0,"counts":[]}`), &decoded))
+}
+
+func TestMergeRequiresSameAccuracy(t *testing.T) {
+	a, _ := New(0.01)
+	b, _ := New(0.02)
+	b.Add(1)
+	assert.Error(t, a.Merge(b))
+
+	empty, _ := New(0.01)
+	assert.Equal(t, 0.0, empty.Quantile(0.99))
+	assert.NoError(t, a.Merge(empty))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"k6-agent/sketch"
+)
+
+// defaultSketchQuantiles 合并接口未指定分位数时返回的分位数
+var defaultSketchQuantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// sketchConfig k6.latency_sketches配置
+type sketchConfig struct {
+	Enabled          bool
+	RelativeAccuracy float64
+	Metrics          []string // 为空时记录所有trend类型的指标
+}
+
+func sketchConfigFromViper() sketchConfig {
+	cfg := sketchConfig{
+		Enabled:          viper.GetBool("k6.latency_sketches.enabled"),
+		RelativeAccuracy: viper.GetFloat64("k6.latency_sketches.relative_accuracy"),
+		Metrics:          viper.GetStringSlice("k6.latency_sketches.metrics"),
+	}
+	if !(cfg.RelativeAccuracy > 0 && cfg.RelativeAccuracy < 1) {
+		cfg.RelativeAccuracy = sketch.DefaultRelativeAccuracy
+	}
+	return cfg
+}
+
+// k6Sketches 从k6数据点构建各trend指标的延迟草图，随任务结果上报供后端合并
+type k6Sketches struct {
+	cfg sketchConfig
+
+	mu       sync.Mutex
+	sketches map[string]*sketch.Sketch
+}
+
+func newK6Sketches(cfg sketchConfig) *k6Sketches {
+	return &k6Sketches{cfg: cfg, sketches: make(map[string]*sketch.Sketch)}
+}
+
+// addSample 记录trend类型的数据点
+func (k *k6Sketches) addSample(sample *k6Sample) {
+	if sample.Type != "trend" {
+		return
+	}
+	if len(k.cfg.Metrics) > 0 && !containsString(k.cfg.Metrics, sample.Metric) {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, ok := k.sketches[sample.Metric]
+	if !ok {
+		s, _ = sketch.New(k.cfg.RelativeAccuracy)
+		k.sketches[sample.Metric] = s
+	}
+	s.Add(sample.Value)
+}
+
+// result 任务结束后的草图，没有数据时返回nil
+func (k *k6Sketches) result() map[string]*sketch.Sketch {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.sketches) == 0 {
+		return nil
+	}
+	result := make(map[string]*sketch.Sketch, len(k.sketches))
+	for name, s := range k.sketches {
+		result[name] = s
+	}
+	return result
+}
+
+// SketchMergeRequest 合并多个任务的延迟草图
+type SketchMergeRequest struct {
+	TaskIDs   []string                    `json:"taskIds"`   // 本Agent上的任务
+	Sketches  []map[string]*sketch.Sketch `json:"sketches"`  // 其他Agent上报的草图，即结果中的latency_sketches
+	Metrics   []string                    `json:"metrics"`   // 只合并这些指标，为空时合并全部
+	Quantiles []float64                   `json:"quantiles"` // 例如0.99，默认p50、p90、p95、p99
+}
+
+// MergedMetric 合并后的单个指标
+type MergedMetric struct {
+	Count       uint64             `json:"count"`
+	Min         float64            `json:"min"`
+	Max         float64            `json:"max"`
+	Avg         float64            `json:"avg"`
+	Percentiles map[string]float64 `json:"percentiles"` // 键与k6摘要一致，例如"p(99)"
+	Sketch      *sketch.Sketch     `json:"sketch"`      // 合并后的草图，可以继续合并
+}
+
+// mergeSketches 按指标合并草图并计算分位数
+func mergeSketches(sets []map[string]*sketch.Sketch, metrics []string, quantiles []float64) (map[string]*MergedMetric, error) {
+	merged := make(map[string]*sketch.Sketch)
+	for _, set := range sets {
+		for name, s := range set {
+			if s == nil || (len(metrics) > 0 && !containsString(metrics, name)) {
+				continue
+			}
+			target, ok := merged[name]
+			if !ok {
+				target, _ = sketch.New(s.RelativeAccuracy())
+				merged[name] = target
+			}
+			if err := target.Merge(s); err != nil {
+				return nil, fmt.Errorf("指标 %s: %v", name, err)
+			}
+		}
+	}
+
+	result := make(map[string]*MergedMetric, len(merged))
+	for name, s := range merged {
+		m := &MergedMetric{
+			Count:       s.Count(),
+			Min:         s.Min(),
+			Max:         s.Max(),
+			Avg:         s.Mean(),
+			Percentiles: make(map[string]float64, len(quantiles)),
+			Sketch:      s,
+		}
+		for _, q := range quantiles {
+			m.Percentiles["p("+strconv.FormatFloat(q*100, 'f', -1, 64)+")"] = s.Quantile(q)
+		}
+		result[name] = m
+	}
+	return result, nil
+}
+
+// MergeSketches 合并本Agent任务和请求中携带的延迟草图，得到整体的分位数
+func (a *Agent) MergeSketches(c *gin.Context) {
+	var req SketchMergeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "无效的请求参数: " + err.Error()})
+		return
+	}
+	if len(req.TaskIDs) == 0 && len(req.Sketches) == 0 {
+		c.JSON(400, gin.H{"error": "需要taskIds或sketches", "field": "taskIds"})
+		return
+	}
+	quantiles := req.Quantiles
+	if len(quantiles) == 0 {
+		quantiles = defaultSketchQuantiles
+	}
+	for _, q := range quantiles {
+		if q < 0 || q > 1 {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("分位数必须在0到1之间: %v", q), "field": "quantiles"})
+			return
+		}
+	}
+
+	sets := append([]map[string]*sketch.Sketch(nil), req.Sketches...)
+	a.tasksMu.RLock()
+	for _, id := range req.TaskIDs {
+		task, ok := a.tasks[id]
+		if !ok {
+			a.tasksMu.RUnlock()
+			c.JSON(404, gin.H{"error": "任务不存在", "taskId": id})
+			return
+		}
+		sketches := task.snapshot().LatencySketches
+		if sketches == nil {
+			a.tasksMu.RUnlock()
+			c.JSON(409, gin.H{"error": "任务还没有延迟草图", "taskId": id})
+			return
+		}
+		sets = append(sets, sketches)
+	}
+	a.tasksMu.RUnlock()
+
+	merged, err := mergeSketches(sets, req.Metrics, quantiles)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "合并失败: " + err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"sources": len(sets), "metrics": merged})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k6-agent/sketch"
+)
+
+// fakeK6Trend 把first..first+99毫秒的http_req_duration写入--out json指定的文件
+const fakeK6Trend = `#!/bin/sh
+for a in "$@"; do case "$a" in json=*) out="${a#json=}";; esac; done
+echo '{"type":"Metric","metric":"http_req_duration","data":{"type":"trend"}}' > "$out"
+echo '{"type":"Metric","metric":"http_reqs","data":{"type":"counter"}}' >> "$out"
+for i in $(seq $FIRST $(($FIRST + 99))); do
+  echo "{\"type\":\"Point\",\"metric\":\"http_req_duration\",\"data\":{\"time\":\"2024-01-01T00:00:00Z\",\"value\":$i}}" >> "$out"
+  echo '{"type":"Point","metric":"http_reqs","data":{"time":"2024-01-01T00:00:00Z","value":1}}' >> "$out"
+done
+`
+
+func TestLatencySketchesMergeAcrossTasks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("依赖/bin/sh")
+	}
+	dir := t.TempDir()
+	viper.Set("resources.workspace_dir", dir)
+	defer viper.Set("resources.workspace_dir", "")
+
+	fakeK6 := filepath.Join(dir, "k6")
+	require.NoError(t, os.WriteFile(fakeK6, []byte(fakeK6Trend), 0755))
+	viper.Set("k6.binary", fakeK6)
+	defer viper.Set("k6.binary", "k6")
+	viper.Set("k6.latency_sketches.enabled", true)
+	defer viper.Set("k6.latency_sketches.enabled", false)
+
+	agent := setupTestAgent()
+	run := func(id, first string) *Task {
+		t.Setenv("FIRST", first)
+		job := &Job{ID: id, Type: "k6", ScriptContent: "export default function() {}"}
+		task := newTestTask(t, agent, job)
+		agent.runTask(task, job)
+		require.Equal(t, "completed", task.Status.Status, task.Status.Error)
+		return task
+	}
+	fast := run("fast-task", "1")
+	slow := run("slow-task", "1000")
+
+	// 只记录trend指标
+	require.Contains(t, fast.Status.LatencySketches, "http_req_duration")
+	assert.NotContains(t, fast.Status.LatencySketches, "http_reqs")
+	assert.Equal(t, uint64(100), fast.Status.LatencySketches["http_req_duration"].Count())
+
+	// 另一台Agent上报的草图经过JSON往返后与本地任务合并
+	remote, err := json.Marshal(slow.Status.LatencySketches)
+	require.NoError(t, err)
+	body := `{"taskIds": ["fast-task"], "sketches": [` + string(remote) + `], "quantiles": [0.5, 0.99]}`
+
+	router := gin.New()
+	router.POST("/sketches/merge", agent.MergeSketches)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/sketches/merge", bytes.NewBufferString(body)))
+	require.Equal(t, 200, w.Code, w.Body.String())
+
+	var resp struct {
+		Sources int                      `json:"sources"`
+		Metrics map[string]*MergedMetric `json:"metrics"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 2, resp.Sources)
+	merged := resp.Metrics["http_req_duration"]
+	require.NotNil(t, merged)
+	assert.Equal(t, uint64(200), merged.Count)
+	assert.Equal(t, 1.0, merged.Min)
+	assert.Equal(t, 1099.0, merged.Max)
+	assert.InEpsilon(t, 100, merged.Percentiles["p(50)"], sketch.DefaultRelativeAccuracy)
+	assert.InEpsilon(t, 1097, merged.Percentiles["p(99)"], sketch.DefaultRelativeAccuracy)
+	assert.Equal(t, uint64(200), merged.Sketch.Count())
+
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{`{}`, 400},
+		{`{"taskIds": ["missing"]}`, 404},
+		{`{"taskIds": ["fast-task"], "quantiles": [99]}`, 400},
+		{`{"sketches": [{"http_req_duration": {"relative_accuracy": 0.05, "count": 1, "offset": 0, "counts": [1]}}], "taskIds": ["fast-task"]}`, 400},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/sketches/merge", bytes.NewBufferString(tc.body)))
+		assert.Equal(t, tc.code, w.Code, tc.body)
+	}
+}
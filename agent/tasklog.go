@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// 日志级别，按严重程度排序
+var logLevelRank = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// k6及多数工具输出中的 level=xxx 字段
+var outputLevelPattern = regexp.MustCompile(`level=(\w+)`)
+
+// LogEntry 一条结构化任务日志
+type LogEntry struct {
+	Seq     int64     `json:"seq"`
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`  // debug, info, warn, error
+	Source  string    `json:"source"` // agent, stdout, stderr
+	Message string    `json:"message"`
+}
+
+// String 格式化为单行文本，用于实时推送和结果回传
+func (e LogEntry) String() string {
+	timestamp := e.Time.Format("2006-01-02 15:04:05")
+	if e.Source == "" || e.Source == "agent" {
+		return fmt.Sprintf("[%s] %s", timestamp, e.Message)
+	}
+	return fmt.Sprintf("[%s] [%s] %s", timestamp, e.Source, e.Message)
+}
+
+// taskLogConfig 任务日志存储配置
+type taskLogConfig struct {
+	Dir         string // 日志文件目录，为空时只保留内存尾部
+	MaxFileSize int64  // 单个文件上限，超过后轮转
+	MaxFiles    int    // 保留的文件数，超出后删除最旧的文件
+	TailLines   int    // 内存中保留的最近日志条数
+}
+
+// taskLogConfigFromViper 读取log.task_*配置，日志目录位于任务工作目录下的logs
+func taskLogConfigFromViper(taskID string) taskLogConfig {
+	maxSize, err := parseByteSize(viper.GetString("log.task_max_file_size"))
+	if err != nil || maxSize <= 0 {
+		maxSize = 10 << 20
+	}
+	maxFiles := viper.GetInt("log.task_max_files")
+	if maxFiles <= 0 {
+		maxFiles = 5
+	}
+	tailLines := viper.GetInt("log.task_tail_lines")
+	if tailLines <= 0 {
+		tailLines = 500
+	}
+	return taskLogConfig{
+		Dir:         filepath.Join(taskWorkspace(taskID), "logs"),
+		MaxFileSize: maxSize,
+		MaxFiles:    maxFiles,
+		TailLines:   tailLines,
+	}
+}
+
+// logSegment 一个日志文件，文件名包含其第一条日志的序号
+type logSegment struct {
+	path     string
+	firstSeq int64
+}
+
+// taskLog 任务日志：完整内容按JSON行写入可轮转的文件，内存中只保留最近的若干条
+type taskLog struct {
+	cfg taskLogConfig
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	segments []logSegment // 最旧的在前，最后一个为正在写入的文件
+	nextSeq  int64
+	written  int64      // 序号小于written的日志已写入文件，轮转或写入失败后不再增加
+	tail     []LogEntry // 环形缓冲
+	tailHead int        // 最旧一条在tail中的位置
+}
+
+// newTaskLog 创建任务日志，目录不可用时返回错误，调用方可退化为仅内存
+func newTaskLog(cfg taskLogConfig) (*taskLog, error) {
+	l := &taskLog{cfg: cfg, tail: make([]LogEntry, 0, cfg.TailLines)}
+	if cfg.Dir == "" {
+		return l, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return l, fmt.Errorf("创建任务日志目录失败: %v", err)
+	}
+	if err := l.openSegment(); err != nil {
+		return l, err
+	}
+	return l, nil
+}
+
+// openSegment 以下一条日志的序号命名并打开新文件
+func (l *taskLog) openSegment() error {
+	path := filepath.Join(l.cfg.Dir, fmt.Sprintf("task.%d.log", l.nextSeq))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("创建任务日志文件失败: %v", err)
+	}
+	l.file = file
+	l.size = 0
+	l.segments = append(l.segments, logSegment{path: path, firstSeq: l.nextSeq})
+	return nil
+}
+
+// rotate 关闭当前文件并开始新文件，超出保留数量时删除最旧的文件
+func (l *taskLog) rotate() {
+	l.file.Close()
+	l.file = nil
+	if err := l.openSegment(); err != nil {
+		logrus.Warnf("任务日志轮转失败，后续日志只保留在内存中: %v", err)
+		return
+	}
+	for len(l.segments) > l.cfg.MaxFiles {
+		os.Remove(l.segments[0].path)
+		l.segments = l.segments[1:]
+	}
+}
+
+// append 记录一条日志并返回带序号的条目
+func (l *taskLog) append(level, source, message string) LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := LogEntry{
+		Seq:     l.nextSeq,
+		Time:    time.Now(),
+		Level:   level,
+		Source:  source,
+		Message: message,
+	}
+	l.nextSeq++
+
+	if l.file != nil {
+		line, _ := json.Marshal(entry)
+		line = append(line, '\n')
+		n, err := l.file.Write(line)
+		l.size += int64(n)
+		if err != nil {
+			logrus.Warnf("写入任务日志失败，后续日志只保留在内存中: %v", err)
+			l.file.Close()
+			l.file = nil
+		} else {
+			l.written = l.nextSeq
+			if l.size >= l.cfg.MaxFileSize {
+				l.rotate()
+			}
+		}
+	}
+
+	if len(l.tail) < l.cfg.TailLines {
+		l.tail = append(l.tail, entry)
+	} else if l.cfg.TailLines > 0 {
+		l.tail[l.tailHead] = entry
+		l.tailHead = (l.tailHead + 1) % len(l.tail)
+	}
+	return entry
+}
+
+// tailEntries 按时间顺序返回内存中的最近日志
+func (l *taskLog) tailEntries() []LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]LogEntry, 0, len(l.tail))
+	entries = append(entries, l.tail[l.tailHead:]...)
+	entries = append(entries, l.tail[:l.tailHead]...)
+	return entries
+}
+
+// count 返回已记录的日志总条数
+func (l *taskLog) count() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.nextSeq
+}
+
+// close 关闭当前文件，之后仍可读取
+func (l *taskLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// logQuery 分页查询条件
+type logQuery struct {
+	Offset int64  // 起始序号
+	Limit  int    // 最多返回条数
+	Level  string // 最低级别，为空表示不过滤
+	Source string // 来源，为空表示不过滤
+}
+
+func (q logQuery) match(entry *LogEntry) bool {
+	if q.Level != "" && logLevelRank[entry.Level] < logLevelRank[q.Level] {
+		return false
+	}
+	return q.Source == "" || entry.Source == q.Source
+}
+
+// logPage 分页查询结果
+type logPage struct {
+	Entries        []LogEntry `json:"entries"`
+	NextOffset     int64      `json:"nextOffset"`     // 下一页的offset
+	Total          int64      `json:"total"`          // 已记录的日志总条数
+	FirstAvailable int64      `json:"firstAvailable"` // 仍可读取的最早序号，更早的日志已被轮转删除
+	HasMore        bool       `json:"hasMore"`
+}
+
+// read 从offset开始按条件读取一页日志。已写入文件的部分从文件读取，
+// 文件不可用或轮转、写入失败后只保留在内存中的部分从内存尾部读取
+func (l *taskLog) read(q logQuery) (*logPage, error) {
+	l.mu.Lock()
+	segments := append([]logSegment(nil), l.segments...)
+	total := l.nextSeq
+	written := l.written
+	l.mu.Unlock()
+
+	page := &logPage{Entries: []LogEntry{}, Total: total, NextOffset: total}
+	if len(segments) > 0 {
+		page.FirstAvailable = segments[0].firstSeq
+	}
+	for i, seg := range segments {
+		if q.Offset >= written || seg.firstSeq >= written {
+			break
+		}
+		// 跳过整个文件都早于offset的文件
+		if i+1 < len(segments) && segments[i+1].firstSeq <= q.Offset {
+			continue
+		}
+		more, err := l.readSegment(seg.path, q, written, page)
+		if err != nil {
+			return nil, err
+		}
+		if more {
+			return page, nil
+		}
+	}
+	if written == total {
+		return page, nil
+	}
+
+	tail := l.tailEntries()
+	if len(segments) == 0 && len(tail) > 0 {
+		page.FirstAvailable = tail[0].Seq
+	}
+	for i := range tail {
+		if tail[i].Seq < written || tail[i].Seq < q.Offset || tail[i].Seq >= total || !q.match(&tail[i]) {
+			continue
+		}
+		if len(page.Entries) == q.Limit {
+			page.NextOffset = tail[i].Seq
+			page.HasMore = true
+			break
+		}
+		page.Entries = append(page.Entries, tail[i])
+	}
+	return page, nil
+}
+
+// readSegment 读取一个文件中序号小于end且符合条件的日志，页已满时返回true
+func (l *taskLog) readSegment(path string, q logQuery, end int64, page *logPage) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) { // 读取期间被轮转删除
+			return false, nil
+		}
+		return false, fmt.Errorf("读取任务日志失败: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var entry LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // 正在写入的不完整行
+		}
+		if entry.Seq < q.Offset || entry.Seq >= end || !q.match(&entry) {
+			continue
+		}
+		if len(page.Entries) == q.Limit {
+			page.NextOffset = entry.Seq
+			page.HasMore = true
+			return true, nil
+		}
+		page.Entries = append(page.Entries, entry)
+	}
+	return false, scanner.Err()
+}
+
+// appendLog 记录一条任务日志，发布log事件并返回格式化后的文本
+func (t *Task) appendLog(level, source, message string) string {
+	entry := LogEntry{Time: time.Now(), Level: level, Source: source, Message: message}
+	if t.Log != nil {
+		entry = t.Log.append(level, source, message)
+	}
+	t.Events.publish(eventLog, entry)
+	return entry.String()
+}
+
+// logLines 返回最近的日志文本
+func (t *Task) logLines() []string {
+	if t.Log == nil {
+		return t.Status.Logs
+	}
+	entries := t.Log.tailEntries()
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		lines[i] = entry.String()
+	}
+	return lines
+}
+
+// outputLevel 推断一行进程输出的级别：优先使用行内的level字段，否则stderr视为warn
+func outputLevel(source, line string) string {
+	if m := outputLevelPattern.FindStringSubmatch(line); m != nil {
+		level := strings.ToLower(m[1])
+		if level == "warning" {
+			level = "warn"
+		}
+		if _, ok := logLevelRank[level]; ok {
+			return level
+		}
+	}
+	if source == "stderr" {
+		return "warn"
+	}
+	return "info"
+}
+
+// logOutput 把一段进程输出按行记入任务日志
+func (a *Agent) logOutput(task *Task, source, output string) {
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if line != "" {
+			task.appendLog(outputLevel(source, line), source, line)
+		}
+	}
+}
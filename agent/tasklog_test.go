@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskLogRotationAndTail(t *testing.T) {
+	dir := t.TempDir()
+	l, err := newTaskLog(taskLogConfig{Dir: dir, MaxFileSize: 1024, MaxFiles: 3, TailLines: 10})
+	require.NoError(t, err)
+	defer l.close()
+
+	for i := 0; i < 200; i++ {
+		l.append("info", "stdout", fmt.Sprintf("line %03d with some padding to fill the file", i))
+	}
+
+	// 旧文件被删除，只保留3个
+	files, err := filepath.Glob(filepath.Join(dir, "task.*.log"))
+	require.NoError(t, err)
+	assert.Len(t, files, 3)
+
+	tail := l.tailEntries()
+	require.Len(t, tail, 10)
+	assert.Equal(t, int64(190), tail[0].Seq)
+	assert.Equal(t, int64(199), tail[9].Seq)
+	assert.Equal(t, int64(200), l.count())
+
+	// 早于保留范围的offset从最早可用的日志开始
+	page, err := l.read(logQuery{Offset: 0, Limit: 5})
+	require.NoError(t, err)
+	assert.Greater(t, page.FirstAvailable, int64(0))
+	require.Len(t, page.Entries, 5)
+	assert.Equal(t, page.FirstAvailable, page.Entries[0].Seq)
+	assert.True(t, page.HasMore)
+}
+
+func TestTaskLogPagination(t *testing.T) {
+	l, err := newTaskLog(taskLogConfig{Dir: t.TempDir(), MaxFileSize: 512, MaxFiles: 100, TailLines: 5})
+	require.NoError(t, err)
+	defer l.close()
+
+	for i := 0; i < 50; i++ {
+		source, level := "stdout", "info"
+		if i%5 == 0 {
+			source, level = "stderr", "error"
+		}
+		l.append(level, source, fmt.Sprintf("line %d", i))
+	}
+
+	// 逐页读完全部日志
+	var seqs []int64
+	offset := int64(0)
+	for {
+		page, err := l.read(logQuery{Offset: offset, Limit: 7})
+		require.NoError(t, err)
+		for _, e := range page.Entries {
+			seqs = append(seqs, e.Seq)
+		}
+		if !page.HasMore {
+			break
+		}
+		offset = page.NextOffset
+	}
+	require.Len(t, seqs, 50)
+	for i, seq := range seqs {
+		assert.Equal(t, int64(i), seq)
+	}
+
+	// 按级别和来源过滤
+	page, err := l.read(logQuery{Limit: 100, Level: "warn"})
+	require.NoError(t, err)
+	assert.Len(t, page.Entries, 10)
+	page, err = l.read(logQuery{Offset: 20, Limit: 100, Source: "stderr"})
+	require.NoError(t, err)
+	require.Len(t, page.Entries, 6)
+	assert.Equal(t, "line 20", page.Entries[0].Message)
+	assert.False(t, page.HasMore)
+	assert.Equal(t, int64(50), page.NextOffset)
+}
+
+func TestTaskLogMemoryOnly(t *testing.T) {
+	l, err := newTaskLog(taskLogConfig{TailLines: 3})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		l.append("info", "agent", fmt.Sprintf("line %d", i))
+	}
+
+	page, err := l.read(logQuery{Limit: 10})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), page.FirstAvailable)
+	assert.Len(t, page.Entries, 3)
+	assert.Equal(t, int64(5), page.Total)
+}
+
+func TestOutputLevel(t *testing.T) {
+	assert.Equal(t, "warn", outputLevel("stderr", `time="2024-01-01" level=warning msg="slow"`))
+	assert.Equal(t, "error", outputLevel("stdout", `level=error msg="boom"`))
+	assert.Equal(t, "info", outputLevel("stdout", "running (1m30s/2m0s)"))
+	assert.Equal(t, "warn", outputLevel("stderr", "something odd"))
+}
+
+func TestGetTaskLogs(t *testing.T) {
+	agent := setupTestAgent()
+	router := gin.New()
+	router.GET("/tasks/:taskId/logs", agent.GetTaskLogs)
+
+	l, err := newTaskLog(taskLogConfig{Dir: t.TempDir(), MaxFileSize: 1 << 20, MaxFiles: 1, TailLines: 10})
+	require.NoError(t, err)
+	defer l.close()
+	for i := 0; i < 30; i++ {
+		l.append("info", "stdout", fmt.Sprintf("line %d", i))
+	}
+
+	agent.tasksMu.Lock()
+	agent.tasks["task-logs"] = &Task{
+		Status: &TaskStatus{ID: "task-logs", Status: "running"},
+		Log:    l,
+	}
+	agent.tasksMu.Unlock()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/tasks/task-logs/logs?offset=10&limit=5&source=stdout", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var page logPage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page.Entries, 5)
+	assert.Equal(t, int64(10), page.Entries[0].Seq)
+	assert.Equal(t, int64(15), page.NextOffset)
+	assert.Equal(t, int64(30), page.Total)
+	assert.True(t, page.HasMore)
+
+	for _, query := range []string{"offset=-1", "limit=0", "limit=5000", "level=verbose"} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/tasks/task-logs/logs?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/tasks/missing/logs", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestTaskLogDirUnavailable(t *testing.T) {
+	// 目录路径被普通文件占用时退化为仅内存
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	require.NoError(t, os.WriteFile(blocker, nil, 0644))
+
+	l, err := newTaskLog(taskLogConfig{Dir: filepath.Join(blocker, "logs"), MaxFileSize: 1024, MaxFiles: 1, TailLines: 2})
+	assert.Error(t, err)
+	require.NotNil(t, l)
+	l.append("info", "agent", "still kept in memory")
+	assert.Len(t, l.tailEntries(), 1)
+}
+
+func TestTaskLogReadAfterWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	l, err := newTaskLog(taskLogConfig{Dir: dir, MaxFileSize: 1 << 20, MaxFiles: 3, TailLines: 10})
+	require.NoError(t, err)
+	defer l.close()
+
+	for i := 0; i < 5; i++ {
+		l.append("info", "stdout", fmt.Sprintf("line %d", i))
+	}
+	// 文件被意外关闭，之后的写入失败，日志只保留在内存中
+	l.mu.Lock()
+	l.file.Close()
+	l.mu.Unlock()
+	for i := 5; i < 8; i++ {
+		l.append("info", "stdout", fmt.Sprintf("line %d", i))
+	}
+
+	page, err := l.read(logQuery{Offset: 0, Limit: 100})
+	require.NoError(t, err)
+	require.Len(t, page.Entries, 8)
+	for i, e := range page.Entries {
+		assert.Equal(t, int64(i), e.Seq)
+	}
+	assert.Equal(t, int64(8), page.NextOffset)
+
+	// 分页跨过文件和内存的边界
+	page, err = l.read(logQuery{Offset: 3, Limit: 3})
+	require.NoError(t, err)
+	require.Len(t, page.Entries, 3)
+	assert.Equal(t, int64(3), page.Entries[0].Seq)
+	assert.True(t, page.HasMore)
+	page, err = l.read(logQuery{Offset: page.NextOffset, Limit: 3})
+	require.NoError(t, err)
+	require.Len(t, page.Entries, 2)
+	assert.Equal(t, int64(6), page.Entries[0].Seq)
+	assert.False(t, page.HasMore)
+}
+
+func TestTaskLogReadAfterRotationFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	l, err := newTaskLog(taskLogConfig{Dir: dir, MaxFileSize: 64, MaxFiles: 3, TailLines: 10})
+	require.NoError(t, err)
+	defer l.close()
+
+	// 目录被删除后轮转无法创建新文件
+	l.append("info", "stdout", "first line")
+	require.NoError(t, os.RemoveAll(dir))
+	l.append("info", "stdout", "second line with enough padding to trigger a rotation")
+	l.append("info", "stdout", "third line")
+
+	page, err := l.read(logQuery{Offset: 0, Limit: 100})
+	require.NoError(t, err)
+	var messages []string
+	for _, e := range page.Entries {
+		messages = append(messages, e.Message)
+	}
+	// 前两条所在的文件已被删除，读取时跳过；之后的日志从内存读取
+	assert.Equal(t, []string{"third line"}, messages)
+
+	page, err = l.read(logQuery{Offset: 2, Limit: 100})
+	require.NoError(t, err)
+	require.Len(t, page.Entries, 1)
+	assert.Equal(t, int64(2), page.Entries[0].Seq)
+}
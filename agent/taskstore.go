@@ -0,0 +1,268 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// taskWorkspace 任务的工作目录，脚本、日志和产物都放在这里，任务被清理时整体删除
+func taskWorkspace(taskID string) string {
+	return filepath.Join(workspaceDir(), "tasks", taskID)
+}
+
+// TaskSummary 任务列表中的一项
+type TaskSummary struct {
+	ID        string            `json:"id"`
+	Type      string            `json:"type"`
+	Status    string            `json:"status"`
+	StartTime time.Time         `json:"startTime"`
+	EndTime   *time.Time        `json:"endTime,omitempty"`
+	Progress  float64           `json:"progress"`
+	ScriptID  string            `json:"scriptId,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	TraceID   string            `json:"traceId,omitempty"`
+	SegmentID string            `json:"segmentId,omitempty"`
+}
+
+// taskSummary 从任务状态提取列表和通知使用的摘要
+func taskSummary(s *TaskStatus) TaskSummary {
+	return TaskSummary{
+		ID:        s.ID,
+		Type:      s.Type,
+		Status:    s.Status,
+		StartTime: s.StartTime,
+		EndTime:   s.EndTime,
+		Progress:  s.Progress,
+		ScriptID:  s.ScriptID,
+		Tags:      s.Tags,
+		Error:     s.Error,
+		TraceID:   s.TraceID,
+		SegmentID: s.SegmentID,
+	}
+}
+
+// taskFilter 任务列表的过滤条件
+type taskFilter struct {
+	Statuses []string
+	Type     string
+	Tags     map[string]string
+	Since    time.Time // 开始时间不早于
+	Until    time.Time // 开始时间不晚于
+}
+
+func (f taskFilter) match(status *TaskStatus) bool {
+	if len(f.Statuses) > 0 && !containsString(f.Statuses, status.Status) {
+		return false
+	}
+	if f.Type != "" && status.Type != f.Type {
+		return false
+	}
+	for k, v := range f.Tags {
+		if status.Tags[k] != v {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && status.StartTime.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && status.StartTime.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// update 在任务锁内修改状态，任务登记后对Status的写入都经过这里
+func (t *Task) update(fn func(s *TaskStatus)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fn(t.Status)
+}
+
+// snapshot 在任务锁内复制状态，供接口、列表和清理等其他goroutine读取。
+// 会被原地修改的屏障和回调记录一并复制，租约取自taskLease
+func (t *Task) snapshot() TaskStatus {
+	t.mu.RLock()
+	status := *t.Status
+	if status.Barrier != nil {
+		barrier := *status.Barrier
+		status.Barrier = &barrier
+	}
+	if status.Callback != nil {
+		callback := *status.Callback
+		callback.Attempts = append([]CallbackAttempt{}, callback.Attempts...)
+		status.Callback = &callback
+	}
+	t.mu.RUnlock()
+
+	if t.Lease != nil {
+		lease := t.Lease.snapshot()
+		status.Lease = &lease
+	}
+	return status
+}
+
+// finished 任务已结束且结果已回传，可以被清理
+func (t *Task) finished() bool {
+	return t.snapshot().EndTime != nil && t.Events.isClosed()
+}
+
+// ListTasks 按条件分页列出任务，按开始时间倒序
+func (a *Agent) ListTasks(c *gin.Context) {
+	filter := taskFilter{Type: c.Query("type"), Tags: make(map[string]string)}
+	if v := c.Query("status"); v != "" {
+		filter.Statuses = strings.Split(v, ",")
+	}
+	for _, tag := range c.QueryArray("tag") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			c.JSON(400, gin.H{"error": "tag格式应为key=value"})
+			return
+		}
+		filter.Tags[kv[0]] = kv[1]
+	}
+	for name, target := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := c.Query(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "无效的" + name + "，应为RFC3339时间"})
+				return
+			}
+			*target = t
+		}
+	}
+
+	offset, limit := 0, 50
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(400, gin.H{"error": "无效的offset"})
+			return
+		}
+		offset = n
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 500 {
+			c.JSON(400, gin.H{"error": "limit必须在1到500之间"})
+			return
+		}
+		limit = n
+	}
+
+	a.tasksMu.RLock()
+	summaries := make([]TaskSummary, 0, len(a.tasks))
+	for _, task := range a.tasks {
+		if status := task.snapshot(); filter.match(&status) {
+			summaries = append(summaries, taskSummary(&status))
+		}
+	}
+	a.tasksMu.RUnlock()
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].StartTime.After(summaries[j].StartTime)
+	})
+
+	total := len(summaries)
+	page := []TaskSummary{}
+	if offset < total {
+		end := offset + limit
+		if end > total {
+			end = total
+		}
+		page = summaries[offset:end]
+	}
+
+	c.JSON(200, gin.H{
+		"tasks":  page,
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+	})
+}
+
+// taskRetention 已结束任务的保留策略
+type taskRetention struct {
+	MaxCount int           // 最多保留的已结束任务数，0表示不限
+	MaxAge   time.Duration // 结束后最长保留时间，0表示不限
+}
+
+// taskRetentionFromViper 读取resources.task_retention_*配置
+func taskRetentionFromViper() taskRetention {
+	retention := taskRetention{MaxCount: viper.GetInt("resources.task_retention_count")}
+	if age, err := time.ParseDuration(viper.GetString("resources.task_retention_age")); err == nil && age > 0 {
+		retention.MaxAge = age
+	}
+	return retention
+}
+
+// evictTasks 清理超过保留期限或数量的已结束任务及其工作目录，返回清理数
+func (a *Agent) evictTasks(retention taskRetention, now time.Time) int {
+	a.tasksMu.Lock()
+	var finished []TaskStatus
+	for _, task := range a.tasks {
+		if status := task.snapshot(); status.EndTime != nil && task.Events.isClosed() {
+			finished = append(finished, status)
+		}
+	}
+	// 最新结束的在前
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].EndTime.After(*finished[j].EndTime)
+	})
+
+	var evicted []string
+	var evictedStatuses []TaskStatus
+	for i, status := range finished {
+		expired := retention.MaxAge > 0 && now.Sub(*status.EndTime) > retention.MaxAge
+		overflow := retention.MaxCount > 0 && i >= retention.MaxCount
+		if expired || overflow {
+			delete(a.tasks, status.ID)
+			evicted = append(evicted, status.ID)
+			evictedStatuses = append(evictedStatuses, status)
+		}
+	}
+	// 清理后仍在去重窗口内记住任务的最终状态
+	a.rememberJobs(evictedStatuses, now)
+	a.tasksMu.Unlock()
+
+	for _, id := range evicted {
+		if err := os.RemoveAll(taskWorkspace(id)); err != nil {
+			logrus.Warnf("删除任务 %s 的工作目录失败: %v", id, err)
+		}
+	}
+	if len(evicted) > 0 {
+		logrus.Infof("已清理 %d 个已结束的任务", len(evicted))
+	}
+	return len(evicted)
+}
+
+// startTaskCleanup 按resources.cleanup_interval定期清理已结束的任务
+func (a *Agent) startTaskCleanup() {
+	interval, err := time.ParseDuration(viper.GetString("resources.cleanup_interval"))
+	if err != nil || interval <= 0 {
+		interval = time.Hour
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+			a.evictTasks(taskRetentionFromViper(), time.Now())
+			if a.coordinator != nil {
+				a.coordinator.evictRuns(time.Now())
+			}
+		}
+	}
+}
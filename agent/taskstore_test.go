@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addFinishedTask 登记一个已结束的任务，endAgo为结束距今的时长，0表示仍在运行
+func addFinishedTask(agent *Agent, id, taskType, status string, tags map[string]string, start time.Time, endAgo time.Duration) *Task {
+	task := &Task{
+		Status: &TaskStatus{ID: id, Type: taskType, Status: status, Tags: tags, StartTime: start},
+		Events: newTaskHub(10, 10),
+	}
+	if endAgo > 0 {
+		end := time.Now().Add(-endAgo)
+		task.Status.EndTime = &end
+		task.Events.close()
+	}
+	agent.tasksMu.Lock()
+	agent.tasks[id] = task
+	agent.tasksMu.Unlock()
+	return task
+}
+
+func TestListTasks(t *testing.T) {
+	agent := setupTestAgent()
+	router := gin.New()
+	router.GET("/tasks", agent.ListTasks)
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		status, taskType, env := "completed", "k6", "prod"
+		if i%2 == 1 {
+			status, taskType, env = "failed", "shell", "staging"
+		}
+		addFinishedTask(agent, fmt.Sprintf("task-%d", i), taskType, status, map[string]string{"env": env}, base.Add(time.Duration(i)*time.Hour), time.Minute)
+	}
+
+	list := func(query string) (int, []TaskSummary, int) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/tasks?"+query, nil))
+		var resp struct {
+			Tasks []TaskSummary `json:"tasks"`
+			Total int           `json:"total"`
+		}
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		}
+		return w.Code, resp.Tasks, resp.Total
+	}
+
+	// 默认按开始时间倒序
+	code, tasks, total := list("limit=3")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 10, total)
+	require.Len(t, tasks, 3)
+	assert.Equal(t, "task-9", tasks[0].ID)
+	assert.Equal(t, "task-7", tasks[2].ID)
+
+	_, tasks, _ = list("limit=3&offset=9")
+	require.Len(t, tasks, 1)
+	assert.Equal(t, "task-0", tasks[0].ID)
+
+	_, tasks, total = list("status=failed&type=shell&tag=env=staging")
+	assert.Equal(t, 5, total)
+	for _, task := range tasks {
+		assert.Equal(t, "failed", task.Status)
+	}
+
+	_, _, total = list("status=completed,failed&tag=env=staging&tag=team=x")
+	assert.Equal(t, 0, total)
+
+	_, tasks, total = list("since=2024-01-01T02:00:00Z&until=2024-01-01T04:00:00Z")
+	assert.Equal(t, 3, total)
+	assert.Equal(t, "task-4", tasks[0].ID)
+
+	for _, query := range []string{"limit=0", "limit=501", "offset=-1", "since=yesterday", "tag=noequals"} {
+		code, _, _ = list(query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
+
+func TestEvictTasks(t *testing.T) {
+	viper.Set("resources.workspace_dir", t.TempDir())
+	defer viper.Set("resources.workspace_dir", "")
+
+	agent := setupTestAgent()
+	now := time.Now()
+	addFinishedTask(agent, "old", "k6", "completed", nil, now, 48*time.Hour)
+	addFinishedTask(agent, "recent-1", "k6", "completed", nil, now, 3*time.Minute)
+	addFinishedTask(agent, "recent-2", "k6", "failed", nil, now, 2*time.Minute)
+	addFinishedTask(agent, "recent-3", "k6", "completed", nil, now, time.Minute)
+	addFinishedTask(agent, "running", "k6", "running", nil, now, 0)
+
+	for _, id := range []string{"old", "recent-1", "running"} {
+		require.NoError(t, os.MkdirAll(taskWorkspace(id), 0755))
+	}
+
+	// 按保留时长清理
+	assert.Equal(t, 1, agent.evictTasks(taskRetention{MaxAge: 24 * time.Hour}, now))
+	assert.NotContains(t, agent.tasks, "old")
+	assert.NoDirExists(t, taskWorkspace("old"))
+
+	// 按数量清理时保留最新结束的任务，运行中的任务不受影响
+	assert.Equal(t, 1, agent.evictTasks(taskRetention{MaxCount: 2}, now))
+	assert.NotContains(t, agent.tasks, "recent-1")
+	assert.NoDirExists(t, taskWorkspace("recent-1"))
+	assert.Contains(t, agent.tasks, "recent-2")
+	assert.Contains(t, agent.tasks, "recent-3")
+	assert.Contains(t, agent.tasks, "running")
+	assert.DirExists(t, taskWorkspace("running"))
+
+	assert.Equal(t, 0, agent.evictTasks(taskRetention{}, now))
+}
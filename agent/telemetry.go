@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "k6-agent"
+
+// telemetryConfig OTLP导出配置
+type telemetryConfig struct {
+	Enabled         bool
+	Endpoint        string // 例如 http://otel-collector:4318
+	Headers         map[string]string
+	ExportK6Metrics bool
+	MetricInterval  time.Duration
+	// 作为k6指标属性导出的k6标签和任务标签。累计型指标的每个属性组合在进程存活期间一直保留，
+	// 只能放取值有限的标签，url、name和任务ID等不应加入
+	K6Attributes []string
+}
+
+// telemetryConfigFromViper 读取telemetry.otlp配置
+func telemetryConfigFromViper() telemetryConfig {
+	interval, err := time.ParseDuration(viper.GetString("telemetry.otlp.metric_interval"))
+	if err != nil || interval <= 0 {
+		interval = 10 * time.Second
+	}
+	return telemetryConfig{
+		Enabled:         viper.GetBool("telemetry.otlp.enabled"),
+		Endpoint:        viper.GetString("telemetry.otlp.endpoint"),
+		Headers:         viper.GetStringMapString("telemetry.otlp.headers"),
+		ExportK6Metrics: viper.GetBool("telemetry.otlp.export_k6_metrics"),
+		MetricInterval:  interval,
+		K6Attributes:    viper.GetStringSlice("telemetry.otlp.k6_attributes"),
+	}
+}
+
+// telemetry 通过OTLP/HTTP导出任务链路和k6指标，未启用时链路为空操作
+type telemetry struct {
+	cfg            telemetryConfig
+	tracer         trace.Tracer
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+	k6             *otelK6Instruments
+}
+
+// newTelemetry 按配置创建OTLP导出器
+func newTelemetry(cfg telemetryConfig) (*telemetry, error) {
+	t := &telemetry{
+		cfg:    cfg,
+		tracer: trace.NewNoopTracerProvider().Tracer(instrumentationName),
+	}
+	if !cfg.Enabled {
+		return t, nil
+	}
+
+	endpoint, err := url.Parse(strings.TrimRight(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return t, fmt.Errorf("无效的OTLP地址: %q", cfg.Endpoint)
+	}
+
+	hostname, _ := os.Hostname()
+	res := resource.NewSchemaless(
+		attribute.String("service.name", instrumentationName),
+		attribute.String("host.name", hostname),
+	)
+
+	traceOpts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(endpoint.Host),
+		otlptracehttp.WithURLPath(endpoint.Path + "/v1/traces"),
+		otlptracehttp.WithHeaders(cfg.Headers),
+	}
+	if endpoint.Scheme == "http" {
+		traceOpts = append(traceOpts, otlptracehttp.WithInsecure())
+	}
+	traceExporter, err := otlptracehttp.New(context.Background(), traceOpts...)
+	if err != nil {
+		return t, fmt.Errorf("创建OTLP链路导出器失败: %v", err)
+	}
+	t.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(res),
+	)
+	t.tracer = t.tracerProvider.Tracer(instrumentationName)
+
+	if cfg.ExportK6Metrics {
+		metricOpts := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(endpoint.Host),
+			otlpmetrichttp.WithURLPath(endpoint.Path + "/v1/metrics"),
+			otlpmetrichttp.WithHeaders(cfg.Headers),
+		}
+		if endpoint.Scheme == "http" {
+			metricOpts = append(metricOpts, otlpmetrichttp.WithInsecure())
+		}
+		metricExporter, err := otlpmetrichttp.New(context.Background(), metricOpts...)
+		if err != nil {
+			return t, fmt.Errorf("创建OTLP指标导出器失败: %v", err)
+		}
+		t.meterProvider = sdkmetric.NewMeterProvider(
+			sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter, sdkmetric.WithInterval(cfg.MetricInterval))),
+			sdkmetric.WithResource(res),
+		)
+		t.k6 = newOtelK6Instruments(t.meterProvider.Meter(instrumentationName))
+	}
+
+	logrus.Infof("已启用OpenTelemetry导出: %s", cfg.Endpoint)
+	return t, nil
+}
+
+// shutdown 刷新并关闭导出器
+func (t *telemetry) shutdown(ctx context.Context) {
+	if t.tracerProvider != nil {
+		if err := t.tracerProvider.Shutdown(ctx); err != nil {
+			logrus.Warnf("关闭OTLP链路导出器失败: %v", err)
+		}
+	}
+	if t.meterProvider != nil {
+		if err := t.meterProvider.Shutdown(ctx); err != nil {
+			logrus.Warnf("关闭OTLP指标导出器失败: %v", err)
+		}
+	}
+}
+
+// startJobSpan 创建任务的根span，start为接收到任务的时间
+func (t *telemetry) startJobSpan(job *Job, agentID string, start time.Time) (context.Context, trace.Span) {
+	if start.IsZero() {
+		start = time.Now()
+	}
+	return t.tracer.Start(context.Background(), "job",
+		trace.WithTimestamp(start),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("job.id", job.ID),
+			attribute.String("job.type", job.Type),
+			attribute.String("job.script_id", job.ScriptID),
+			attribute.String("agent.id", agentID),
+		),
+	)
+}
+
+// k6Sink 返回把k6数据点导出为OTLP指标的sink，未启用时返回nil。
+// 任务标签只保留K6Attributes中列出的，agent_id始终保留
+func (t *telemetry) k6Sink(taskID string, tags map[string]string) k6SampleSink {
+	if t.k6 == nil {
+		return nil
+	}
+	allowed := make(map[string]bool, len(t.cfg.K6Attributes))
+	for _, key := range t.cfg.K6Attributes {
+		allowed[key] = true
+	}
+	kept := make(map[string]string)
+	for k, v := range tags {
+		if allowed[k] || k == "agent_id" {
+			kept[k] = v
+		}
+	}
+	return &otelK6Sink{
+		instruments: t.k6,
+		provider:    t.meterProvider,
+		taskID:      taskID,
+		tags:        kept,
+		allowed:     allowed,
+	}
+}
+
+// startSpan 在任务链路下创建子span，任务未关联链路时为空操作
+func (t *Task) startSpan(name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	ctx := t.TraceCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(instrumentationName)
+	return tracer.Start(ctx, name, opts...)
+}
+
+// traceID 返回任务链路的TraceID，未采样时为空
+func (t *Task) traceID() string {
+	if t.TraceCtx == nil {
+		return ""
+	}
+	sc := trace.SpanContextFromContext(t.TraceCtx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// endSpan 根据错误设置span状态后结束
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// otelK6Instruments 按k6指标名懒创建的OTLP仪表，所有任务共享
+type otelK6Instruments struct {
+	meter metric.Meter
+
+	mu         sync.Mutex
+	counters   map[string]metric.Float64Counter
+	histograms map[string]metric.Float64Histogram
+	rates      map[string]metric.Int64Counter
+	gauges     map[string]bool
+	// gauge最新值，按指标名、任务和属性集合索引，由回调读取
+	gaugeValues map[string]map[gaugeKey]gaugeValue
+}
+
+type gaugeKey struct {
+	taskID string
+	attrs  attribute.Distinct
+}
+
+type gaugeValue struct {
+	attrs attribute.Set
+	value float64
+}
+
+func newOtelK6Instruments(meter metric.Meter) *otelK6Instruments {
+	return &otelK6Instruments{
+		meter:       meter,
+		counters:    make(map[string]metric.Float64Counter),
+		histograms:  make(map[string]metric.Float64Histogram),
+		rates:       make(map[string]metric.Int64Counter),
+		gauges:      make(map[string]bool),
+		gaugeValues: make(map[string]map[gaugeKey]gaugeValue),
+	}
+}
+
+// record 按k6指标类型记录数据点：counter累加，trend记入直方图，rate按结果计数，gauge保留最新值
+func (i *otelK6Instruments) record(ctx context.Context, taskID string, sample *k6Sample, attrs attribute.Set) {
+	name := "k6." + sample.Metric
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	switch sample.Type {
+	case "counter":
+		counter, ok := i.counters[name]
+		if !ok {
+			var err error
+			if counter, err = i.meter.Float64Counter(name); err != nil {
+				return
+			}
+			i.counters[name] = counter
+		}
+		counter.Add(ctx, sample.Value, metric.WithAttributeSet(attrs))
+	case "trend":
+		histogram, ok := i.histograms[name]
+		if !ok {
+			var err error
+			if histogram, err = i.meter.Float64Histogram(name); err != nil {
+				return
+			}
+			i.histograms[name] = histogram
+		}
+		histogram.Record(ctx, sample.Value, metric.WithAttributeSet(attrs))
+	case "rate":
+		rate, ok := i.rates[name]
+		if !ok {
+			var err error
+			if rate, err = i.meter.Int64Counter(name); err != nil {
+				return
+			}
+			i.rates[name] = rate
+		}
+		result := attribute.Bool("k6.rate.result", sample.Value != 0)
+		rate.Add(ctx, 1, metric.WithAttributes(append(attrs.ToSlice(), result)...))
+	case "gauge":
+		if !i.gauges[name] {
+			if _, err := i.meter.Float64ObservableGauge(name, metric.WithFloat64Callback(i.observeGauge(name))); err != nil {
+				return
+			}
+			i.gauges[name] = true
+			i.gaugeValues[name] = make(map[gaugeKey]gaugeValue)
+		}
+		i.gaugeValues[name][gaugeKey{taskID: taskID, attrs: attrs.Equivalent()}] = gaugeValue{attrs: attrs, value: sample.Value}
+	}
+}
+
+// observeGauge 返回上报gauge最新值的回调，属性相同的多个运行中任务相加，例如整个Agent的VU数
+func (i *otelK6Instruments) observeGauge(name string) metric.Float64Callback {
+	return func(ctx context.Context, o metric.Float64Observer) error {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		sums := make(map[attribute.Distinct]gaugeValue)
+		for key, v := range i.gaugeValues[name] {
+			sum := sums[key.attrs]
+			sums[key.attrs] = gaugeValue{attrs: v.attrs, value: sum.value + v.value}
+		}
+		for _, v := range sums {
+			o.Observe(v.value, metric.WithAttributeSet(v.attrs))
+		}
+		return nil
+	}
+}
+
+// forgetTask 任务结束后不再上报其gauge
+func (i *otelK6Instruments) forgetTask(taskID string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, values := range i.gaugeValues {
+		for key := range values {
+			if key.taskID == taskID {
+				delete(values, key)
+			}
+		}
+	}
+}
+
+// otelK6Sink 单个任务的k6数据点导出
+type otelK6Sink struct {
+	instruments *otelK6Instruments
+	provider    *sdkmetric.MeterProvider
+	taskID      string
+	tags        map[string]string
+	allowed     map[string]bool // 作为属性导出的k6标签
+}
+
+func (s *otelK6Sink) addSample(sample *k6Sample) {
+	kvs := make([]attribute.KeyValue, 0, len(s.allowed)+len(s.tags))
+	for k, v := range sample.Tags {
+		if _, ok := s.tags[k]; !ok && v != "" && s.allowed[k] {
+			kvs = append(kvs, attribute.String(k, v))
+		}
+	}
+	for k, v := range s.tags {
+		kvs = append(kvs, attribute.String(k, v))
+	}
+	s.instruments.record(context.Background(), s.taskID, sample, attribute.NewSet(kvs...))
+}
+
+// close 任务结束时立即推送一次，使最终值不必等待下个导出周期
+func (s *otelK6Sink) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.provider.ForceFlush(ctx); err != nil {
+		logrus.Warnf("推送任务 %s 的OTLP指标失败: %v", s.taskID, err)
+	}
+	s.instruments.forgetTask(s.taskID)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpCollector 模拟OTLP/HTTP Collector，记录收到的span、指标名和指标属性
+type otlpCollector struct {
+	mu      sync.Mutex
+	spans   map[string]string // span名 -> traceID
+	metrics map[string]bool
+	attrs   map[string]map[string]string // 指标名 -> 数据点属性
+	gauges  map[string][]float64         // gauge指标名 -> 收到的数据点值
+}
+
+func newOTLPCollector(t *testing.T) (*otlpCollector, *httptest.Server) {
+	c := &otlpCollector{spans: make(map[string]string), metrics: make(map[string]bool), attrs: make(map[string]map[string]string), gauges: make(map[string][]float64)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		switch r.URL.Path {
+		case "/v1/traces":
+			var req coltracepb.ExportTraceServiceRequest
+			require.NoError(t, proto.Unmarshal(body, &req))
+			for _, rs := range req.ResourceSpans {
+				for _, ss := range rs.ScopeSpans {
+					for _, span := range ss.Spans {
+						c.spans[span.Name] = hexTraceID(span.TraceId)
+					}
+				}
+			}
+		case "/v1/metrics":
+			var req colmetricpb.ExportMetricsServiceRequest
+			require.NoError(t, proto.Unmarshal(body, &req))
+			for _, rm := range req.ResourceMetrics {
+				for _, sm := range rm.ScopeMetrics {
+					for _, m := range sm.Metrics {
+						c.metrics[m.Name] = true
+						c.recordAttrs(m)
+					}
+				}
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return c, server
+}
+
+func (c *otlpCollector) recordAttrs(m *metricpb.Metric) {
+	var points [][]*commonpb.KeyValue
+	for _, dp := range m.GetSum().GetDataPoints() {
+		points = append(points, dp.Attributes)
+	}
+	for _, dp := range m.GetHistogram().GetDataPoints() {
+		points = append(points, dp.Attributes)
+	}
+	for _, dp := range m.GetGauge().GetDataPoints() {
+		points = append(points, dp.Attributes)
+		c.gauges[m.Name] = append(c.gauges[m.Name], dp.GetAsDouble())
+	}
+	for _, kvs := range points {
+		if c.attrs[m.Name] == nil {
+			c.attrs[m.Name] = make(map[string]string)
+		}
+		for _, kv := range kvs {
+			c.attrs[m.Name][kv.Key] = kv.Value.GetStringValue()
+		}
+	}
+}
+
+func hexTraceID(id []byte) string {
+	const digits = "0123456789abcdef"
+	out := make([]byte, 0, len(id)*2)
+	for _, b := range id {
+		out = append(out, digits[b>>4], digits[b&0x0f])
+	}
+	return string(out)
+}
+
+func TestTelemetryDisabledIsNoop(t *testing.T) {
+	tel, err := newTelemetry(telemetryConfig{})
+	require.NoError(t, err)
+
+	task := &Task{}
+	task.TraceCtx, task.Span = tel.startJobSpan(&Job{ID: "job-1"}, "agent-1", time.Now())
+	_, span := task.startSpan("job.run")
+	span.End()
+	task.Span.End()
+
+	assert.Empty(t, task.traceID())
+	assert.Nil(t, tel.k6Sink("job-1", nil))
+}
+
+func TestTelemetryExportsJobTrace(t *testing.T) {
+	collector, server := newOTLPCollector(t)
+
+	tel, err := newTelemetry(telemetryConfig{Enabled: true, Endpoint: server.URL, MetricInterval: time.Hour})
+	require.NoError(t, err)
+
+	job := &Job{ID: "job-1", Type: "k6", ScriptID: "script-1"}
+	task := &Task{}
+	task.TraceCtx, task.Span = tel.startJobSpan(job, "agent-1", time.Now().Add(-time.Second))
+	for _, name := range []string{"job.poll", "job.script_download", "job.build_command", "job.run", "job.process_result", "job.report"} {
+		_, span := task.startSpan(name)
+		span.End()
+	}
+	endSpan(task.Span, nil)
+
+	traceID := task.traceID()
+	require.Len(t, traceID, 32)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tel.shutdown(ctx)
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	for _, name := range []string{"job", "job.poll", "job.script_download", "job.build_command", "job.run", "job.process_result", "job.report"} {
+		assert.Equal(t, traceID, collector.spans[name], "span %s", name)
+	}
+}
+
+func TestTelemetryExportsK6Metrics(t *testing.T) {
+	collector, server := newOTLPCollector(t)
+
+	tel, err := newTelemetry(telemetryConfig{
+		Enabled:         true,
+		Endpoint:        server.URL,
+		ExportK6Metrics: true,
+		MetricInterval:  time.Hour,
+		K6Attributes:    []string{"method", "status", "env"},
+	})
+	require.NoError(t, err)
+	defer tel.shutdown(context.Background())
+
+	sink := tel.k6Sink("job-1", map[string]string{"agent_id": "agent-1", "task_id": "job-1", "segment": "0", "env": "staging", "team": "qa"})
+	require.NotNil(t, sink)
+
+	tags := map[string]string{"method": "GET", "status": "200", "url": "http://example.com/items/42", "name": "items"}
+	sink.addSample(&k6Sample{Metric: "http_reqs", Type: "counter", Value: 1, Tags: tags})
+	sink.addSample(&k6Sample{Metric: "http_req_duration", Type: "trend", Value: 12.5, Tags: tags})
+	sink.addSample(&k6Sample{Metric: "http_req_failed", Type: "rate", Value: 0, Tags: tags})
+	sink.addSample(&k6Sample{Metric: "vus", Type: "gauge", Value: 10})
+
+	// close会立即推送一次，不必等待导出周期
+	sink.(k6SinkCloser).close()
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	for _, name := range []string{"k6.http_reqs", "k6.http_req_duration", "k6.http_req_failed", "k6.vus"} {
+		assert.True(t, collector.metrics[name], "metric %s", name)
+	}
+
+	// 只导出白名单中的标签和agent_id，任务ID和url等取值无限的标签不会成为属性
+	assert.Equal(t, map[string]string{"agent_id": "agent-1", "env": "staging", "method": "GET", "status": "200"}, collector.attrs["k6.http_reqs"])
+	assert.Equal(t, map[string]string{"agent_id": "agent-1", "env": "staging"}, collector.attrs["k6.vus"])
+}
+
+func TestTelemetryK6GaugeSumsTasks(t *testing.T) {
+	collector, server := newOTLPCollector(t)
+
+	tel, err := newTelemetry(telemetryConfig{Enabled: true, Endpoint: server.URL, ExportK6Metrics: true, MetricInterval: time.Hour})
+	require.NoError(t, err)
+	defer tel.shutdown(context.Background())
+
+	tags := map[string]string{"agent_id": "agent-1"}
+	first := tel.k6Sink("job-1", tags)
+	second := tel.k6Sink("job-2", tags)
+	first.addSample(&k6Sample{Metric: "vus", Type: "gauge", Value: 10})
+	second.addSample(&k6Sample{Metric: "vus", Type: "gauge", Value: 5})
+
+	first.(k6SinkCloser).close()
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	// 两个任务属性相同，只上报一个数据点，值为两者之和
+	assert.Equal(t, []float64{15}, collector.gauges["k6.vus"])
+}
+
+func TestTelemetryRejectsInvalidEndpoint(t *testing.T) {
+	tel, err := newTelemetry(telemetryConfig{Enabled: true, Endpoint: "localhost"})
+	assert.Error(t, err)
+	require.NotNil(t, tel)
+	assert.Nil(t, tel.k6Sink("job-1", nil))
+}